@@ -0,0 +1,336 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// Package agent keeps a node's WireGuard device in line with
+// the config the control plane renders for it
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/karasz/gomesh/wireguard"
+)
+
+const (
+	minBackoff = time.Second
+	maxBackoff = 5 * time.Minute
+)
+
+// Agent polls the control plane for the config of its node
+// and applies it to a Device
+type Agent struct {
+	// Server is the base URL of the control plane
+	Server string
+	// Name is the name of the node in the registry
+	Name string
+	// Token is the bootstrap bearer token the server binds to the
+	// node, used until the node knows its private key
+	Token string
+	// PrivateKey is the node's key, requests are signed with it
+	PrivateKey string
+	// Device is where the configs are applied
+	Device Device
+	// Cache is where the last config is kept, it is applied on
+	// start so the node keeps working while the server is down
+	Cache string
+	// Wait is how long the server may hold a request waiting
+	// for changes, zero means plain polling every Interval
+	Wait time.Duration
+	// Interval is the time between two polls
+	Interval time.Duration
+	// Client is the HTTP client used, http.DefaultClient if nil
+	Client *http.Client
+	// Logf is used for logging, log.Printf if nil
+	Logf func(format string, args ...interface{})
+	// NoReport disables reporting the addresses of this node
+	NoReport bool
+	// NAT and Site are reported along with the addresses when set
+	NAT  string
+	Site string
+	// NoProbe disables the echo service and the probing of other nodes
+	NoProbe bool
+	// ProbeProto and ProbePort are how the other nodes are probed,
+	// udp and probe.DefaultPort when empty
+	ProbeProto string
+	ProbePort  int
+	// ProbeInterval is the time between two probing rounds and
+	// ProbeFanout the number of nodes probed in each, all if zero
+	ProbeInterval time.Duration
+	ProbeFanout   int
+
+	// mu guards PrivateKey, serverKey, refused and addresses,
+	// which the reporting and probing goroutines use too
+	mu        sync.Mutex
+	serverKey string
+	// refused is set when a signed request was refused, the
+	// bootstrap token is used until a new config is applied
+	refused bool
+	etag    string
+	// addresses are the mesh addresses of the node, they
+	// are not reported as LAN addresses
+	addresses  []string
+	lastReport string
+	reportedAt time.Time
+	probeRound int
+	// responding holds the addresses the echo service
+	// listens on and stopResponders stops it
+	responding     string
+	stopResponders context.CancelFunc
+	responderErrs  chan error
+}
+
+// Run will keep the device up to date until ctx is done
+func (a *Agent) Run(ctx context.Context) error {
+	if a.Cache != "" {
+		if err := a.applyCache(); err != nil && !os.IsNotExist(err) {
+			a.logf("cached config: %v", err)
+		}
+	}
+
+	if !a.NoReport {
+		go a.reportLoop(ctx)
+	}
+	if !a.NoProbe {
+		go a.probeLoop(ctx)
+	}
+
+	failures := 0
+	for {
+		err := a.poll(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		delay := a.Interval
+		if err != nil {
+			failures++
+			delay = backoff(failures)
+			a.logf("poll: %v, retrying in %s", err, delay.Round(time.Millisecond))
+		} else {
+			failures = 0
+			if a.Wait > 0 {
+				delay = 0
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// backoff is exponential with jitter, so that nodes
+// do not all come back at once after an outage
+func backoff(failures int) time.Duration {
+	d := maxBackoff
+	if failures < 20 {
+		if d = minBackoff << uint(failures-1); d > maxBackoff {
+			d = maxBackoff
+		}
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (a *Agent) applyCache() error {
+	b, err := os.ReadFile(a.Cache)
+	if err != nil {
+		return err
+	}
+	if err = a.apply(b); err != nil {
+		return err
+	}
+	a.etag = wireguard.ConfigETag(b)
+	a.logf("applied cached config %s", a.Cache)
+	return nil
+}
+
+// poll will fetch the config once and apply it if it changed
+func (a *Agent) poll(ctx context.Context) error {
+	u := fmt.Sprintf("%s/v1/nodes/%s/config", strings.TrimRight(a.Server, "/"), url.PathEscape(a.Name))
+	if a.Wait > 0 {
+		u += "?wait=" + a.Wait.String()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	if a.etag != "" {
+		req.Header.Set("If-None-Match", a.etag)
+	}
+	if err = a.authorize(ctx, req); err != nil {
+		return err
+	}
+
+	resp, err := a.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		// the key may have been rotated, the token gets the new one
+		if a.Token != "" && strings.HasPrefix(req.Header.Get("Authorization"), wireguard.SignatureScheme+" ") {
+			a.mu.Lock()
+			a.refused = true
+			a.mu.Unlock()
+		}
+		fallthrough
+	default:
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if err = a.apply(b); err != nil {
+		return err
+	}
+	a.etag = resp.Header.Get("ETag")
+	a.logf("applied new config %s", a.etag)
+	if a.Cache != "" {
+		if err = os.MkdirAll(filepath.Dir(a.Cache), 0700); err != nil {
+			return err
+		}
+		return os.WriteFile(a.Cache, b, 0600)
+	}
+	return nil
+}
+
+func (a *Agent) apply(b []byte) error {
+	c, err := wireguard.ParseConfig(b)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	// nodes that joined hold their own key, the server does not know
+	// it; the key the server serves wins, it changes when rotated
+	if c.Interface.PrivateKey != "" {
+		a.PrivateKey = c.Interface.PrivateKey
+	} else {
+		c.Interface.PrivateKey = a.PrivateKey
+	}
+	a.addresses = c.Interface.Address
+	a.refused = false
+	a.mu.Unlock()
+	return a.Device.Apply(c)
+}
+
+// authorize will sign the request with the node key if it is
+// known and was not refused, or else use the bootstrap token
+func (a *Agent) authorize(ctx context.Context, req *http.Request) error {
+	a.mu.Lock()
+	key, serverKey := a.PrivateKey, a.serverKey
+	if a.refused && a.Token != "" {
+		key = ""
+	}
+	a.mu.Unlock()
+	if key != "" && serverKey == "" {
+		pub, err := a.fetchServerKey(ctx)
+		if err != nil && a.Token == "" {
+			return err
+		}
+		if err == nil {
+			a.mu.Lock()
+			a.serverKey, serverKey = pub, pub
+			a.mu.Unlock()
+		}
+	}
+	if key != "" && serverKey != "" {
+		var body []byte
+		if req.GetBody != nil {
+			rc, err := req.GetBody()
+			if err != nil {
+				return err
+			}
+			body, err = io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		}
+		h, err := wireguard.SignRequest(a.Name, key, serverKey, req.Method, req.URL.RequestURI(), body, time.Now())
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", h)
+		return nil
+	}
+	if a.Token == "" {
+		return errors.New("no private key and no bootstrap token")
+	}
+	req.Header.Set("Authorization", "Bearer "+a.Token)
+	return nil
+}
+
+// fetchServerKey will return the public key of the control plane
+func (a *Agent) fetchServerKey(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(a.Server, "/")+"/v1/server", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := a.client().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var v struct{ PublicKey string }
+	if err = json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return "", err
+	}
+	if v.PublicKey == "" {
+		return "", errors.New("server does not accept signed requests")
+	}
+	return v.PublicKey, nil
+}
+
+func (a *Agent) client() *http.Client {
+	if a.Client != nil {
+		return a.Client
+	}
+	return http.DefaultClient
+}
+
+func (a *Agent) logf(format string, args ...interface{}) {
+	if a.Logf != nil {
+		a.Logf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
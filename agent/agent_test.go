@@ -0,0 +1,280 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package agent
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/karasz/gomesh/server"
+	"github.com/karasz/gomesh/wireguard"
+)
+
+const (
+	adminToken = "admin-token"
+	nodeToken  = "node-a-token"
+)
+
+// fakeDevice records the configs applied to it
+type fakeDevice struct {
+	mu      sync.Mutex
+	applied []wireguard.Config
+}
+
+// Apply implements Device
+func (d *fakeDevice) Apply(c wireguard.Config) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.applied = append(d.applied, c)
+	return nil
+}
+
+// waitFor will wait until a config matching ok is applied
+func (d *fakeDevice) waitFor(t *testing.T, what string, ok func(wireguard.Config) bool) wireguard.Config {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		d.mu.Lock()
+		for _, c := range d.applied {
+			if ok(c) {
+				d.mu.Unlock()
+				return c
+			}
+		}
+		d.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no config %s was applied", what)
+	return wireguard.Config{}
+}
+
+func hasPeer(name string) func(wireguard.Config) bool {
+	return func(c wireguard.Config) bool {
+		for _, pc := range c.Peers {
+			if pc.Name == name {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// newMesh will start a control plane serving a registry of two nodes
+func newMesh(t *testing.T) (*httptest.Server, wireguard.Peers) {
+	t.Helper()
+	peers, err := wireguard.LoadPeers(filepath.Join(t.TempDir(), "database.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pr := range []wireguard.Peer{
+		{Name: "a", Address: []string{"10.0.0.1/32"}, Endpoint: "192.0.2.1"},
+		{Name: "b", Address: []string{"10.0.0.2/32"}, Endpoint: "192.0.2.2"},
+	} {
+		if err = peers.AddPeer(pr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	key, err := wireguard.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(server.New(peers, []string{adminToken}, map[string]string{"a": nodeToken}, key))
+	t.Cleanup(ts.Close)
+	return ts, peers
+}
+
+// admin will make a request to the control plane with the admin token
+func admin(t *testing.T, ts *httptest.Server, method, path, body string) {
+	t.Helper()
+	req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		t.Fatalf("%s %s: %s", method, path, resp.Status)
+	}
+}
+
+func runAgent(t *testing.T, a *Agent) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		a.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func TestAgentConverges(t *testing.T) {
+	ts, _ := newMesh(t)
+	dev := &fakeDevice{}
+	cache := filepath.Join(t.TempDir(), "a.conf")
+	runAgent(t, &Agent{Server: ts.URL, Name: "a", Token: nodeToken, Device: dev, Cache: cache,
+		Wait: time.Second, Interval: 50 * time.Millisecond, NoReport: true, NoProbe: true, Logf: t.Logf})
+
+	c := dev.waitFor(t, "with b", hasPeer("b"))
+	if c.Interface.PrivateKey == "" {
+		t.Error("applied config has no private key")
+	}
+	if b, err := os.ReadFile(cache); err != nil || !strings.Contains(string(b), "# Name: b") {
+		t.Errorf("config not cached: %v", err)
+	}
+
+	// the agent signs its requests from now on
+	admin(t, ts, http.MethodPost, "/v1/nodes", `{"Name":"c","Address":["10.0.0.3/32"],"Endpoint":"192.0.2.3"}`)
+	dev.waitFor(t, "with c", hasPeer("c"))
+}
+
+func TestAgentRotatedKey(t *testing.T) {
+	ts, peers := newMesh(t)
+	old, _ := peers.Get("a")
+	dev := &fakeDevice{}
+	a := &Agent{Server: ts.URL, Name: "a", Token: nodeToken, Device: dev,
+		Wait: time.Second, Interval: 50 * time.Millisecond, NoReport: true, NoProbe: true, Logf: t.Logf}
+	runAgent(t, a)
+	dev.waitFor(t, "with b", hasPeer("b"))
+
+	admin(t, ts, http.MethodPost, "/v1/nodes/a/rotate", "")
+	c := dev.waitFor(t, "with the new key", func(c wireguard.Config) bool {
+		return c.Interface.PrivateKey != old.PrivateKey
+	})
+	// signed with the new key the agent still gets changes
+	admin(t, ts, http.MethodPost, "/v1/nodes", `{"Name":"c","Address":["10.0.0.3/32"],"Endpoint":"192.0.2.3"}`)
+	dev.waitFor(t, "with c", hasPeer("c"))
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.PrivateKey != c.Interface.PrivateKey {
+		t.Error("the agent still signs with the old key")
+	}
+}
+
+func TestAgentCache(t *testing.T) {
+	ts, peers := newMesh(t)
+	pr, _ := peers.Get("a")
+	c, err := peers.Config(pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := filepath.Join(t.TempDir(), "a.conf")
+	if err = os.WriteFile(cache, []byte(c.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// the control plane is down
+	ts.Close()
+
+	dev := &fakeDevice{}
+	var mu sync.Mutex
+	var logs []string
+	runAgent(t, &Agent{Server: ts.URL, Name: "a", Token: nodeToken, Device: dev, Cache: cache,
+		Interval: time.Millisecond, NoReport: true, NoProbe: true,
+		Logf: func(format string, args ...interface{}) {
+			mu.Lock()
+			defer mu.Unlock()
+			logs = append(logs, format)
+		}})
+	dev.waitFor(t, "from the cache", hasPeer("b"))
+
+	// the retries back off instead of following Interval
+	time.Sleep(1500 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	polls := 0
+	for _, l := range logs {
+		if strings.HasPrefix(l, "poll:") {
+			polls++
+		}
+	}
+	if polls == 0 || polls > 3 {
+		t.Errorf("%d failed polls in 1.5s, expected backing off", polls)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		max      time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{5, 16 * time.Second},
+		{9, 256 * time.Second},
+		{10, maxBackoff},
+		{100, maxBackoff},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			if d := backoff(tt.failures); d < tt.max/2 || d > tt.max {
+				t.Fatalf("backoff(%d) = %s, expected between %s and %s", tt.failures, d, tt.max/2, tt.max)
+			}
+		}
+	}
+}
+
+func TestWgctrlRefuses(t *testing.T) {
+	if _, err := net.InterfaceByName("lo"); err != nil {
+		t.Skip("no lo interface")
+	}
+	tests := []struct {
+		name string
+		c    wireguard.Config
+		err  string
+	}{
+		{name: "keys and peers", c: wireguard.Config{Interface: wireguard.Interface{Address: []string{"127.0.0.1/8"}, ListenPort: 51820}}},
+		{name: "hooks", c: wireguard.Config{Interface: wireguard.Interface{
+			Address: []string{"127.0.0.1/8"},
+			PostUp:  []string{"ip route add 10.0.0.0/24 dev %i"},
+			PreDown: []string{"true"},
+		}}, err: "needs PostUp, PreDown"},
+		{name: "dns", c: wireguard.Config{Interface: wireguard.Interface{Address: []string{"127.0.0.1/8"}, DNS: "10.0.0.53"}}, err: "needs DNS"},
+		{name: "missing address", c: wireguard.Config{Interface: wireguard.Interface{Address: []string{"10.99.0.1/32"}}}, err: "address 10.99.0.1/32 is not set"},
+		{name: "mtu", c: wireguard.Config{Interface: wireguard.Interface{Address: []string{"127.0.0.1/8"}, MTU: 1280}}, err: "MTU"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := keysAndPeers(tt.c)
+			if err == nil {
+				err = hasInterface("lo", tt.c)
+			}
+			if (tt.err == "") != (err == nil) || (err != nil && !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("got %v, expected %q", err, tt.err)
+			}
+		})
+	}
+}
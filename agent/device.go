@@ -0,0 +1,221 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package agent
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/karasz/gomesh/wireguard"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Device applies configs to a WireGuard interface
+type Device interface {
+	Apply(c wireguard.Config) error
+}
+
+// WgctrlDevice configures the keys and peers of an existing interface
+// through wgctrl. Addresses, MTU and routes are left alone, configs
+// needing DNS or PreUp/PostUp/PreDown/PostDown commands are refused
+type WgctrlDevice struct {
+	Name string
+}
+
+// Apply implements Device
+func (d WgctrlDevice) Apply(c wireguard.Config) error {
+	if err := keysAndPeers(c); err != nil {
+		return err
+	}
+	if err := hasInterface(d.Name, c); err != nil {
+		return err
+	}
+	cfg, err := WgtypesConfig(c)
+	if err != nil {
+		return err
+	}
+	client, err := wgctrl.New()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return client.ConfigureDevice(d.Name, cfg)
+}
+
+// keysAndPeers will refuse the configs wgctrl cannot apply in full
+func keysAndPeers(c wireguard.Config) error {
+	var need []string
+	if c.Interface.DNS != "" {
+		need = append(need, "DNS")
+	}
+	for _, h := range []struct {
+		name string
+		cmds []string
+	}{
+		{"PreUp", c.Interface.PreUp},
+		{"PostUp", c.Interface.PostUp},
+		{"PreDown", c.Interface.PreDown},
+		{"PostDown", c.Interface.PostDown},
+	} {
+		if len(h.cmds) > 0 {
+			need = append(need, h.name)
+		}
+	}
+	if len(need) > 0 {
+		return fmt.Errorf("the config needs %s, wgctrl only sets keys and peers, use the wg-quick mode", strings.Join(need, ", "))
+	}
+	return nil
+}
+
+// hasInterface will check that the interface already has
+// the addresses and MTU of the config
+func hasInterface(name string, c wireguard.Config) error {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+	if c.Interface.MTU != 0 && iface.MTU != c.Interface.MTU {
+		return fmt.Errorf("%s: MTU is %d, the config has %d", name, iface.MTU, c.Interface.MTU)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return err
+	}
+	for _, a := range c.Interface.Address {
+		pfx, err := wireguard.ParseAddress(a)
+		if err != nil {
+			return err
+		}
+		var found bool
+		for _, ia := range addrs {
+			if n, ok := ia.(*net.IPNet); ok && n.IP.Equal(net.IP(pfx.Addr().AsSlice())) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: address %s is not set", name, a)
+		}
+	}
+	return nil
+}
+
+// WgQuickDevice writes a wg-quick file and reloads the interface,
+// bringing it up if it is not
+type WgQuickDevice struct {
+	Name string
+	Path string
+}
+
+// Apply implements Device
+func (d WgQuickDevice) Apply(c wireguard.Config) error {
+	if err := os.MkdirAll(filepath.Dir(d.Path), 0700); err != nil {
+		return err
+	}
+	tmp := d.Path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(c.String()), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, d.Path); err != nil {
+		return err
+	}
+
+	if _, err := net.InterfaceByName(d.Name); err != nil {
+		return run("wg-quick", "up", d.Path)
+	}
+	stripped, err := exec.Command("wg-quick", "strip", d.Path).Output()
+	if err != nil {
+		return fmt.Errorf("wg-quick strip: %v", err)
+	}
+	f, err := os.CreateTemp("", "gomesh-*.conf")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(stripped); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return run("wg", "syncconf", d.Name, f.Name())
+}
+
+func run(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %v: %s", name, err, out)
+	}
+	return nil
+}
+
+// WgtypesConfig will convert a config to the form wgctrl expects,
+// replacing all the peers of the device
+func WgtypesConfig(c wireguard.Config) (wgtypes.Config, error) {
+	cfg := wgtypes.Config{ReplacePeers: true}
+	if c.Interface.PrivateKey != "" {
+		k, err := wgtypes.ParseKey(c.Interface.PrivateKey)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.PrivateKey = &k
+	}
+	if c.Interface.ListenPort != 0 {
+		cfg.ListenPort = &c.Interface.ListenPort
+	}
+	if c.Interface.FwMark != 0 {
+		cfg.FirewallMark = &c.Interface.FwMark
+	}
+
+	for _, pc := range c.Peers {
+		k, err := wgtypes.ParseKey(pc.PublicKey)
+		if err != nil {
+			return cfg, fmt.Errorf("peer %s: %v", pc.Name, err)
+		}
+		p := wgtypes.PeerConfig{PublicKey: k, ReplaceAllowedIPs: true}
+		if pc.Endpoint != "" {
+			if p.Endpoint, err = net.ResolveUDPAddr("udp", pc.Endpoint); err != nil {
+				return cfg, fmt.Errorf("peer %s: %v", pc.Name, err)
+			}
+		}
+		if pc.PersistentKeepalive != 0 {
+			d := time.Duration(pc.PersistentKeepalive) * time.Second
+			p.PersistentKeepaliveInterval = &d
+		}
+		for _, a := range pc.AllowedIPs {
+			_, n, err := net.ParseCIDR(a)
+			if err != nil {
+				return cfg, fmt.Errorf("peer %s: %v", pc.Name, err)
+			}
+			p.AllowedIPs = append(p.AllowedIPs, *n)
+		}
+		cfg.Peers = append(cfg.Peers, p)
+	}
+	return cfg, nil
+}
@@ -0,0 +1,106 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/karasz/gomesh/wireguard"
+)
+
+// JoinRequest describes the node redeeming an enrollment token
+type JoinRequest struct {
+	Token      string
+	Name       string
+	Endpoint   string
+	ListenPort int
+	Hostname   string
+	// Type is server, client or roaming
+	Type string
+	// Tags are only given to the node once an admin approves it
+	Tags []string
+}
+
+// ErrPending is returned by Join when the node
+// has to wait for an admin to approve it
+var ErrPending = errors.New("join request is pending approval")
+
+// Join will generate a key pair, register the node with the control
+// plane sending only the public key, and return the node's config
+// holding the private key that never left this host. If the network
+// requires approval the config is returned along with ErrPending
+func Join(ctx context.Context, client *http.Client, serverURL string, jr JoinRequest) (wireguard.Config, error) {
+	var c wireguard.Config
+	key, err := wireguard.GenerateKey()
+	if err != nil {
+		return c, err
+	}
+	pub, err := wireguard.PublicKey(key)
+	if err != nil {
+		return c, err
+	}
+
+	body, err := json.Marshal(struct {
+		JoinRequest
+		PublicKey string
+	}{jr, pub})
+	if err != nil {
+		return c, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(serverURL, "/")+"/v1/join", bytes.NewReader(body))
+	if err != nil {
+		return c, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return c, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusAccepted {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return c, fmt.Errorf("join: %s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+
+	var jresp struct{ Config string }
+	if err = json.NewDecoder(resp.Body).Decode(&jresp); err != nil {
+		return c, err
+	}
+	if c, err = wireguard.ParseConfig([]byte(jresp.Config)); err != nil {
+		return c, err
+	}
+	c.Interface.PrivateKey = key
+	if resp.StatusCode == http.StatusAccepted {
+		return c, ErrPending
+	}
+	return c, nil
+}
@@ -0,0 +1,171 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/karasz/gomesh/probe"
+	"github.com/karasz/gomesh/wireguard"
+)
+
+const defaultProbeInterval = time.Minute
+
+// probeLoop will answer the probes of the other nodes and
+// probe them every ProbeInterval until ctx is done
+func (a *Agent) probeLoop(ctx context.Context) {
+	interval := a.ProbeInterval
+	if interval == 0 {
+		interval = defaultProbeInterval
+	}
+	port := a.ProbePort
+	if port == 0 {
+		port = probe.DefaultPort
+	}
+	a.responderErrs = make(chan error, 1)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		a.respond(ctx, port)
+		if err := a.probe(ctx); err != nil && ctx.Err() == nil {
+			a.logf("probe: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// respond will run the echo service on the mesh addresses of the
+// node, it is restarted when they change or it failed
+func (a *Agent) respond(ctx context.Context, port int) {
+	select {
+	case err := <-a.responderErrs:
+		a.logf("probe responder: %v", err)
+		a.responding = ""
+	default:
+	}
+	a.mu.Lock()
+	addresses := a.addresses
+	a.mu.Unlock()
+	key := strings.Join(addresses, ",")
+	if key == a.responding {
+		return
+	}
+	if a.stopResponders != nil {
+		a.stopResponders()
+	}
+	var rctx context.Context
+	rctx, a.stopResponders = context.WithCancel(ctx)
+	a.responding = key
+	for _, addr := range addresses {
+		pfx, err := wireguard.ParseAddress(addr)
+		if err != nil {
+			continue
+		}
+		r := probe.Responder{Addr: net.JoinHostPort(pfx.Addr().String(), strconv.Itoa(port))}
+		go func() {
+			if err := r.ListenAndServe(rctx); err != nil && rctx.Err() == nil {
+				select {
+				case a.responderErrs <- err:
+				default:
+				}
+			}
+		}()
+	}
+}
+
+// probe will measure the round trips to a rotating subset of the
+// nodes this one can reach and send them to the control plane
+func (a *Agent) probe(ctx context.Context) error {
+	u := fmt.Sprintf("%s/v1/nodes/%s/probes", strings.TrimRight(a.Server, "/"), url.PathEscape(a.Name))
+	var targets []wireguard.ProbeTarget
+	if err := a.call(ctx, http.MethodGet, u, nil, &targets); err != nil {
+		return err
+	}
+	targets = probe.Rotate(targets, a.probeRound, a.ProbeFanout)
+	a.probeRound++
+	if len(targets) == 0 {
+		return nil
+	}
+
+	p := probe.Prober{Proto: a.ProbeProto, Port: a.ProbePort, Count: 5, Interval: 200 * time.Millisecond}
+	probes := make([]wireguard.Probe, len(targets))
+	var wg sync.WaitGroup
+	for i := range targets {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			probes[i] = p.Probe(ctx, targets[i])
+		}(i)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	body, err := json.Marshal(probes)
+	if err != nil {
+		return err
+	}
+	return a.call(ctx, http.MethodPost, u, body, nil)
+}
+
+// call will make a signed request to the control plane
+// and decode the answer into v unless it is nil
+func (a *Agent) call(ctx context.Context, method, u string, body []byte, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if err = a.authorize(ctx, req); err != nil {
+		return err
+	}
+	resp, err := a.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,139 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/karasz/gomesh/wireguard"
+)
+
+// reportInterval is how often a node reports even when its LAN
+// addresses did not change, so that a new public address is seen
+const reportInterval = 5 * time.Minute
+
+// reportCheck is how often a node looks for changed addresses
+const reportCheck = time.Minute
+
+// reportLoop will report the addresses of the node
+// whenever they change until ctx is done
+func (a *Agent) reportLoop(ctx context.Context) {
+	t := time.NewTicker(reportCheck)
+	defer t.Stop()
+	for {
+		if err := a.report(ctx); err != nil && ctx.Err() == nil {
+			a.logf("report: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// report will tell the control plane the addresses this node can be
+// reached on when they changed or reportInterval has passed
+func (a *Agent) report(ctx context.Context) error {
+	a.mu.Lock()
+	mesh := a.addresses
+	a.mu.Unlock()
+	lan, err := lanAddresses(mesh)
+	if err != nil {
+		return err
+	}
+	r := wireguard.Report{LANAddresses: lan, NAT: a.NAT, Site: a.Site}
+	key := strings.Join(lan, ",") + "|" + a.NAT + "|" + a.Site
+	if key == a.lastReport && time.Since(a.reportedAt) < reportInterval {
+		return nil
+	}
+
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	u := fmt.Sprintf("%s/v1/nodes/%s/report", strings.TrimRight(a.Server, "/"), url.PathEscape(a.Name))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err = a.authorize(ctx, req); err != nil {
+		return err
+	}
+	resp, err := a.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	a.lastReport, a.reportedAt = key, time.Now()
+	return nil
+}
+
+// lanAddresses will return the addresses of this host in CIDR
+// notation, leaving out loopback, link-local and mesh addresses
+func lanAddresses(mesh []string) ([]string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	var lan []string
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() || ipnet.IP.IsMulticast() {
+			continue
+		}
+		if inMesh(ipnet.IP, mesh) {
+			continue
+		}
+		lan = append(lan, ipnet.String())
+	}
+	sort.Strings(lan)
+	return lan, nil
+}
+
+func inMesh(ip net.IP, mesh []string) bool {
+	for _, m := range mesh {
+		other, _, err := net.ParseCIDR(m)
+		if err != nil {
+			other = net.ParseIP(m)
+		}
+		if other != nil && other.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -22,6 +22,7 @@ THE SOFTWARE.
 package cmd
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/karasz/gomesh/wireguard"
@@ -45,13 +46,53 @@ var addCmd = &cobra.Command{
 		fwmark, _ := cmd.Flags().GetInt("fwmark")
 		dns, _ := cmd.Flags().GetString("dns")
 		mtu, _ := cmd.Flags().GetInt("mtu")
-		table, _ := cmd.Flags().GetString("table")
+		table, _ := cmd.Flags().GetString("routing_table")
 		preup, _ := cmd.Flags().GetString("preup")
 		predown, _ := cmd.Flags().GetString("predown")
 		postup, _ := cmd.Flags().GetString("postup")
 		postdown, _ := cmd.Flags().GetString("postdown")
 		saveconfig, _ := cmd.Flags().GetBool("saveconfig")
-		p := wireguard.Peer{Name: name, PrivateKey: privatekey, Address: address, ListenPort: listenport, Endpoint: endpoint, AllowedIPs: allowedips, FwMark: fwmark, DNS: dns, MTU: mtu, Table: table, PreUp: preup, PostUp: postup, PreDown: predown, PostDown: postdown, SaveConfig: saveconfig}
+		role, _ := cmd.Flags().GetString("role")
+		tags, _ := cmd.Flags().GetStringSlice("tags")
+		network, _ := cmd.Flags().GetString("network")
+		site, _ := cmd.Flags().GetString("site")
+		nat, _ := cmd.Flags().GetString("nat")
+		relay, _ := cmd.Flags().GetBool("relay")
+		nodeType, _ := cmd.Flags().GetString("type")
+		switch nodeType {
+		case "", wireguard.TypeServer:
+			if endpoint == "" {
+				return errors.New("an endpoint is needed for server nodes, use --type client or roaming for nodes without one")
+			}
+		case wireguard.TypeRoaming:
+			if !cmd.Flags().Changed("listenport") {
+				listenport = 0
+			}
+		}
+		if len(address) == 0 {
+			if network == "" {
+				return errors.New("an address is needed when not adding to a network")
+			}
+			networks, err := wireguard.LoadNetworks()
+			if err != nil {
+				return err
+			}
+			nw, err := networks.Get(network)
+			if err != nil {
+				return err
+			}
+			address, err = thePeers.Allocate(nw)
+			if err != nil {
+				return err
+			}
+		}
+		p := wireguard.Peer{Name: name, PrivateKey: privatekey, Address: address, ListenPort: listenport, Endpoint: endpoint, AllowedIPs: allowedips, FwMark: fwmark, DNS: dns, MTU: mtu, Table: table, PreUp: preup, PostUp: postup, PreDown: predown, PostDown: postdown, SaveConfig: saveconfig, Role: role, Tags: tags, Network: network, Site: site, NAT: nat, Relay: relay, Type: nodeType}
+		update, _ := cmd.Flags().GetBool("update")
+		if update {
+			if _, err := thePeers.Get(name); err == nil {
+				return thePeers.UpdatePeer(p)
+			}
+		}
 		err := thePeers.AddPeer(p)
 		return err
 	},
@@ -61,8 +102,8 @@ func init() {
 	var err error
 	addCmd.Flags().BoolP("update", "u", false, "Update Peer if existing.")
 	addCmd.Flags().StringP("name", "n", "", "Name of the node. (Required)")
-	addCmd.Flags().StringSliceP("address", "a", []string{}, "Address of the node. (Required)")
-	addCmd.Flags().StringP("endpoint", "e", "", "The node's endpoint")
+	addCmd.Flags().StringSliceP("address", "a", []string{}, "Address of the node. (Required unless a network is given)")
+	addCmd.Flags().StringP("endpoint", "e", "", "The node's endpoint (Required for servers)")
 	addCmd.Flags().StringSliceP("allowedips", "", []string{}, "Additional allowed IP addresses")
 	addCmd.Flags().StringP("privatekey", "p", "", "Private key of server interface (if none given one will be generated")
 	addCmd.Flags().IntP("listenport", "l", 51820, "Port to listen on, default 51820")
@@ -75,18 +116,17 @@ func init() {
 	addCmd.Flags().StringP("preDown", "", "", "Command to run before bringing the interface DOWN")
 	addCmd.Flags().StringP("postDown", "", "", "Command to run after bringing the interface DOWN")
 	addCmd.Flags().BoolP("saveconfig", "s", false, "Save config between reboots")
+	addCmd.Flags().StringP("role", "", "", "Role of the node (e.g. hub)")
+	addCmd.Flags().StringSliceP("tags", "t", []string{}, "Tags of the node")
+	addCmd.Flags().StringP("network", "", "", "Network of the node, an address is allocated from it if none is given")
+	addCmd.Flags().StringP("site", "", "", "Site of the node, nodes of a site use their LAN addresses")
+	addCmd.Flags().StringP("nat", "", "", "NAT the node is behind (none, cone, symmetric)")
+	addCmd.Flags().BoolP("relay", "", false, "Forward traffic for pairs of nodes that cannot reach each other")
+	addCmd.Flags().StringP("type", "", wireguard.TypeServer, "Type of the node (server, client, roaming)")
 	err = addCmd.MarkFlagRequired("name")
 	if err != nil {
 		fmt.Println(err)
 	}
-	err = addCmd.MarkFlagRequired("address")
-	if err != nil {
-		fmt.Println(err)
-	}
-	err = addCmd.MarkFlagRequired("endpoint")
-	if err != nil {
-		fmt.Println(err)
-	}
 
 	rootCmd.AddCommand(addCmd)
 }
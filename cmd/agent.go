@@ -0,0 +1,128 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/karasz/gomesh/agent"
+	"github.com/karasz/gomesh/probe"
+	"github.com/spf13/cobra"
+)
+
+// agentCmd represents the agent command
+var agentCmd = &cobra.Command{
+	Use:   "agent",
+	Short: "Keep this node's config in line with the control plane",
+	Long: `Agent will poll the control plane for the config of this node and apply it,
+either through wgctrl or by rewriting and reloading a wg-quick file.
+wgctrl only sets keys and peers on an interface that already has its
+addresses, configs with DNS or up/down commands need wg-quick.
+Requests are signed with the node's WireGuard key once it is known,
+the bootstrap token is used until then.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		serverURL, _ := cmd.Flags().GetString("server")
+		token, _ := cmd.Flags().GetString("token")
+		name, _ := cmd.Flags().GetString("name")
+		keyFile, _ := cmd.Flags().GetString("key_file")
+		device, _ := cmd.Flags().GetString("device")
+		mode, _ := cmd.Flags().GetString("mode")
+		configPath, _ := cmd.Flags().GetString("config_path")
+		cache, _ := cmd.Flags().GetString("cache")
+		wait, _ := cmd.Flags().GetDuration("wait")
+		interval, _ := cmd.Flags().GetDuration("interval")
+		noReport, _ := cmd.Flags().GetBool("no_report")
+		nat, _ := cmd.Flags().GetString("nat")
+		site, _ := cmd.Flags().GetString("site")
+		noProbe, _ := cmd.Flags().GetBool("no_probe")
+		probeProto, _ := cmd.Flags().GetString("probe_proto")
+		probePort, _ := cmd.Flags().GetInt("probe_port")
+		probeInterval, _ := cmd.Flags().GetDuration("probe_interval")
+		probeFanout, _ := cmd.Flags().GetInt("probe_fanout")
+
+		a := &agent.Agent{Server: serverURL, Name: name, Token: token, Cache: cache, Wait: wait, Interval: interval, NoReport: noReport, NAT: nat, Site: site,
+			NoProbe: noProbe, ProbeProto: probeProto, ProbePort: probePort, ProbeInterval: probeInterval, ProbeFanout: probeFanout}
+		if probeProto != "udp" && probeProto != "tcp" {
+			return fmt.Errorf("unknown probe protocol %q", probeProto)
+		}
+		if keyFile != "" {
+			b, err := os.ReadFile(keyFile)
+			if err != nil {
+				return err
+			}
+			a.PrivateKey = strings.TrimSpace(string(b))
+		}
+		switch mode {
+		case "wgctrl":
+			a.Device = agent.WgctrlDevice{Name: device}
+		case "wg-quick":
+			if configPath == "" {
+				configPath = "/etc/wireguard/" + device + ".conf"
+			}
+			a.Device = agent.WgQuickDevice{Name: device, Path: configPath}
+		default:
+			return fmt.Errorf("unknown mode %q", mode)
+		}
+		if a.Cache == "" {
+			a.Cache = "/var/lib/gomesh/" + name + ".conf"
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		if err := a.Run(ctx); err != context.Canceled {
+			return err
+		}
+		return nil
+	},
+}
+
+func init() {
+	agentCmd.Flags().StringP("server", "s", "", "URL of the control plane (Required)")
+	agentCmd.Flags().StringP("token", "t", "", "Bootstrap bearer token bound to this node by the server")
+	agentCmd.Flags().StringP("name", "n", "", "Name of this node (Required)")
+	agentCmd.Flags().StringP("key_file", "k", "", "File holding this node's private key")
+	agentCmd.Flags().StringP("device", "", "wg0", "WireGuard interface to manage")
+	agentCmd.Flags().StringP("mode", "m", "wgctrl", "How to apply configs (wgctrl, wg-quick)")
+	agentCmd.Flags().StringP("config_path", "", "", "wg-quick file to write (default /etc/wireguard/<device>.conf)")
+	agentCmd.Flags().StringP("cache", "", "", "Local config cache (default /var/lib/gomesh/<name>.conf)")
+	agentCmd.Flags().DurationP("wait", "w", time.Minute, "How long the server may hold a poll, 0 to poll every interval")
+	agentCmd.Flags().DurationP("interval", "i", 30*time.Second, "Time between polls when not long polling")
+	agentCmd.Flags().BoolP("no_report", "", false, "Do not report the addresses of this node")
+	agentCmd.Flags().StringP("nat", "", "", "NAT this node is behind (none, cone, symmetric)")
+	agentCmd.Flags().StringP("site", "", "", "Site of this node, nodes of a site use their LAN addresses")
+	agentCmd.Flags().BoolP("no_probe", "", false, "Do not answer or send reachability probes")
+	agentCmd.Flags().StringP("probe_proto", "", "udp", "Protocol of the probes (udp, tcp)")
+	agentCmd.Flags().IntP("probe_port", "", probe.DefaultPort, "Port of the probe echo service")
+	agentCmd.Flags().DurationP("probe_interval", "", time.Minute, "Time between two probing rounds")
+	agentCmd.Flags().IntP("probe_fanout", "", 8, "Nodes probed in each round, 0 for all")
+	for _, f := range []string{"server", "name"} {
+		if err := agentCmd.MarkFlagRequired(f); err != nil {
+			fmt.Println(err)
+		}
+	}
+	rootCmd.AddCommand(agentCmd)
+}
@@ -0,0 +1,160 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/karasz/gomesh/wireguard"
+	"github.com/spf13/cobra"
+)
+
+// analyzeCmd represents the analyze command
+var analyzeCmd = &cobra.Command{
+	Use:   "analyze",
+	Short: "Check the rendered configs for unreachable nodes and ambiguous routes",
+	Long: `Analyze will render the config of every node and trace a packet between
+every pair of nodes through their AllowedIPs, the way WireGuard routes and
+filters it. It reports the pairs that cannot talk, prefixes routed to several
+peers of a node, pairs whose way back differs from their way there, and the
+relays and hubs some pairs cannot do without.
+
+With --without the same is done as if the given nodes were removed, and the
+pairs that would lose their path or take another one are reported. It fails
+when any pair cannot talk.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		without, _ := cmd.Flags().GetStringSlice("without")
+		output, _ := cmd.Flags().GetString("output")
+		a, err := thePeers.Analyze()
+		if err != nil {
+			return err
+		}
+		var im *wireguard.Impact
+		if len(without) > 0 {
+			i, err := thePeers.Without(a, without)
+			if err != nil {
+				return err
+			}
+			im = &i
+		}
+
+		switch output {
+		case "json":
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "    ")
+			if im != nil {
+				err = enc.Encode(im)
+			} else {
+				err = enc.Encode(a)
+			}
+			if err != nil {
+				return err
+			}
+		case "text":
+			if im != nil {
+				printImpact(*im)
+			} else {
+				printAnalysis(a)
+			}
+		default:
+			return fmt.Errorf("unknown output %q, use text or json", output)
+		}
+
+		if im != nil && (len(im.Lost) > 0 || im.After.Problems()) {
+			return errors.New("the change breaks the mesh")
+		}
+		if im == nil && a.Problems() {
+			return errors.New("problems found")
+		}
+		return nil
+	},
+}
+
+func printAnalysis(a wireguard.Analysis) {
+	fmt.Printf("%d paths traced, %d unreachable\n", len(a.Paths), len(a.Unreachable))
+	if len(a.Unreachable) > 0 {
+		fmt.Println("\nUnreachable:")
+		for _, p := range a.Unreachable {
+			fmt.Printf("  %s: %s\n", pathName(p), p.Reason)
+		}
+	}
+	if len(a.Overlaps) > 0 {
+		fmt.Println("\nOverlapping AllowedIPs:")
+		for _, o := range a.Overlaps {
+			fmt.Printf("  %s routes %s to %s, only one of them gets it\n", o.Node, o.Prefix, strings.Join(o.Peers, ", "))
+		}
+	}
+	if len(a.Asymmetric) > 0 {
+		fmt.Println("\nAsymmetric paths:")
+		for _, pair := range a.Asymmetric {
+			fmt.Printf("  %s, back %s\n", strings.Join(pair[0].Hops, " -> "), strings.Join(pair[1].Hops, " -> "))
+		}
+	}
+	if len(a.SinglePoints) > 0 {
+		fmt.Println("\nSingle points of failure:")
+		for _, sp := range a.SinglePoints {
+			var pairs []string
+			for _, p := range sp.Pairs {
+				pairs = append(pairs, p[0]+" -> "+p[1])
+			}
+			fmt.Printf("  %s, needed by %s\n", sp.Node, strings.Join(pairs, ", "))
+		}
+	}
+}
+
+func printImpact(im wireguard.Impact) {
+	fmt.Printf("Without %s: %d paths are lost, %d take another way\n", strings.Join(im.Without, ", "), len(im.Lost), len(im.Changed))
+	if len(im.Lost) > 0 {
+		fmt.Println("\nLost:")
+		for _, p := range im.Lost {
+			fmt.Printf("  %s: %s\n", pathName(p), p.Reason)
+		}
+	}
+	if len(im.Changed) > 0 {
+		fmt.Println("\nChanged:")
+		for _, pair := range im.Changed {
+			fmt.Printf("  %s, now %s\n", strings.Join(pair[0].Hops, " -> "), strings.Join(pair[1].Hops, " -> "))
+		}
+	}
+	if im.After.Problems() {
+		fmt.Println("\nAfter the change:")
+		printAnalysis(im.After)
+	}
+}
+
+// pathName will name a path by its ends and the address it goes to
+func pathName(p wireguard.Path) string {
+	if p.Address == "" {
+		return p.From + " -> " + p.To
+	}
+	return fmt.Sprintf("%s -> %s (%s)", p.From, p.To, p.Address)
+}
+
+func init() {
+	analyzeCmd.Flags().StringSliceP("without", "", nil, "Analyze the mesh as if these nodes were removed")
+	analyzeCmd.Flags().StringP("output", "o", "text", "Output format (text, json)")
+	rootCmd.AddCommand(analyzeCmd)
+}
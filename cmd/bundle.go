@@ -0,0 +1,82 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/karasz/gomesh/wireguard"
+	"github.com/spf13/cobra"
+)
+
+// bundleCmd represents the bundle command
+var bundleCmd = &cobra.Command{
+	Use:   "bundle",
+	Short: "Write a self-contained install bundle for a peer",
+	Long: `Bundle will write a .tar.gz holding the rendered config, the private key
+in a separate file, an install script and a manifest of checksums.
+With --encrypt-to the bundle is age encrypted to the given keys.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		peername, _ := cmd.Flags().GetString("peer")
+		format, _ := cmd.Flags().GetString("format")
+		out, _ := cmd.Flags().GetString("output")
+		encryptTo, _ := cmd.Flags().GetStringSlice("encrypt-to")
+		if err := wireguard.SetFormat(format); err != nil {
+			return err
+		}
+		if out == "" {
+			out = peername + ".tar.gz"
+			if len(encryptTo) > 0 {
+				out += ".age"
+			}
+		}
+
+		f, err := os.OpenFile(out, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		err = thePeers.Bundle(f, peername, wireguard.BundleOptions{Format: format, EncryptTo: encryptTo})
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(out)
+			return err
+		}
+		fmt.Println("bundle written to", out)
+		return nil
+	},
+}
+
+func init() {
+	bundleCmd.Flags().StringP("peer", "p", "", "Peer to bundle (Required)")
+	bundleCmd.Flags().StringP("format", "f", "wg-quick", "Config format ("+strings.Join(wireguard.Formats, ", ")+")")
+	bundleCmd.Flags().StringP("output", "o", "", "Bundle file (default <peer>.tar.gz)")
+	bundleCmd.Flags().StringSliceP("encrypt-to", "", []string{}, "age or SSH public key of the receiving host")
+	err := bundleCmd.MarkFlagRequired("peer")
+	if err != nil {
+		fmt.Println(err)
+	}
+	rootCmd.AddCommand(bundleCmd)
+}
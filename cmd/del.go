@@ -32,9 +32,9 @@ var delCmd = &cobra.Command{
 	Use:   "del",
 	Short: "Delete a peer from registry",
 	Long:  `The peer with the name will be deleted`,
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		peer, _ := cmd.Flags().GetString("name")
-		thePeers.DeletePeer(peer)
+		return thePeers.DeletePeer(peer)
 	},
 }
 
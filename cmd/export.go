@@ -0,0 +1,117 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/karasz/gomesh/wireguard"
+	"github.com/spf13/cobra"
+)
+
+// exportCmd represents the export command
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export the registry for other tools",
+	Long:  `Export will write the registry in formats understood by other tools`,
+	Example: `  gomesh export --to wg-meshconf -o database.csv
+  gomesh export ansible -o ansible`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		to, _ := cmd.Flags().GetString("to")
+		out, _ := cmd.Flags().GetString("output")
+		if to != "wg-meshconf" {
+			return fmt.Errorf("unknown export format %q", to)
+		}
+		if out == "" {
+			return thePeers.WriteMeshConf(os.Stdout)
+		}
+		f, err := os.OpenFile(out, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		if err = thePeers.WriteMeshConf(f); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	},
+}
+
+// exportAnsibleCmd represents the export ansible command
+var exportAnsibleCmd = &cobra.Command{
+	Use:   "ansible",
+	Short: "Export an Ansible inventory and host_vars",
+	Long: `Export an Ansible inventory with groups made from node roles (role_<role>)
+and tags (tag_<tag>) together with a host_vars/<name>.yml for every node.
+If a vault password file is given the private keys are vault encrypted.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		out, _ := cmd.Flags().GetString("output")
+		format, _ := cmd.Flags().GetString("inventory_format")
+		passwordFile, _ := cmd.Flags().GetString("vault_password_file")
+		opts := wireguard.AnsibleOptions{InventoryFormat: format}
+		if passwordFile != "" {
+			b, err := os.ReadFile(passwordFile)
+			if err != nil {
+				return err
+			}
+			opts.VaultPassword = []byte(strings.TrimSpace(string(b)))
+			if len(opts.VaultPassword) == 0 {
+				return fmt.Errorf("vault password file %s is empty", passwordFile)
+			}
+		}
+		return thePeers.ExportAnsible(out, opts)
+	},
+}
+
+// exportZoneCmd represents the export zone command
+var exportZoneCmd = &cobra.Command{
+	Use:   "zone",
+	Short: "Export DNS zone files naming the nodes",
+	Long: `Export an RFC 1035 zone file for the mesh domain with A and AAAA records
+for <node>.<network>.<domain>, the matching reverse zones, and CoreDNS and
+dnsmasq snippets serving them.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		out, _ := cmd.Flags().GetString("output")
+		domain, _ := cmd.Flags().GetString("domain")
+		ns, _ := cmd.Flags().GetString("nameserver")
+		zoneDir, _ := cmd.Flags().GetString("zone_dir")
+		ttl, _ := cmd.Flags().GetInt("ttl")
+		return thePeers.ExportZone(out, wireguard.ZoneOptions{Domain: domain, Nameserver: ns, ZoneDir: zoneDir, TTL: ttl})
+	},
+}
+
+func init() {
+	exportCmd.Flags().StringP("to", "", "wg-meshconf", "Format to export to (wg-meshconf)")
+	exportCmd.Flags().StringP("output", "o", "", "File to write to (default standard out)")
+	exportAnsibleCmd.Flags().StringP("output", "o", "ansible", "Directory where to write the inventory and host_vars.")
+	exportAnsibleCmd.Flags().StringP("inventory_format", "i", "ini", "Inventory format (ini, yaml)")
+	exportAnsibleCmd.Flags().StringP("vault_password_file", "", "", "Encrypt private keys with the password in this file")
+	exportZoneCmd.Flags().StringP("output", "o", "dns", "Directory where to write the zone files")
+	exportZoneCmd.Flags().StringP("domain", "", wireguard.DefaultDomain, "DNS domain of the mesh")
+	exportZoneCmd.Flags().StringP("nameserver", "", "", "Name server of the zones (default ns.<domain>)")
+	exportZoneCmd.Flags().StringP("zone_dir", "", "/etc/coredns", "Where CoreDNS finds the zone files")
+	exportZoneCmd.Flags().IntP("ttl", "", 300, "TTL of the records")
+	exportCmd.AddCommand(exportAnsibleCmd, exportZoneCmd)
+	rootCmd.AddCommand(exportCmd)
+}
@@ -23,6 +23,7 @@ package cmd
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/karasz/gomesh/wireguard"
 	"github.com/spf13/cobra"
@@ -33,15 +34,41 @@ var generateCmd = &cobra.Command{
 	Use:   "generate",
 	Short: "Generate configs",
 	Long:  `Generate will create the configs file in the specified folder`,
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		out, _ := cmd.Flags().GetString("output")
 		peername, _ := cmd.Flags().GetString("peer_name")
 		usestdout, _ := cmd.Flags().GetBool("useStdOut")
+		format, _ := cmd.Flags().GetString("format")
+		namespace, _ := cmd.Flags().GetString("namespace")
+		labels, _ := cmd.Flags().GetStringToString("labels")
+		nameprefix, _ := cmd.Flags().GetString("name_prefix")
+		kustomize, _ := cmd.Flags().GetBool("kustomize")
+		dnsHosts, _ := cmd.Flags().GetBool("dns-hosts")
+		domain, _ := cmd.Flags().GetString("domain")
+		routing, _ := cmd.Flags().GetString("routing")
 		wireguard.SetOutput(usestdout)
-		err := thePeers.GenerateConfigs(out, peername)
+		if err := wireguard.SetFormat(format); err != nil {
+			return err
+		}
+		err := wireguard.SetKubernetesOptions(wireguard.KubernetesOptions{Namespace: namespace, Labels: labels, NamePrefix: nameprefix, Kustomize: kustomize})
 		if err != nil {
-			fmt.Println("generate", err)
+			return err
+		}
+		switch {
+		case routing != "static" && format != "wg-quick":
+			err = fmt.Errorf("the %s routing only writes wg-quick configs", routing)
+		case routing != "static":
+			err = thePeers.GenerateRouted(out, peername, routing)
+		default:
+			err = thePeers.GenerateConfigs(out, peername)
+		}
+		if err != nil {
+			return err
+		}
+		if dnsHosts {
+			return thePeers.GenerateHosts(out, domain)
 		}
+		return nil
 	},
 }
 
@@ -49,5 +76,13 @@ func init() {
 	generateCmd.Flags().StringP("output", "o", "output", "Directory where to output configs.")
 	generateCmd.Flags().StringP("peer_name", "p", "", "Generate config for this peer")
 	generateCmd.Flags().BoolP("useStdOut", "s", false, "Use StdOut instead of files")
+	generateCmd.Flags().StringP("format", "f", "wg-quick", "Config format ("+strings.Join(wireguard.Formats, ", ")+")")
+	generateCmd.Flags().StringP("namespace", "", "", "Kubernetes namespace for the k8s format")
+	generateCmd.Flags().StringToStringP("labels", "", map[string]string{}, "Extra labels for the k8s format (key=value)")
+	generateCmd.Flags().StringP("name_prefix", "", "", "Prefix for the names of Kubernetes objects")
+	generateCmd.Flags().BoolP("kustomize", "", false, "Write a kustomization.yaml referencing the k8s manifests")
+	generateCmd.Flags().BoolP("dns-hosts", "", false, "Also write an /etc/hosts fragment naming the nodes")
+	generateCmd.Flags().StringP("domain", "", wireguard.DefaultDomain, "DNS domain of the mesh")
+	generateCmd.Flags().StringP("routing", "", "static", "static AllowedIPs, or a tunnel per link and a config for a routing daemon (bird, babel)")
 	rootCmd.AddCommand(generateCmd)
 }
@@ -0,0 +1,73 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/karasz/gomesh/wireguard"
+	"github.com/spf13/cobra"
+)
+
+// graphCmd represents the graph command
+var graphCmd = &cobra.Command{
+	Use:   "graph",
+	Short: "Draw the topology of the mesh",
+	Long: `Graph will write the topology the configs are rendered from: the nodes with
+their roles and tags, an edge for each pair with a tunnel of its own or going
+through a relay, and the routed subnets as leaves of their active and standby
+gateways. Render it with e.g. gomesh graph | dot -Tsvg > mesh.svg`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		output, _ := cmd.Flags().GetString("output")
+		highlight, _ := cmd.Flags().GetString("highlight")
+		links, err := wireguard.LoadLinks()
+		if err != nil {
+			return err
+		}
+		g := thePeers.Graph(links)
+		if highlight != "" {
+			if err = g.Highlight(highlight); err != nil {
+				return err
+			}
+		}
+		switch output {
+		case "dot":
+			return g.WriteDOT(os.Stdout)
+		case "mermaid":
+			return g.WriteMermaid(os.Stdout)
+		case "json":
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "    ")
+			return enc.Encode(g)
+		default:
+			return fmt.Errorf("unknown output %q, use one of dot, mermaid, json", output)
+		}
+	},
+}
+
+func init() {
+	graphCmd.Flags().StringP("output", "o", "dot", "Output format (dot, mermaid, json)")
+	graphCmd.Flags().StringP("highlight", "", "", "Emphasise this node and its neighbours")
+	rootCmd.AddCommand(graphCmd)
+}
@@ -0,0 +1,98 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/karasz/gomesh/agent"
+	"github.com/karasz/gomesh/wireguard"
+	"github.com/spf13/cobra"
+)
+
+// joinCmd represents the join command
+var joinCmd = &cobra.Command{
+	Use:   "join <token>",
+	Short: "Join a mesh with an enrollment token",
+	Long: `Join will generate a key pair on this host, register it with the control plane
+using an enrollment token and write the config it gets back. Only the
+public key is sent, the private key is written to --key_file.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		serverURL, _ := cmd.Flags().GetString("server")
+		name, _ := cmd.Flags().GetString("name")
+		endpoint, _ := cmd.Flags().GetString("endpoint")
+		listenport, _ := cmd.Flags().GetInt("listenport")
+		out, _ := cmd.Flags().GetString("output")
+		keyFile, _ := cmd.Flags().GetString("key_file")
+		tags, _ := cmd.Flags().GetStringSlice("tags")
+		nodeType, _ := cmd.Flags().GetString("type")
+		if nodeType == wireguard.TypeRoaming && !cmd.Flags().Changed("listenport") {
+			listenport = 0
+		}
+		hostname, _ := os.Hostname()
+		if out == "" {
+			out = name + ".conf"
+		}
+		if keyFile == "" {
+			keyFile = name + ".key"
+		}
+
+		c, err := agent.Join(context.Background(), nil, serverURL, agent.JoinRequest{Token: args[0], Name: name, Endpoint: endpoint, ListenPort: listenport, Hostname: hostname, Type: nodeType, Tags: tags})
+		pending := errors.Is(err, agent.ErrPending)
+		if err != nil && !pending {
+			return err
+		}
+		if err = os.WriteFile(keyFile, []byte(c.Interface.PrivateKey+"\n"), 0600); err != nil {
+			return err
+		}
+		if err = os.WriteFile(out, []byte(c.String()), 0600); err != nil {
+			return err
+		}
+		fmt.Printf("joined as %s with address %s, config written to %s\n", name, strings.Join(c.Interface.Address, ","), out)
+		if pending {
+			fmt.Println("the network requires approval, run gomesh agent to get the peers once approved")
+		}
+		return nil
+	},
+}
+
+func init() {
+	joinCmd.Flags().StringP("server", "s", "", "URL of the control plane (Required)")
+	joinCmd.Flags().StringP("name", "n", "", "Name of this node (Required)")
+	joinCmd.Flags().StringP("endpoint", "e", "", "This node's endpoint")
+	joinCmd.Flags().IntP("listenport", "l", 51820, "Port to listen on")
+	joinCmd.Flags().StringP("output", "o", "", "Where to write the config (default <name>.conf)")
+	joinCmd.Flags().StringP("key_file", "k", "", "Where to write the private key (default <name>.key)")
+	joinCmd.Flags().StringSliceP("tags", "t", []string{}, "Tags to request, given once approved")
+	joinCmd.Flags().StringP("type", "", "", "Type of this node (server, client, roaming)")
+	for _, f := range []string{"server", "name"} {
+		if err := joinCmd.MarkFlagRequired(f); err != nil {
+			fmt.Println(err)
+		}
+	}
+	rootCmd.AddCommand(joinCmd)
+}
@@ -0,0 +1,188 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/karasz/gomesh/wireguard"
+	"github.com/spf13/cobra"
+)
+
+// linkCmd represents the link command
+var linkCmd = &cobra.Command{
+	Use:   "link",
+	Short: "Manage the settings of pairs of nodes",
+	Long: `Links hold what applies to a pair of nodes rather than to a node as a whole:
+a keepalive, the endpoint one end reaches the other on, whether the link is
+disabled, and notes`,
+}
+
+// linkSetCmd represents the link set command
+var linkSetCmd = &cobra.Command{
+	Use:   "set <node> <node>",
+	Short: "Change the settings of a link",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		links, l, err := loadLink(args[0], args[1])
+		if err != nil {
+			return err
+		}
+		if cmd.Flags().Changed("keepalive") {
+			l.Keepalive, _ = cmd.Flags().GetInt("keepalive")
+		}
+		if cmd.Flags().Changed("mtu") {
+			l.MTU, _ = cmd.Flags().GetInt("mtu")
+		}
+		if cmd.Flags().Changed("disabled") {
+			l.Disabled, _ = cmd.Flags().GetBool("disabled")
+		}
+		if cmd.Flags().Changed("notes") {
+			l.Notes, _ = cmd.Flags().GetString("notes")
+		}
+		if cmd.Flags().Changed("endpoint") {
+			endpoints, _ := cmd.Flags().GetStringToString("endpoint")
+			if l.Endpoints == nil {
+				l.Endpoints = map[string]string{}
+			}
+			for from, ep := range endpoints {
+				l.Endpoints[from] = ep
+			}
+		}
+		return links.Set(l)
+	},
+}
+
+// linkShowCmd represents the link show command
+var linkShowCmd = &cobra.Command{
+	Use:   "show [<node> <node>]",
+	Short: "Show the links with settings of their own",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 0 && len(args) != 2 {
+			return fmt.Errorf("accepts 0 or 2 arg(s), received %d", len(args))
+		}
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		links, err := wireguard.LoadLinks()
+		if err != nil {
+			return err
+		}
+		if len(args) == 2 {
+			_, l, err := loadLink(args[0], args[1])
+			if err != nil {
+				return err
+			}
+			links = wireguard.Links{l}
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', tabwriter.AlignRight|tabwriter.Debug)
+		fmt.Fprintln(tw, "A\t", "B\t", "STATE\t", "KEEPALIVE\t", "ENDPOINTS\t", "MTU\t", "WEIGHT\t", "LATENCY\t", "NOTES\t")
+		for _, l := range links {
+			state := "up"
+			switch {
+			case l.Disabled:
+				state = "disabled"
+			case l.NoDirect:
+				state = "no direct"
+			}
+			var endpoints []string
+			for from, ep := range l.Endpoints {
+				endpoints = append(endpoints, from+"="+ep)
+			}
+			sort.Strings(endpoints)
+			latency := ""
+			if rtt, ok := l.Latency(); ok {
+				latency = rtt.Round(100 * time.Microsecond).String()
+			}
+			fmt.Fprintln(tw, l.A+"\t", l.B+"\t", state+"\t", optional(l.Keepalive)+"\t", strings.Join(endpoints, ",")+"\t",
+				optional(l.MTU)+"\t", optional(l.Weight)+"\t", latency+"\t", l.Notes+"\t")
+		}
+		return tw.Flush()
+	},
+}
+
+// linkDisableCmd represents the link disable command
+var linkDisableCmd = &cobra.Command{
+	Use:   "disable <node> <node>",
+	Short: "Turn a link off, its traffic goes through a relay if there is one",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return setDisabled(args[0], args[1], true)
+	},
+}
+
+// linkEnableCmd represents the link enable command
+var linkEnableCmd = &cobra.Command{
+	Use:   "enable <node> <node>",
+	Short: "Turn a disabled link back on",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return setDisabled(args[0], args[1], false)
+	},
+}
+
+func setDisabled(a, b string, disabled bool) error {
+	links, l, err := loadLink(a, b)
+	if err != nil {
+		return err
+	}
+	l.Disabled = disabled
+	return links.Set(l)
+}
+
+// loadLink will return the links and the one between
+// the named nodes, which must exist
+func loadLink(a, b string) (wireguard.Links, wireguard.Link, error) {
+	for _, n := range []string{a, b} {
+		if _, err := thePeers.Get(n); err != nil {
+			return nil, wireguard.Link{}, err
+		}
+	}
+	links, err := wireguard.LoadLinks()
+	if err != nil {
+		return nil, wireguard.Link{}, err
+	}
+	return links, links.Get(a, b), nil
+}
+
+func optional(i int) string {
+	if i == 0 {
+		return ""
+	}
+	return strconv.Itoa(i)
+}
+
+func init() {
+	linkSetCmd.Flags().IntP("keepalive", "k", 0, "PersistentKeepalive of both ends, 0 for the settings of the nodes")
+	linkSetCmd.Flags().StringToStringP("endpoint", "e", nil, "Endpoint a node reaches the other end on (node=host:port, empty to remove)")
+	linkSetCmd.Flags().IntP("mtu", "m", 0, "MTU of the tunnel of the link in the routed mode")
+	linkSetCmd.Flags().BoolP("disabled", "", false, "Turn the link off")
+	linkSetCmd.Flags().StringP("notes", "", "", "Free text about the link")
+	linkCmd.AddCommand(linkSetCmd, linkShowCmd, linkDisableCmd, linkEnableCmd)
+	rootCmd.AddCommand(linkCmd)
+}
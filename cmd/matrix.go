@@ -0,0 +1,131 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/karasz/gomesh/wireguard"
+	"github.com/spf13/cobra"
+)
+
+// matrixCmd represents the matrix command
+var matrixCmd = &cobra.Command{
+	Use:   "matrix",
+	Short: "Show the measured reachability between the nodes",
+	Long: `Matrix will show the latest probes the agents sent, one row for each
+probing node and one column for each probed node. A cell holds the average
+round trip and the loss, "down" when no probe got an answer, "no path" when
+the nodes cannot talk at all and "-" when nothing was measured yet`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		network, _ := cmd.Flags().GetString("network")
+		output, _ := cmd.Flags().GetString("output")
+		maxAge, _ := cmd.Flags().GetDuration("max_age")
+		links, err := wireguard.LoadLinks()
+		if err != nil {
+			return err
+		}
+		var nodes wireguard.Peers
+		for _, pr := range thePeers {
+			if !pr.Pending && (network == "" || strings.EqualFold(pr.Network, network)) {
+				nodes = append(nodes, pr)
+			}
+		}
+
+		switch output {
+		case "json":
+			probes := []wireguard.Probe{}
+			for _, from := range nodes {
+				for _, to := range nodes {
+					if pb, ok := links.Get(from.Name, to.Name).Probe(from.Name); ok && from.Name != to.Name {
+						probes = append(probes, pb)
+					}
+				}
+			}
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "    ")
+			return enc.Encode(probes)
+		case "table":
+		default:
+			return fmt.Errorf("unknown output %q, use table or json", output)
+		}
+
+		paths := map[[2]string]bool{}
+		for _, r := range nodes.Routes(links) {
+			paths[[2]string{r.From, r.To}] = r.OK()
+			paths[[2]string{r.To, r.From}] = r.OK()
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', tabwriter.AlignRight|tabwriter.Debug)
+		fmt.Fprint(tw, "FROM \\ TO\t")
+		for _, to := range nodes {
+			fmt.Fprint(tw, to.Name+"\t")
+		}
+		fmt.Fprintln(tw)
+		now := time.Now()
+		for _, from := range nodes {
+			fmt.Fprint(tw, from.Name+"\t")
+			for _, to := range nodes {
+				fmt.Fprint(tw, matrixCell(from, to, links, paths, now, maxAge)+"\t")
+			}
+			fmt.Fprintln(tw)
+		}
+		return tw.Flush()
+	},
+}
+
+func matrixCell(from, to wireguard.Peer, links wireguard.Links, paths map[[2]string]bool, now time.Time, maxAge time.Duration) string {
+	if from.Name == to.Name {
+		return ""
+	}
+	ok, known := paths[[2]string{from.Name, to.Name}]
+	if !known {
+		// different networks never see each other
+		return ""
+	}
+	pb, measured := links.Get(from.Name, to.Name).Probe(from.Name)
+	switch {
+	case !ok:
+		return "no path"
+	case !measured:
+		return "-"
+	case maxAge > 0 && now.Sub(pb.At) > maxAge:
+		return "stale"
+	case pb.Received == 0:
+		return "down"
+	case pb.Received < pb.Sent:
+		return fmt.Sprintf("%s %.0f%%", pb.RTT.Round(100*time.Microsecond), 100*pb.Loss())
+	default:
+		return pb.RTT.Round(100 * time.Microsecond).String()
+	}
+}
+
+func init() {
+	matrixCmd.Flags().StringP("network", "n", "", "Only show the nodes of this network")
+	matrixCmd.Flags().StringP("output", "o", "table", "Output format (table, json)")
+	matrixCmd.Flags().DurationP("max_age", "", 15*time.Minute, "Show older probes as stale, 0 to keep them all")
+	rootCmd.AddCommand(matrixCmd)
+}
@@ -0,0 +1,159 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/karasz/gomesh/wireguard"
+	"github.com/spf13/cobra"
+)
+
+// networkCmd represents the network command
+var networkCmd = &cobra.Command{
+	Use:   "network",
+	Short: "Manage networks",
+	Long: `Networks group peers sharing an address range, peers only see the peers
+of their own network and get their addresses from its prefix`,
+}
+
+// networkAddCmd represents the network add command
+var networkAddCmd = &cobra.Command{
+	Use:   "add",
+	Short: "Add a network",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name, _ := cmd.Flags().GetString("name")
+		prefix, _ := cmd.Flags().GetString("prefix")
+		approval, _ := cmd.Flags().GetBool("require_approval")
+		dns, _ := cmd.Flags().GetString("dns")
+		prefix6, err := ipv6Prefix(cmd)
+		if err != nil {
+			return err
+		}
+		networks, err := wireguard.LoadNetworks()
+		if err != nil {
+			return err
+		}
+		return networks.AddNetwork(wireguard.Network{Name: name, Prefix: prefix, Prefix6: prefix6, RequireApproval: approval, DNS: dns})
+	},
+}
+
+// networkSetCmd represents the network set command
+var networkSetCmd = &cobra.Command{
+	Use:   "set <name>",
+	Short: "Change the settings of a network",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		networks, err := wireguard.LoadNetworks()
+		if err != nil {
+			return err
+		}
+		nw, err := networks.Get(args[0])
+		if err != nil {
+			return err
+		}
+		if cmd.Flags().Changed("require_approval") {
+			nw.RequireApproval, _ = cmd.Flags().GetBool("require_approval")
+		}
+		if cmd.Flags().Changed("dns") {
+			nw.DNS, _ = cmd.Flags().GetString("dns")
+		}
+		if cmd.Flags().Changed("prefix6") || cmd.Flags().Changed("ula") || cmd.Flags().Changed("ula_seed") {
+			if nw.Prefix6, err = ipv6Prefix(cmd); err != nil {
+				return err
+			}
+		}
+		return networks.UpdateNetwork(nw)
+	},
+}
+
+// networkListCmd represents the network list command
+var networkListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the networks",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		networks, err := wireguard.LoadNetworks()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', tabwriter.AlignRight|tabwriter.Debug)
+		fmt.Fprintln(tw, "NAME\t", "PREFIX\t", "PREFIX6\t", "APPROVAL\t", "DNS\t")
+		for _, nw := range networks {
+			fmt.Fprintln(tw, nw.Name+"\t", nw.Prefix+"\t", nw.Prefix6+"\t", strconv.FormatBool(nw.RequireApproval)+"\t", nw.DNS+"\t")
+		}
+		return tw.Flush()
+	},
+}
+
+// networkDelCmd represents the network del command
+var networkDelCmd = &cobra.Command{
+	Use:   "del <name>",
+	Short: "Delete a network",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		networks, err := wireguard.LoadNetworks()
+		if err != nil {
+			return err
+		}
+		return networks.DeleteNetwork(args[0])
+	},
+}
+
+// ipv6Prefix will return the IPv6 prefix given with --prefix6,
+// or a generated ULA one when --ula or --ula_seed is given
+func ipv6Prefix(cmd *cobra.Command) (string, error) {
+	prefix6, _ := cmd.Flags().GetString("prefix6")
+	ula, _ := cmd.Flags().GetBool("ula")
+	seed, _ := cmd.Flags().GetString("ula_seed")
+	if !ula && seed == "" {
+		return prefix6, nil
+	}
+	if prefix6 != "" {
+		return "", errors.New("--prefix6 cannot be used with --ula or --ula_seed")
+	}
+	pfx, err := wireguard.ULA(seed)
+	if err != nil {
+		return "", err
+	}
+	return pfx.String(), nil
+}
+
+func init() {
+	networkAddCmd.Flags().StringP("name", "n", "", "Name of the network (Required)")
+	networkAddCmd.Flags().StringP("prefix", "p", "", "Address range of the network, e.g. 10.10.0.0/24")
+	for _, c := range []*cobra.Command{networkAddCmd, networkSetCmd} {
+		c.Flags().BoolP("require_approval", "", false, "Keep joining nodes pending until approved")
+		c.Flags().StringP("dns", "", "", "DNS of the nodes without their own, e.g. the mesh DNS server")
+		c.Flags().StringP("prefix6", "", "", "IPv6 address range of a dual-stack network, e.g. fd12:3456:789a::/48")
+		c.Flags().BoolP("ula", "", false, "Generate a random RFC 4193 unique local /48 as the IPv6 range")
+		c.Flags().StringP("ula_seed", "", "", "Derive the unique local /48 from this seed instead")
+	}
+	if err := networkAddCmd.MarkFlagRequired("name"); err != nil {
+		fmt.Println(err)
+	}
+	networkCmd.AddCommand(networkAddCmd, networkSetCmd, networkListCmd, networkDelCmd)
+	rootCmd.AddCommand(networkCmd)
+}
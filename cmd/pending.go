@@ -0,0 +1,103 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/karasz/gomesh/wireguard"
+	"github.com/spf13/cobra"
+)
+
+// pendingCmd represents the pending command
+var pendingCmd = &cobra.Command{
+	Use:   "pending",
+	Short: "Manage join requests waiting for approval",
+	Long: `Nodes joining a network created with --require_approval are kept
+out of the mesh until approved`,
+}
+
+// pendingListCmd represents the pending list command
+var pendingListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List join requests waiting for approval",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', tabwriter.AlignRight|tabwriter.Debug)
+		fmt.Fprintln(tw, "NAME\t", "NETWORK\t", "ADDRESS\t", "FINGERPRINT\t", "REQUESTED TAGS\t", "REMOTE\t", "HOSTNAME\t", "REQUESTED\t")
+		for _, pr := range thePeers.PendingPeers() {
+			pub, err := pr.Public()
+			if err != nil {
+				return err
+			}
+			fp, err := wireguard.Fingerprint(pub)
+			if err != nil {
+				return err
+			}
+			var j wireguard.JoinInfo
+			if pr.Join != nil {
+				j = *pr.Join
+			}
+			fmt.Fprintln(tw, pr.Name+"\t", pr.Network+"\t", strings.Join(pr.Address, ",")+"\t", fp+"\t", strings.Join(j.RequestedTags, ",")+"\t", j.RemoteAddr+"\t", j.Hostname+"\t", j.Requested.Format(time.RFC3339)+"\t")
+		}
+		return tw.Flush()
+	},
+}
+
+// pendingApproveCmd represents the pending approve command
+var pendingApproveCmd = &cobra.Command{
+	Use:   "approve <name>",
+	Short: "Let a pending node into the mesh",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		by, _ := cmd.Flags().GetString("by")
+		// without --tags the node gets the tags it asked for
+		var tags []string
+		if cmd.Flags().Changed("tags") {
+			tags, _ = cmd.Flags().GetStringSlice("tags")
+			if tags == nil {
+				tags = []string{}
+			}
+		}
+		return thePeers.Approve(args[0], by, tags, time.Now().UTC())
+	},
+}
+
+// pendingRejectCmd represents the pending reject command
+var pendingRejectCmd = &cobra.Command{
+	Use:   "reject <name>",
+	Short: "Remove a pending node",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return thePeers.Reject(args[0])
+	},
+}
+
+func init() {
+	pendingApproveCmd.Flags().StringP("by", "", os.Getenv("USER"), "Who approved the node")
+	pendingApproveCmd.Flags().StringSliceP("tags", "t", []string{}, "Tags to give instead of the requested ones")
+	pendingCmd.AddCommand(pendingListCmd, pendingApproveCmd, pendingRejectCmd)
+	rootCmd.AddCommand(pendingCmd)
+}
@@ -0,0 +1,134 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/karasz/gomesh/wireguard"
+	"github.com/spf13/cobra"
+)
+
+// policyCmd represents the policy command
+var policyCmd = &cobra.Command{
+	Use:   "policy",
+	Short: "Inspect the access-control policy",
+	Long: `The policy is kept next to the registry (database.policy for database.json),
+one rule per line:
+
+  allow tag:web -> tag:db port 5432/tcp
+  allow role:admin -> * port 22/tcp,icmp
+  allow node:backup -> network:prod
+
+Selectors are node:<name>, tag:<tag>, role:<role>, network:<name> or *.
+Once the file exists every node drops the traffic it receives on its
+WireGuard interface unless a rule allows it. The rules are compiled to
+nftables commands in the PostUp and PostDown of every config.`,
+}
+
+// policyCheckCmd represents the policy check command
+var policyCheckCmd = &cobra.Command{
+	Use:   "check <src> <dst> <port>",
+	Short: "Tell whether src may reach dst on port, e.g. 5432/tcp",
+	Args:  cobra.ExactArgs(3),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		src, err := thePeers.Get(args[0])
+		if err != nil {
+			return err
+		}
+		dst, err := thePeers.Get(args[1])
+		if err != nil {
+			return err
+		}
+		proto, port, err := parseFlow(args[2])
+		if err != nil {
+			return err
+		}
+		if src.Network != dst.Network {
+			return fmt.Errorf("%s and %s are in different networks", src.Name, dst.Name)
+		}
+		pol, err := wireguard.LoadPolicy()
+		if err != nil {
+			return err
+		}
+		if pol == nil {
+			fmt.Println("allowed, there is no policy")
+			return nil
+		}
+		rule, ok := pol.Allowed(src, dst, proto, port)
+		if !ok {
+			return errors.New("denied, no rule allows it")
+		}
+		fmt.Printf("allowed by line %d: %s\n", rule.Line, rule.Text)
+		return nil
+	},
+}
+
+// policyShowCmd represents the policy show command
+var policyShowCmd = &cobra.Command{
+	Use:   "show <node>",
+	Short: "Print the nftables ruleset of a node",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		iface, _ := cmd.Flags().GetString("interface")
+		pr, err := thePeers.Get(args[0])
+		if err != nil {
+			return err
+		}
+		pol, err := wireguard.LoadPolicy()
+		if err != nil {
+			return err
+		}
+		if pol == nil {
+			return errors.New("there is no policy")
+		}
+		if iface == "" {
+			iface = strings.ToLower(pr.Name)
+		}
+		fmt.Print(pol.Ruleset(thePeers, pr, iface))
+		return nil
+	},
+}
+
+// parseFlow will parse 5432/tcp, 53/udp or icmp,
+// a port without a protocol is tcp
+func parseFlow(s string) (string, int, error) {
+	proto := "tcp"
+	if i := strings.Index(s, "/"); i >= 0 {
+		s, proto = s[:i], strings.ToLower(s[i+1:])
+	} else if !strings.ContainsAny(s, "0123456789") {
+		return strings.ToLower(s), 0, nil
+	}
+	var port int
+	if _, err := fmt.Sscanf(s, "%d", &port); err != nil || port < 1 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid port %q", s)
+	}
+	return proto, port, nil
+}
+
+func init() {
+	policyShowCmd.Flags().StringP("interface", "i", "", "WireGuard interface of the node (default its name)")
+	policyCmd.AddCommand(policyCheckCmd, policyShowCmd)
+	rootCmd.AddCommand(policyCmd)
+}
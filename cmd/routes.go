@@ -0,0 +1,130 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/karasz/gomesh/wireguard"
+	"github.com/spf13/cobra"
+)
+
+// routesCmd represents the routes command
+var routesCmd = &cobra.Command{
+	Use:   "routes",
+	Short: "Explain the path each pair of nodes takes",
+	Long: `Routes will show, for every pair of nodes seeing each other, whether they
+have a tunnel of their own, go through a relay or cannot talk at all`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name, _ := cmd.Flags().GetString("name")
+		links, err := wireguard.LoadLinks()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', tabwriter.AlignRight|tabwriter.Debug)
+		fmt.Fprintln(tw, "FROM\t", "TO\t", "PATH\t", "REASON\t")
+		for _, r := range thePeers.Routes(links) {
+			if name != "" && !strings.EqualFold(r.From, name) && !strings.EqualFold(r.To, name) {
+				continue
+			}
+			path := "direct"
+			switch {
+			case r.Via != "":
+				path = "via " + r.Via
+			case !r.Direct:
+				path = "none"
+			}
+			fmt.Fprintln(tw, r.From+"\t", r.To+"\t", path+"\t", r.Reason+"\t")
+		}
+		return tw.Flush()
+	},
+}
+
+// routesBlockCmd represents the routes block command
+var routesBlockCmd = &cobra.Command{
+	Use:   "block <node> <node>",
+	Short: "Mark a pair of nodes as having no direct path",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return setNoDirect(args[0], args[1], true)
+	},
+}
+
+// routesUnblockCmd represents the routes unblock command
+var routesUnblockCmd = &cobra.Command{
+	Use:   "unblock <node> <node>",
+	Short: "Let a pair of nodes have a tunnel of their own again",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return setNoDirect(args[0], args[1], false)
+	},
+}
+
+// routesWeightCmd represents the routes weight command
+var routesWeightCmd = &cobra.Command{
+	Use:   "weight <node> <node> <cost>",
+	Short: "Set the cost of a link in the routed mode, 0 to derive it from the probes",
+	Args:  cobra.ExactArgs(3),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cost, err := strconv.Atoi(args[2])
+		if err != nil || cost < 0 || cost > 65535 {
+			return fmt.Errorf("invalid cost %q", args[2])
+		}
+		for _, n := range args[:2] {
+			if _, err := thePeers.Get(n); err != nil {
+				return err
+			}
+		}
+		links, err := wireguard.LoadLinks()
+		if err != nil {
+			return err
+		}
+		l := links.Get(args[0], args[1])
+		l.Weight = cost
+		return links.Set(l)
+	},
+}
+
+func setNoDirect(a, b string, noDirect bool) error {
+	for _, n := range []string{a, b} {
+		if _, err := thePeers.Get(n); err != nil {
+			return err
+		}
+	}
+	links, err := wireguard.LoadLinks()
+	if err != nil {
+		return err
+	}
+	l := links.Get(a, b)
+	l.NoDirect = noDirect
+	return links.Set(l)
+}
+
+func init() {
+	routesCmd.Flags().StringP("name", "n", "", "Only show the pairs this node is part of")
+	routesCmd.AddCommand(routesBlockCmd, routesUnblockCmd, routesWeightCmd)
+	rootCmd.AddCommand(routesCmd)
+}
@@ -0,0 +1,135 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/karasz/gomesh/meshdns"
+	"github.com/karasz/gomesh/server"
+	"github.com/karasz/gomesh/wireguard"
+	"github.com/spf13/cobra"
+)
+
+// serveCmd represents the serve command
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Serve the registry over HTTP",
+	Long: `Serve will start an HTTP server exposing the registry as a REST API.
+Admin requests are authenticated with the operator tokens of --token, nodes
+sign their requests or use the bootstrap token bound to them with --node_token,
+which only gives access to their own config. The API is described at /openapi.json`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		listen, _ := cmd.Flags().GetString("listen")
+		tokens, _ := cmd.Flags().GetStringSlice("token")
+		tokenFile, _ := cmd.Flags().GetString("token_file")
+		nodeTokens, _ := cmd.Flags().GetStringToString("node_token")
+		nodeTokenFile, _ := cmd.Flags().GetString("node_token_file")
+		cert, _ := cmd.Flags().GetString("tls_cert")
+		key, _ := cmd.Flags().GetString("tls_key")
+		keyFile, _ := cmd.Flags().GetString("key_file")
+		dnsListen, _ := cmd.Flags().GetString("dns_listen")
+		dnsDomain, _ := cmd.Flags().GetString("dns_domain")
+		dnsUpstream, _ := cmd.Flags().GetString("dns_upstream")
+		if tokenFile != "" {
+			b, err := os.ReadFile(tokenFile)
+			if err != nil {
+				return err
+			}
+			for _, t := range strings.Split(string(b), "\n") {
+				if t = strings.TrimSpace(t); t != "" {
+					tokens = append(tokens, t)
+				}
+			}
+		}
+		if nodeTokenFile != "" {
+			b, err := os.ReadFile(nodeTokenFile)
+			if err != nil {
+				return err
+			}
+			for i, line := range strings.Split(string(b), "\n") {
+				f := strings.Fields(line)
+				switch {
+				case len(f) == 0:
+				case len(f) == 2:
+					nodeTokens[f[0]] = f[1]
+				default:
+					return fmt.Errorf("%s:%d: expected a node name and a token", nodeTokenFile, i+1)
+				}
+			}
+		}
+		if len(tokens) == 0 {
+			return errors.New("at least one token is needed, use --token or --token_file")
+		}
+
+		if keyFile == "" {
+			keyFile = wireguard.SidecarPath("server.key")
+		}
+		serverKey, err := wireguard.LoadOrCreateKey(keyFile)
+		if err != nil {
+			return err
+		}
+		pub, _ := wireguard.PublicKey(serverKey)
+
+		fmt.Println("serving", dbFile, "on", listen, "with public key", pub)
+		srv := server.New(thePeers, tokens, nodeTokens, serverKey)
+		if dnsListen != "" {
+			dns := &meshdns.Server{Domain: dnsDomain, Upstream: dnsUpstream, Peers: srv.Peers}
+			conn, err := net.ListenPacket("udp", dnsListen)
+			if err != nil {
+				return err
+			}
+			fmt.Println("answering DNS for", dnsDomain, "on", dnsListen)
+			go func() {
+				if err := dns.Serve(context.Background(), conn); err != nil {
+					log.Println("dns:", err)
+				}
+			}()
+		}
+		if cert != "" {
+			return http.ListenAndServeTLS(listen, cert, key, srv)
+		}
+		return http.ListenAndServe(listen, srv)
+	},
+}
+
+func init() {
+	serveCmd.Flags().StringP("listen", "l", ":8080", "Address to listen on")
+	serveCmd.Flags().StringSliceP("token", "t", []string{}, "Operator bearer token allowed to use the whole API")
+	serveCmd.Flags().StringP("token_file", "", "", "File with one operator bearer token per line")
+	serveCmd.Flags().StringToStringP("node_token", "", map[string]string{}, "Bootstrap token of a node (node=token), only valid for its own config")
+	serveCmd.Flags().StringP("node_token_file", "", "", "File with a node name and its bootstrap token per line")
+	serveCmd.Flags().StringP("tls_cert", "", "", "TLS certificate file")
+	serveCmd.Flags().StringP("tls_key", "", "", "TLS key file")
+	serveCmd.Flags().StringP("key_file", "k", "", "Server key used to verify node signatures (default next to the database)")
+	serveCmd.Flags().StringP("dns_listen", "", "", "Also answer DNS for the mesh domain on this UDP address, e.g. 10.10.0.1:53")
+	serveCmd.Flags().StringP("dns_domain", "", wireguard.DefaultDomain, "DNS domain of the mesh")
+	serveCmd.Flags().StringP("dns_upstream", "", "", "DNS server other queries are forwarded to, e.g. 1.1.1.1:53")
+	rootCmd.AddCommand(serveCmd)
+}
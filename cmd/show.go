@@ -22,22 +22,48 @@ THE SOFTWARE.
 package cmd
 
 import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/karasz/gomesh/wireguard"
 	"github.com/spf13/cobra"
 )
 
 // showCmd represents the show command
 var showCmd = &cobra.Command{
 	Use:   "show",
-	Short: "Print a table with the peers",
-	Long: `Show will print a table with the registered Peers
-	if brief is set to true then empty atributes will be ommited`,
-	Run: func(cmd *cobra.Command, args []string) {
-		brief, _ := cmd.Flags().GetBool("brief")
-		thePeers.PrettyPrint(brief)
+	Short: "Print the registered peers",
+	Long: `Show will print the registered Peers as a table or as json, yaml or csv.
+	Private keys are only printed with --show-secrets, public keys are shown instead.`,
+	Example: `  gomesh show -o wide
+  gomesh show -o json --where role=hub --name 'db-*'
+  gomesh show --columns name,address,tags --sort-by name`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		output, _ := cmd.Flags().GetString("output")
+		columns, _ := cmd.Flags().GetStringSlice("columns")
+		where, _ := cmd.Flags().GetStringSlice("where")
+		name, _ := cmd.Flags().GetString("name")
+		sortBy, _ := cmd.Flags().GetString("sort-by")
+		showSecrets, _ := cmd.Flags().GetBool("show-secrets")
+		if brief, _ := cmd.Flags().GetBool("brief"); !brief && !cmd.Flags().Changed("output") {
+			output = "wide"
+		}
+		return thePeers.Print(os.Stdout, wireguard.PrintOptions{Output: output, Columns: columns, Where: where, Name: name, SortBy: sortBy, ShowSecrets: showSecrets})
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(showCmd)
 	showCmd.Flags().BoolP("brief", "b", true, "Only print non-empty fields")
+	err := showCmd.Flags().MarkDeprecated("brief", "use --output wide instead")
+	if err != nil {
+		fmt.Println(err)
+	}
+	showCmd.Flags().StringP("output", "o", "table", "Output format (table, wide, json, yaml, csv)")
+	showCmd.Flags().StringSliceP("columns", "c", []string{}, "Columns to print ("+strings.Join(wireguard.Columns(), ", ")+")")
+	showCmd.Flags().StringSliceP("where", "w", []string{}, "Only print peers where column=value")
+	showCmd.Flags().StringP("name", "n", "", "Only print peers whose name matches this glob")
+	showCmd.Flags().StringP("sort-by", "", "", "Column to sort on")
+	showCmd.Flags().BoolP("show-secrets", "", false, "Allow printing private keys")
 }
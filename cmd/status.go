@@ -0,0 +1,118 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/karasz/gomesh/status"
+	"github.com/karasz/gomesh/wireguard"
+	"github.com/spf13/cobra"
+	"golang.zx2c4.com/wireguard/wgctrl"
+)
+
+// statusCmd represents the status command
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the live state of the mesh on this node",
+	Long: `Status will read the WireGuard device and join its peers with the registry
+by public key, telling for each peer when it last had a handshake and how
+healthy it is: up, stale (no handshake for 3 minutes), never, missing (in the
+registry but not on the device) or unknown (on the device but not in the registry).`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		device, _ := cmd.Flags().GetString("device")
+		output, _ := cmd.Flags().GetString("output")
+		watch, _ := cmd.Flags().GetBool("watch")
+		interval, _ := cmd.Flags().GetDuration("interval")
+		if output != "table" && output != "json" {
+			return fmt.Errorf("unknown output %q", output)
+		}
+		client, err := wgctrl.New()
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		for {
+			// the registry may change while watching
+			peers, err := wireguard.LoadPeers(dbFile)
+			if err != nil {
+				return err
+			}
+			st, err := status.Collect(client, device, peers, time.Now())
+			if err != nil {
+				return err
+			}
+			if watch && output == "table" {
+				// clear the terminal
+				fmt.Print("\033[H\033[2J")
+			}
+			if output == "json" {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "    ")
+				err = enc.Encode(st)
+			} else {
+				err = printStatus(os.Stdout, st)
+			}
+			if err != nil || !watch {
+				return err
+			}
+			time.Sleep(interval)
+		}
+	},
+}
+
+func printStatus(w io.Writer, st status.Status) error {
+	node := st.Node
+	if node == "" {
+		node = "not in the registry"
+	}
+	fmt.Fprintf(w, "%s (%s): %d of %d expected peers configured\n", st.Device, node, st.Configured, st.Expected)
+	tw := tabwriter.NewWriter(w, 0, 0, 3, ' ', tabwriter.AlignRight|tabwriter.Debug)
+	fmt.Fprintln(tw, "NAME\t", "HEALTH\t", "HANDSHAKE\t", "RX\t", "TX\t", "ENDPOINT\t", "PUBLIC KEY\t")
+	for _, p := range st.Peers {
+		name := p.Name
+		if name == "" {
+			name = "?"
+		}
+		handshake := "-"
+		if p.LastHandshake != nil {
+			handshake = (time.Duration(p.HandshakeAge) * time.Second).String() + " ago"
+		}
+		fmt.Fprintln(tw, name+"\t", p.Health+"\t", handshake+"\t", strconv.FormatInt(p.RxBytes, 10)+"\t", strconv.FormatInt(p.TxBytes, 10)+"\t", p.Endpoint+"\t", p.PublicKey+"\t")
+	}
+	return tw.Flush()
+}
+
+func init() {
+	statusCmd.Flags().StringP("device", "", "wg0", "WireGuard interface to read")
+	statusCmd.Flags().StringP("output", "o", "table", "Output format (table, json)")
+	statusCmd.Flags().BoolP("watch", "w", false, "Refresh the view until interrupted")
+	statusCmd.Flags().DurationP("interval", "i", 2*time.Second, "Time between refreshes when watching")
+	rootCmd.AddCommand(statusCmd)
+}
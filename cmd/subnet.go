@@ -0,0 +1,127 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/karasz/gomesh/wireguard"
+	"github.com/spf13/cobra"
+)
+
+// subnetCmd represents the subnet command
+var subnetCmd = &cobra.Command{
+	Use:   "subnet",
+	Short: "Manage the LAN subnets routed behind nodes",
+	Long: `Nodes can announce the LAN prefixes they serve, the other nodes of their
+network route those prefixes through them. A prefix announced by two nodes,
+one of them as standby, is routed to the active one`,
+}
+
+// subnetAddCmd represents the subnet add command
+var subnetAddCmd = &cobra.Command{
+	Use:   "add",
+	Short: "Announce a subnet behind a node",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name, _ := cmd.Flags().GetString("name")
+		prefix, _ := cmd.Flags().GetString("prefix")
+		standby, _ := cmd.Flags().GetBool("standby")
+		masquerade, _ := cmd.Flags().GetBool("masquerade")
+		return thePeers.AddSubnet(name, wireguard.Subnet{Prefix: prefix, Standby: standby, Masquerade: masquerade})
+	},
+}
+
+// subnetDelCmd represents the subnet del command
+var subnetDelCmd = &cobra.Command{
+	Use:   "del",
+	Short: "Stop announcing a subnet behind a node",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name, _ := cmd.Flags().GetString("name")
+		prefix, _ := cmd.Flags().GetString("prefix")
+		return thePeers.DeleteSubnet(name, prefix)
+	},
+}
+
+// subnetPromoteCmd represents the subnet promote command
+var subnetPromoteCmd = &cobra.Command{
+	Use:   "promote",
+	Short: "Make a node the active gateway of a subnet",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name, _ := cmd.Flags().GetString("name")
+		prefix, _ := cmd.Flags().GetString("prefix")
+		return thePeers.PromoteSubnet(name, prefix)
+	},
+}
+
+// subnetListCmd represents the subnet list command
+var subnetListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the announced subnets",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', tabwriter.AlignRight|tabwriter.Debug)
+		fmt.Fprintln(tw, "PREFIX\t", "NODE\t", "NETWORK\t", "STATE\t", "MASQUERADE\t")
+		for _, a := range thePeers.Announcements() {
+			state := "standby"
+			if a.Active {
+				state = "active"
+			}
+			fmt.Fprintln(tw, a.Prefix+"\t", a.Peer+"\t", a.Network+"\t", state+"\t", strconv.FormatBool(a.Masquerade)+"\t")
+		}
+		return tw.Flush()
+	},
+}
+
+// subnetCheckCmd represents the subnet check command
+var subnetCheckCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Look for overlapping subnet announcements",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conflicts := thePeers.SubnetConflicts()
+		for _, c := range conflicts {
+			fmt.Println(c)
+		}
+		if len(conflicts) > 0 {
+			return errors.New("overlapping announcements found")
+		}
+		return nil
+	},
+}
+
+func init() {
+	for _, c := range []*cobra.Command{subnetAddCmd, subnetDelCmd, subnetPromoteCmd} {
+		c.Flags().StringP("name", "n", "", "Name of the node (Required)")
+		c.Flags().StringP("prefix", "p", "", "Subnet prefix, e.g. 192.168.1.0/24 (Required)")
+		for _, f := range []string{"name", "prefix"} {
+			if err := c.MarkFlagRequired(f); err != nil {
+				fmt.Println(err)
+			}
+		}
+	}
+	subnetAddCmd.Flags().BoolP("standby", "", false, "Only route the subnet here when no other node announces it as active")
+	subnetAddCmd.Flags().BoolP("masquerade", "", false, "NAT the mesh traffic going into the subnet")
+	subnetCmd.AddCommand(subnetAddCmd, subnetDelCmd, subnetPromoteCmd, subnetListCmd, subnetCheckCmd)
+	rootCmd.AddCommand(subnetCmd)
+}
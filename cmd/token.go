@@ -0,0 +1,130 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/karasz/gomesh/wireguard"
+	"github.com/spf13/cobra"
+)
+
+// tokenCmd represents the token command
+var tokenCmd = &cobra.Command{
+	Use:   "token",
+	Short: "Manage enrollment tokens",
+	Long:  `Enrollment tokens let nodes join a network with gomesh join`,
+}
+
+// tokenCreateCmd represents the token create command
+var tokenCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Create a signed enrollment token",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		network, _ := cmd.Flags().GetString("network")
+		ttl, _ := cmd.Flags().GetDuration("ttl")
+		uses, _ := cmd.Flags().GetInt("uses")
+		tags, _ := cmd.Flags().GetStringSlice("tags")
+		networks, err := wireguard.LoadNetworks()
+		if err != nil {
+			return err
+		}
+		if _, err = networks.Get(network); err != nil {
+			return err
+		}
+		store, err := wireguard.LoadTokens()
+		if err != nil {
+			return err
+		}
+		token, _, err := store.Create(network, ttl, uses, tags)
+		if err != nil {
+			return err
+		}
+		fmt.Println(token)
+		return nil
+	},
+}
+
+// tokenListCmd represents the token list command
+var tokenListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List outstanding enrollment tokens",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		all, _ := cmd.Flags().GetBool("all")
+		store, err := wireguard.LoadTokens()
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', tabwriter.AlignRight|tabwriter.Debug)
+		fmt.Fprintln(tw, "ID\t", "NETWORK\t", "TAGS\t", "EXPIRES\t", "USES\t", "STATE\t")
+		for _, t := range store.Tokens {
+			state := "outstanding"
+			switch {
+			case t.Revoked:
+				state = "revoked"
+			case !now.Before(t.Expires):
+				state = "expired"
+			case t.Used >= t.Uses:
+				state = "used"
+			}
+			if state != "outstanding" && !all {
+				continue
+			}
+			fmt.Fprintln(tw, t.ID+"\t", t.Network+"\t", strings.Join(t.Tags, ",")+"\t", t.Expires.Format(time.RFC3339)+"\t", strconv.Itoa(t.Used)+"/"+strconv.Itoa(t.Uses)+"\t", state+"\t")
+		}
+		return tw.Flush()
+	},
+}
+
+// tokenRevokeCmd represents the token revoke command
+var tokenRevokeCmd = &cobra.Command{
+	Use:   "revoke <id>",
+	Short: "Revoke an enrollment token",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := wireguard.LoadTokens()
+		if err != nil {
+			return err
+		}
+		return store.Revoke(args[0])
+	},
+}
+
+func init() {
+	tokenCreateCmd.Flags().StringP("network", "", "", "Network the token joins (Required)")
+	tokenCreateCmd.Flags().DurationP("ttl", "", time.Hour, "How long the token is valid")
+	tokenCreateCmd.Flags().IntP("uses", "", 1, "How many nodes may join with the token")
+	tokenCreateCmd.Flags().StringSliceP("tags", "t", []string{}, "Tags given to the nodes joining")
+	err := tokenCreateCmd.MarkFlagRequired("network")
+	if err != nil {
+		fmt.Println(err)
+	}
+	tokenListCmd.Flags().BoolP("all", "a", false, "Also list revoked, expired and used tokens")
+	tokenCmd.AddCommand(tokenCreateCmd, tokenListCmd, tokenRevokeCmd)
+	rootCmd.AddCommand(tokenCmd)
+}
@@ -0,0 +1,285 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// Package meshdns is a small authoritative DNS server
+// answering for the mesh domain from the registry
+package meshdns
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/karasz/gomesh/wireguard"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// upstreamTimeout is how long a forwarded query may take
+const upstreamTimeout = 3 * time.Second
+
+// Server answers <node>.<network>.<domain> queries, and the reverse
+// lookups of the mesh addresses, from the registry at the time of
+// the query. Other queries are forwarded to Upstream
+type Server struct {
+	// Domain is the mesh domain, wireguard.DefaultDomain if empty
+	Domain string
+	// Upstream is the host:port other queries are forwarded
+	// to, they are refused if empty
+	Upstream string
+	// Peers returns the current registry
+	Peers func() wireguard.Peers
+	// TTL of the answers
+	TTL uint32
+	// Logf is used for logging, log.Printf if nil
+	Logf func(format string, args ...interface{})
+}
+
+// ListenAndServe will answer queries on the UDP address until ctx is done
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, conn)
+}
+
+// Serve will answer the queries read from conn until ctx is done,
+// conn is closed when Serve returns
+func (s *Server) Serve(ctx context.Context, conn net.PacketConn) error {
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Temporary() {
+				continue
+			}
+			return err
+		}
+		req := append([]byte{}, buf[:n]...)
+		go func() {
+			resp, err := s.Handle(req)
+			if err != nil {
+				s.logf("dns: %s: %v", addr, err)
+				return
+			}
+			conn.WriteTo(resp, addr)
+		}()
+	}
+}
+
+// Handle will return the response to a DNS query
+func (s *Server) Handle(req []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(req)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return s.reply(h, nil, dnsmessage.RCodeFormatError, nil, nil)
+	}
+	name := strings.ToLower(strings.TrimSuffix(q.Name.String(), "."))
+	domain := s.domain()
+
+	if name == domain || strings.HasSuffix(name, "."+domain) {
+		return s.answer(h, q, name)
+	}
+	if strings.HasSuffix(name, ".in-addr.arpa") || strings.HasSuffix(name, ".ip6.arpa") {
+		if resp, ok, err := s.reverse(h, q, name); ok || err != nil {
+			return resp, err
+		}
+	}
+	if s.Upstream == "" {
+		return s.reply(h, &q, dnsmessage.RCodeRefused, nil, nil)
+	}
+	resp, err := s.forward(req)
+	if err != nil {
+		s.logf("dns: forwarding %s: %v", name, err)
+		return s.reply(h, &q, dnsmessage.RCodeServerFailure, nil, nil)
+	}
+	return resp, nil
+}
+
+// answer will answer a query inside the mesh domain
+func (s *Server) answer(h dnsmessage.Header, q dnsmessage.Question, name string) ([]byte, error) {
+	records, err := s.Peers().DNSRecords(s.domain())
+	if err != nil {
+		return s.reply(h, &q, dnsmessage.RCodeServerFailure, nil, nil)
+	}
+
+	exists := name == s.domain()
+	var answers []dnsmessage.Resource
+	for _, r := range records {
+		if r.Name != name {
+			continue
+		}
+		exists = true
+		hdr := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: s.ttl()}
+		if v4 := r.IP.To4(); v4 != nil && q.Type == dnsmessage.TypeA {
+			var a dnsmessage.AResource
+			copy(a.A[:], v4)
+			answers = append(answers, dnsmessage.Resource{Header: hdr, Body: &a})
+		}
+		if r.IP.To4() == nil && q.Type == dnsmessage.TypeAAAA {
+			var a dnsmessage.AAAAResource
+			copy(a.AAAA[:], r.IP.To16())
+			answers = append(answers, dnsmessage.Resource{Header: hdr, Body: &a})
+		}
+	}
+	if name == s.domain() && q.Type == dnsmessage.TypeSOA {
+		soa, err := s.soa()
+		if err != nil {
+			return nil, err
+		}
+		return s.reply(h, &q, dnsmessage.RCodeSuccess, []dnsmessage.Resource{soa}, nil)
+	}
+
+	rcode := dnsmessage.RCodeSuccess
+	if !exists {
+		rcode = dnsmessage.RCodeNameError
+	}
+	var authority []dnsmessage.Resource
+	if len(answers) == 0 {
+		soa, err := s.soa()
+		if err != nil {
+			return nil, err
+		}
+		authority = append(authority, soa)
+	}
+	return s.reply(h, &q, rcode, answers, authority)
+}
+
+// reverse will answer a PTR query for a mesh address,
+// ok is false if the address is not in the mesh
+func (s *Server) reverse(h dnsmessage.Header, q dnsmessage.Question, name string) ([]byte, bool, error) {
+	records, err := s.Peers().DNSRecords(s.domain())
+	if err != nil {
+		return nil, false, nil
+	}
+	for _, r := range records {
+		if wireguard.ReverseName(r.IP) != name {
+			continue
+		}
+		var answers []dnsmessage.Resource
+		if q.Type == dnsmessage.TypePTR {
+			target, err := dnsmessage.NewName(r.Name + ".")
+			if err != nil {
+				return nil, true, err
+			}
+			answers = append(answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: s.ttl()},
+				Body:   &dnsmessage.PTRResource{PTR: target},
+			})
+		}
+		resp, err := s.reply(h, &q, dnsmessage.RCodeSuccess, answers, nil)
+		return resp, true, err
+	}
+	return nil, false, nil
+}
+
+func (s *Server) reply(h dnsmessage.Header, q *dnsmessage.Question, rcode dnsmessage.RCode, answers, authority []dnsmessage.Resource) ([]byte, error) {
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 h.ID,
+			Response:           true,
+			OpCode:             h.OpCode,
+			Authoritative:      rcode != dnsmessage.RCodeRefused && rcode != dnsmessage.RCodeServerFailure,
+			RecursionDesired:   h.RecursionDesired,
+			RecursionAvailable: s.Upstream != "",
+			RCode:              rcode,
+		},
+		Answers:     answers,
+		Authorities: authority,
+	}
+	if q != nil {
+		msg.Questions = []dnsmessage.Question{*q}
+	}
+	return msg.Pack()
+}
+
+func (s *Server) soa() (dnsmessage.Resource, error) {
+	origin, err := dnsmessage.NewName(s.domain() + ".")
+	if err != nil {
+		return dnsmessage.Resource{}, err
+	}
+	ns, _ := dnsmessage.NewName("ns." + s.domain() + ".")
+	mbox, _ := dnsmessage.NewName("hostmaster." + s.domain() + ".")
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: origin, Class: dnsmessage.ClassINET, TTL: s.ttl()},
+		Body: &dnsmessage.SOAResource{
+			NS: ns, MBox: mbox, Serial: uint32(time.Now().Unix()),
+			Refresh: 3600, Retry: 600, Expire: 86400, MinTTL: s.ttl(),
+		},
+	}, nil
+}
+
+// forward will pass the query to the upstream server
+func (s *Server) forward(req []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", s.Upstream, upstreamTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(upstreamTimeout))
+	if _, err = conn.Write(req); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func (s *Server) domain() string {
+	if s.Domain == "" {
+		return wireguard.DefaultDomain
+	}
+	return strings.ToLower(strings.Trim(s.Domain, "."))
+}
+
+func (s *Server) ttl() uint32 {
+	if s.TTL == 0 {
+		return 60
+	}
+	return s.TTL
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.Logf != nil {
+		s.Logf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
@@ -0,0 +1,188 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package meshdns
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/karasz/gomesh/wireguard"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// registry is a registry that can change between queries
+type registry struct {
+	mu    sync.Mutex
+	peers wireguard.Peers
+}
+
+func (r *registry) get() wireguard.Peers {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append(wireguard.Peers{}, r.peers...)
+}
+
+func (r *registry) set(p wireguard.Peers) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.peers = p
+}
+
+// serve will run s on a loopback UDP port and return its address
+func serve(t *testing.T, s *Server) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(ctx, conn) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	})
+	s.Logf = t.Logf
+	return conn.LocalAddr().String()
+}
+
+// query will ask the server at addr and return the
+// rcode and the answers as strings
+func query(t *testing.T, addr, name string, typ dnsmessage.Type) (dnsmessage.RCode, []string) {
+	t.Helper()
+	req := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 42, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: typ, Class: dnsmessage.ClassINET}},
+	}
+	b, err := req.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("%s %s: %v", name, typ, err)
+	}
+	var resp dnsmessage.Message
+	if err = resp.Unpack(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ID != req.ID || !resp.Response {
+		t.Errorf("%s %s: header %+v", name, typ, resp.Header)
+	}
+	var answers []string
+	for _, a := range resp.Answers {
+		switch body := a.Body.(type) {
+		case *dnsmessage.AResource:
+			answers = append(answers, net.IP(body.A[:]).String())
+		case *dnsmessage.AAAAResource:
+			answers = append(answers, net.IP(body.AAAA[:]).String())
+		case *dnsmessage.PTRResource:
+			answers = append(answers, body.PTR.String())
+		default:
+			answers = append(answers, body.GoString())
+		}
+	}
+	return resp.RCode, answers
+}
+
+func TestServer(t *testing.T) {
+	upstream := serve(t, &Server{
+		Domain: "example.com",
+		Peers: func() wireguard.Peers {
+			return wireguard.Peers{{Name: "www", Address: []string{"192.0.2.80/32"}}}
+		},
+	})
+	reg := &registry{peers: wireguard.Peers{
+		{Name: "web1", Network: "prod", Address: []string{"10.0.0.1/24", "fd00::1/64"}},
+		{Name: "laptop1", Network: "prod", Address: []string{"10.0.0.9/24"}, Pending: true},
+	}}
+	addr := serve(t, &Server{Upstream: upstream, Peers: reg.get})
+
+	tests := []struct {
+		name  string
+		typ   dnsmessage.Type
+		rcode dnsmessage.RCode
+		want  []string
+	}{
+		{"web1.prod.mesh.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"10.0.0.1"}},
+		{"WEB1.Prod.Mesh.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"10.0.0.1"}},
+		{"web1.prod.mesh.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, []string{"fd00::1"}},
+		{"web1.prod.mesh.", dnsmessage.TypeTXT, dnsmessage.RCodeSuccess, nil},
+		{"nope.prod.mesh.", dnsmessage.TypeA, dnsmessage.RCodeNameError, nil},
+		{"laptop1.prod.mesh.", dnsmessage.TypeA, dnsmessage.RCodeNameError, nil},
+		{"1.0.0.10.in-addr.arpa.", dnsmessage.TypePTR, dnsmessage.RCodeSuccess, []string{"web1.prod.mesh."}},
+		{wireguard.ReverseName(net.ParseIP("fd00::1")) + ".", dnsmessage.TypePTR, dnsmessage.RCodeSuccess, []string{"web1.prod.mesh."}},
+		{"www.example.com.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"192.0.2.80"}},
+		{"nope.example.com.", dnsmessage.TypeA, dnsmessage.RCodeNameError, nil},
+	}
+	for _, tt := range tests {
+		rcode, answers := query(t, addr, tt.name, tt.typ)
+		if rcode != tt.rcode || !reflect.DeepEqual(answers, tt.want) {
+			t.Errorf("%s %s: got %s %v, expected %s %v", tt.name, tt.typ, rcode, answers, tt.rcode, tt.want)
+		}
+	}
+
+	// the registry is read on every query
+	reg.set(wireguard.Peers{{Name: "db1", Network: "prod", Address: []string{"10.0.0.2/24"}}})
+	if rcode, answers := query(t, addr, "db1.prod.mesh.", dnsmessage.TypeA); rcode != dnsmessage.RCodeSuccess || !reflect.DeepEqual(answers, []string{"10.0.0.2"}) {
+		t.Errorf("added node: got %s %v", rcode, answers)
+	}
+	if rcode, _ := query(t, addr, "web1.prod.mesh.", dnsmessage.TypeA); rcode != dnsmessage.RCodeNameError {
+		t.Errorf("removed node: got %s", rcode)
+	}
+	// and the address is no longer the mesh's to answer for,
+	// the upstream refuses it
+	if rcode, _ := query(t, addr, "1.0.0.10.in-addr.arpa.", dnsmessage.TypePTR); rcode != dnsmessage.RCodeRefused {
+		t.Errorf("removed node PTR: got %s", rcode)
+	}
+}
+
+func TestServerRefused(t *testing.T) {
+	addr := serve(t, &Server{Domain: "corp.internal.", Peers: func() wireguard.Peers {
+		return wireguard.Peers{{Name: "web1", Address: []string{"10.0.0.1/24"}}}
+	}})
+	if rcode, answers := query(t, addr, "web1.corp.internal.", dnsmessage.TypeA); rcode != dnsmessage.RCodeSuccess || len(answers) != 1 {
+		t.Errorf("got %s %v", rcode, answers)
+	}
+	if rcode, _ := query(t, addr, "www.example.com.", dnsmessage.TypeA); rcode != dnsmessage.RCodeRefused {
+		t.Errorf("got %s, expected refused", rcode)
+	}
+	if rcode, _ := query(t, addr, "2.0.0.10.in-addr.arpa.", dnsmessage.TypePTR); rcode != dnsmessage.RCodeRefused {
+		t.Errorf("PTR outside the mesh: got %s, expected refused", rcode)
+	}
+}
@@ -0,0 +1,341 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// Package meshtest brings a whole registry up in one process, every
+// node running wireguard-go on a userspace network stack and talking to
+// the others over loopback UDP, so that rendered configs can be tested
+// end to end without root or kernel modules:
+//
+//	m, err := meshtest.Start(peers)
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	defer m.Close()
+//	if err := m.Connect(ctx, "web1", "db1", 5432); err != nil {
+//		t.Error(err)
+//	}
+//
+// Relays forward between their peers and the nftables rules of the
+// access policy in the rendered configs filter what nodes receive.
+package meshtest
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/karasz/gomesh/wireguard"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+// mtu of the node interfaces when the config sets none
+const mtu = 1420
+
+// Mesh is a registry brought up in one process
+type Mesh struct {
+	Nodes map[string]*Node
+}
+
+// Node is a Peer of the registry running its rendered config
+type Node struct {
+	Peer   wireguard.Peer
+	Config wireguard.Config
+	// Net is the network stack of the node, bound to its mesh addresses
+	Net *netstack.Net
+
+	dev  *device.Device
+	port int
+
+	mu sync.Mutex
+	// echo servers Connect started, by port
+	echo map[int]net.Listener
+}
+
+// Start will render the config of every Peer that is not pending and
+// bring them all up, the endpoints in the configs are pointed at the
+// loopback ports the nodes listen on
+func Start(peers wireguard.Peers) (*Mesh, error) {
+	m := &Mesh{Nodes: map[string]*Node{}}
+	for _, pr := range peers {
+		if pr.Pending {
+			continue
+		}
+		n, err := start(peers, pr)
+		if err != nil {
+			m.Close()
+			return nil, fmt.Errorf("%s: %w", pr.Name, err)
+		}
+		m.Nodes[pr.Name] = n
+	}
+	// the ports are only known once every node is up
+	for _, n := range m.Nodes {
+		if err := m.configure(n); err != nil {
+			m.Close()
+			return nil, fmt.Errorf("%s: %w", n.Peer.Name, err)
+		}
+	}
+	return m, nil
+}
+
+// start will bring a node up with its key and addresses but no peers
+func start(peers wireguard.Peers, pr wireguard.Peer) (*Node, error) {
+	c, err := peers.Config(pr)
+	if err != nil {
+		return nil, err
+	}
+	if c.Interface.PrivateKey == "" {
+		return nil, errors.New("private key not in the registry")
+	}
+	rules, err := firewall(c.Interface.PostUp)
+	if err != nil {
+		return nil, err
+	}
+	var local []netip.Addr
+	for _, a := range c.Interface.Address {
+		addr, err := parseAddr(a)
+		if err != nil {
+			return nil, err
+		}
+		local = append(local, addr)
+	}
+	size := c.Interface.MTU
+	if size == 0 {
+		size = mtu
+	}
+	t, tnet, err := netstack.CreateNetTUN(local, nil, size)
+	if err != nil {
+		return nil, err
+	}
+	s := newShim(t, local, c.Forwards())
+	if rules != nil {
+		s.allow = allow(rules)
+	}
+	dev := device.NewDevice(s, conn.NewDefaultBind(), device.NewLogger(device.LogLevelSilent, ""))
+	key, err := hexKey(c.Interface.PrivateKey)
+	if err != nil {
+		dev.Close()
+		return nil, err
+	}
+	if err = dev.IpcSet("private_key=" + key + "\nlisten_port=0\n"); err != nil {
+		dev.Close()
+		return nil, err
+	}
+	if err = dev.Up(); err != nil {
+		dev.Close()
+		return nil, err
+	}
+	n := &Node{Peer: pr, Config: c, Net: tnet, dev: dev}
+	if n.port, err = listenPort(dev); err != nil {
+		dev.Close()
+		return nil, err
+	}
+	return n, nil
+}
+
+// configure will give a node its peers
+func (m *Mesh) configure(n *Node) error {
+	var b strings.Builder
+	b.WriteString("replace_peers=true\n")
+	for _, pc := range n.Config.Peers {
+		key, err := hexKey(pc.PublicKey)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&b, "public_key=%s\nreplace_allowed_ips=true\n", key)
+		if pc.Endpoint != "" {
+			other, ok := m.Nodes[pc.Name]
+			if !ok {
+				return fmt.Errorf("peer %s is not running", pc.Name)
+			}
+			fmt.Fprintf(&b, "endpoint=127.0.0.1:%d\n", other.port)
+		}
+		for _, a := range pc.AllowedIPs {
+			p, err := parsePrefix(a)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(&b, "allowed_ip=%s\n", p)
+		}
+		if pc.PersistentKeepalive != 0 {
+			fmt.Fprintf(&b, "persistent_keepalive_interval=%d\n", pc.PersistentKeepalive)
+		}
+	}
+	return n.dev.IpcSet(b.String())
+}
+
+// Node will return the named node
+func (m *Mesh) Node(name string) (*Node, error) {
+	for _, n := range m.Nodes {
+		if strings.EqualFold(n.Peer.Name, name) {
+			return n, nil
+		}
+	}
+	return nil, fmt.Errorf("%s: %w", name, wireguard.ErrPeerNotFound)
+}
+
+// Connect will open a TCP connection from one node to the first
+// address of another and pass a byte both ways
+func (m *Mesh) Connect(ctx context.Context, from, to string, port int) error {
+	src, err := m.Node(from)
+	if err != nil {
+		return err
+	}
+	dst, err := m.Node(to)
+	if err != nil {
+		return err
+	}
+	if err = dst.serveEcho(port); err != nil {
+		return err
+	}
+
+	c, err := src.Dial(ctx, dst.Addr(), port)
+	if err != nil {
+		return fmt.Errorf("%s cannot reach %s:%d: %w", from, to, port, err)
+	}
+	defer c.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+	if _, err = c.Write([]byte{1}); err != nil {
+		return err
+	}
+	if _, err = bufio.NewReader(c).ReadByte(); err != nil {
+		return fmt.Errorf("%s got no answer from %s:%d: %w", from, to, port, err)
+	}
+	return nil
+}
+
+// Close will take every node down
+func (m *Mesh) Close() {
+	for _, n := range m.Nodes {
+		n.mu.Lock()
+		for _, ln := range n.echo {
+			ln.Close()
+		}
+		n.mu.Unlock()
+		n.dev.Close()
+	}
+}
+
+// serveEcho will answer connections to port with the byte they send,
+// the listener is kept for the next Connect to the node and port
+func (n *Node) serveEcho(port int) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.echo[port]; ok {
+		return nil
+	}
+	ln, err := n.Listen(port)
+	if err != nil {
+		return err
+	}
+	if n.echo == nil {
+		n.echo = map[int]net.Listener{}
+	}
+	n.echo[port] = ln
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.CopyN(c, c, 1)
+			}()
+		}
+	}()
+	return nil
+}
+
+// Addr will return the first mesh address of the node
+func (n *Node) Addr() netip.Addr {
+	if len(n.Config.Interface.Address) == 0 {
+		return netip.Addr{}
+	}
+	addr, _ := parseAddr(n.Config.Interface.Address[0])
+	return addr
+}
+
+// Listen will accept TCP connections on the first
+// mesh address of the node
+func (n *Node) Listen(port int) (net.Listener, error) {
+	return n.Net.ListenTCPAddrPort(netip.AddrPortFrom(n.Addr(), uint16(port)))
+}
+
+// Dial will open a TCP connection from the node
+func (n *Node) Dial(ctx context.Context, addr netip.Addr, port int) (net.Conn, error) {
+	return n.Net.DialContextTCPAddrPort(ctx, netip.AddrPortFrom(addr, uint16(port)))
+}
+
+// listenPort will return the UDP port the device got
+func listenPort(dev *device.Device) (int, error) {
+	state, err := dev.IpcGet()
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(state, "\n") {
+		if v := strings.TrimPrefix(line, "listen_port="); v != line {
+			return strconv.Atoi(v)
+		}
+	}
+	return 0, errors.New("device has no listen port")
+}
+
+// hexKey will turn a base64 WireGuard key into
+// the hex form of the UAPI
+func hexKey(k string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(k)
+	if err != nil || len(b) != 32 {
+		return "", fmt.Errorf("invalid key %q", k)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func parseAddr(a string) (netip.Addr, error) {
+	if p, err := netip.ParsePrefix(a); err == nil {
+		return p.Addr(), nil
+	}
+	return netip.ParseAddr(a)
+}
+
+func parsePrefix(a string) (netip.Prefix, error) {
+	if p, err := netip.ParsePrefix(a); err == nil {
+		return p.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(a)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
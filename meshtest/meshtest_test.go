@@ -0,0 +1,172 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package meshtest
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/karasz/gomesh/wireguard"
+)
+
+// registry will point the registry at a temporary directory, with
+// policy as its access policy when not empty, and return the peers
+// with keys of their own
+func registry(t *testing.T, policy string, peers ...wireguard.Peer) wireguard.Peers {
+	t.Helper()
+	db := filepath.Join(t.TempDir(), "database.json")
+	if _, err := wireguard.LoadPeers(db); err != nil {
+		t.Fatal(err)
+	}
+	if policy != "" {
+		if err := os.WriteFile(wireguard.SidecarPath("policy"), []byte(policy), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range peers {
+		key, err := wireguard.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		peers[i].PrivateKey = key
+	}
+	return wireguard.Peers(peers)
+}
+
+func startMesh(t *testing.T, peers wireguard.Peers) *Mesh {
+	t.Helper()
+	m, err := Start(peers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(m.Close)
+	return m
+}
+
+func connect(t *testing.T, m *Mesh, from, to string, port int, timeout time.Duration) error {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return m.Connect(ctx, from, to, port)
+}
+
+func TestConnectDirect(t *testing.T) {
+	m := startMesh(t, registry(t, "",
+		wireguard.Peer{Name: "web1", Address: []string{"10.0.0.1/24"}, Endpoint: "web1.example.com", ListenPort: 51820},
+		wireguard.Peer{Name: "db1", Address: []string{"10.0.0.2/24"}, Endpoint: "db1.example.com", ListenPort: 51820},
+	))
+	// the second connection to the same port reuses the listener
+	for i := 0; i < 2; i++ {
+		if err := connect(t, m, "web1", "db1", 5432, 10*time.Second); err != nil {
+			t.Fatalf("connection %d: %v", i+1, err)
+		}
+	}
+	if err := connect(t, m, "db1", "web1", 5432, 10*time.Second); err != nil {
+		t.Error(err)
+	}
+	if err := connect(t, m, "web1", "nope", 5432, time.Second); err == nil {
+		t.Error("connected to a node that does not exist")
+	}
+}
+
+func TestConnectRelayed(t *testing.T) {
+	m := startMesh(t, registry(t, "",
+		wireguard.Peer{Name: "laptop1", Address: []string{"10.0.0.1/24"}, NAT: wireguard.NATSymmetric},
+		wireguard.Peer{Name: "laptop2", Address: []string{"10.0.0.2/24"}, NAT: wireguard.NATSymmetric},
+		wireguard.Peer{Name: "relay1", Address: []string{"10.0.0.3/24"}, Endpoint: "relay1.example.com", ListenPort: 51820, Relay: true},
+	))
+	for _, pc := range m.Nodes["laptop1"].Config.Peers {
+		if pc.Name == "laptop2" {
+			t.Fatal("laptop1 has a tunnel to laptop2")
+		}
+	}
+	if err := connect(t, m, "laptop1", "laptop2", 22, 10*time.Second); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConnectPolicy(t *testing.T) {
+	m := startMesh(t, registry(t, "allow tag:web -> tag:db port 5432/tcp\n",
+		wireguard.Peer{Name: "web1", Address: []string{"10.0.0.1/24"}, Endpoint: "web1.example.com", ListenPort: 51820, Tags: []string{"web"}},
+		wireguard.Peer{Name: "db1", Address: []string{"10.0.0.2/24"}, Endpoint: "db1.example.com", ListenPort: 51820, Tags: []string{"db"}},
+	))
+	if err := connect(t, m, "web1", "db1", 5432, 10*time.Second); err != nil {
+		t.Error(err)
+	}
+	if err := connect(t, m, "web1", "db1", 22, time.Second); err == nil {
+		t.Error("web1 reached db1:22")
+	}
+	if err := connect(t, m, "db1", "web1", 5432, time.Second); err == nil {
+		t.Error("db1 reached web1:5432")
+	}
+}
+
+func TestParseNftRule(t *testing.T) {
+	tests := []struct {
+		in   string
+		want nftRule
+		err  bool
+	}{
+		{in: "drop", want: nftRule{}},
+		{in: "ct state established,related accept", want: nftRule{tracked: true, accept: true}},
+		{
+			in: "ip saddr { 10.0.0.1, 10.0.0.2 } tcp dport { 22, 8000-8080 } accept",
+			want: nftRule{
+				saddr:  map[netip.Addr]bool{netip.MustParseAddr("10.0.0.1"): true, netip.MustParseAddr("10.0.0.2"): true},
+				protos: map[uint8]bool{6: true},
+				dports: [][2]int{{22, 22}, {8000, 8080}},
+				accept: true,
+			},
+		},
+		{
+			in: "ip6 saddr { fd00::1 } meta l4proto { icmp, ipv6-icmp } accept",
+			want: nftRule{
+				saddr:  map[netip.Addr]bool{netip.MustParseAddr("fd00::1"): true},
+				protos: map[uint8]bool{1: true, 58: true},
+				accept: true,
+			},
+		},
+		{in: "ip saddr { 10.0.0.1 } meta l4proto udp accept", want: nftRule{saddr: map[netip.Addr]bool{netip.MustParseAddr("10.0.0.1"): true}, protos: map[uint8]bool{17: true}, accept: true}},
+		{in: "ip saddr { 10.0.0.1 }", err: true},
+		{in: "accept ip saddr { 10.0.0.1 }", err: true},
+		{in: "ip daddr { 10.0.0.1 } accept", err: true},
+		{in: "meta l4proto gre accept", err: true},
+		{in: "counter accept", err: true},
+	}
+	for _, tt := range tests {
+		got, err := parseNftRule(tt.in)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: no error", tt.in)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %+v, %v, expected %+v", tt.in, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package meshtest
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// nftPrefix starts the PostUp commands of the access policy
+const nftPrefix = "nft add rule inet gomesh input iifname %i "
+
+// protocol numbers of the l4proto names the rules use
+var protoNumbers = map[string]uint8{
+	"icmp":      1,
+	"tcp":       6,
+	"udp":       17,
+	"ipv6-icmp": 58,
+}
+
+// nftRule is one rule of the input chain, a nil
+// set matches everything
+type nftRule struct {
+	saddr  map[netip.Addr]bool
+	protos map[uint8]bool
+	dports [][2]int
+	// tracked rules are the ct state ones,
+	// the shim tracks connections itself
+	tracked bool
+	accept  bool
+}
+
+// matches will tell whether the rule applies to a new connection
+func (r nftRule) matches(p packet) bool {
+	if r.tracked {
+		return false
+	}
+	if r.saddr != nil && !r.saddr[p.src.Addr()] {
+		return false
+	}
+	if r.protos != nil && !r.protos[p.proto] {
+		return false
+	}
+	if r.dports == nil {
+		return true
+	}
+	port := int(p.dst.Port())
+	for _, d := range r.dports {
+		if port >= d[0] && port <= d[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// firewall will read the input chain from the PostUp commands of a
+// config, nil when the config does not filter
+func firewall(postUp []string) ([]nftRule, error) {
+	var rules []nftRule
+	for _, up := range postUp {
+		if !strings.HasPrefix(up, nftPrefix) {
+			continue
+		}
+		r, err := parseNftRule(strings.TrimPrefix(up, nftPrefix))
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", up, err)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// allow will return the check of new connections against the rules,
+// the first matching rule decides and the chain policy accepts
+func allow(rules []nftRule) func(packet) bool {
+	return func(p packet) bool {
+		for _, r := range rules {
+			if r.matches(p) {
+				return r.accept
+			}
+		}
+		return true
+	}
+}
+
+// parseNftRule will read the subset of the nftables
+// syntax the access policy is rendered to
+func parseNftRule(s string) (nftRule, error) {
+	var r nftRule
+	tokens := strings.Fields(s)
+	for i := 0; i < len(tokens); i++ {
+		var values []string
+		switch tok := tokens[i]; tok {
+		case "accept", "drop":
+			if i != len(tokens)-1 {
+				return r, fmt.Errorf("%s is not last", tok)
+			}
+			r.accept = tok == "accept"
+			return r, nil
+		case "ct":
+			// ct state established,related
+			i += 2
+			r.tracked = true
+		case "ip", "ip6":
+			if i+1 >= len(tokens) || tokens[i+1] != "saddr" {
+				return r, fmt.Errorf("unknown %s match", tok)
+			}
+			values, i = readSet(tokens, i+2)
+			r.saddr = map[netip.Addr]bool{}
+			for _, v := range values {
+				addr, err := netip.ParseAddr(v)
+				if err != nil {
+					return r, err
+				}
+				r.saddr[addr] = true
+			}
+		case "meta":
+			if i+1 >= len(tokens) || tokens[i+1] != "l4proto" {
+				return r, fmt.Errorf("unknown meta match")
+			}
+			values, i = readSet(tokens, i+2)
+			r.protos = map[uint8]bool{}
+			for _, v := range values {
+				n, ok := protoNumbers[v]
+				if !ok {
+					return r, fmt.Errorf("unknown protocol %s", v)
+				}
+				r.protos[n] = true
+			}
+		case "tcp", "udp":
+			if i+1 >= len(tokens) || tokens[i+1] != "dport" {
+				return r, fmt.Errorf("unknown %s match", tok)
+			}
+			values, i = readSet(tokens, i+2)
+			r.protos = map[uint8]bool{protoNumbers[tok]: true}
+			for _, v := range values {
+				from, to, _ := strings.Cut(v, "-")
+				if to == "" {
+					to = from
+				}
+				a, err := strconv.Atoi(from)
+				if err != nil {
+					return r, err
+				}
+				b, err := strconv.Atoi(to)
+				if err != nil {
+					return r, err
+				}
+				r.dports = append(r.dports, [2]int{a, b})
+			}
+		default:
+			return r, fmt.Errorf("unknown match %s", tok)
+		}
+	}
+	return r, fmt.Errorf("no verdict")
+}
+
+// readSet will read a value or a { a, b } set starting at
+// tokens[i] and return the index of its last token
+func readSet(tokens []string, i int) ([]string, int) {
+	if i >= len(tokens) {
+		return nil, i
+	}
+	if tokens[i] != "{" {
+		return []string{tokens[i]}, i
+	}
+	var values []string
+	for i++; i < len(tokens) && tokens[i] != "}"; i++ {
+		if v := strings.TrimSuffix(tokens[i], ","); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values, i
+}
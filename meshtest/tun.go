@@ -0,0 +1,225 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package meshtest
+
+import (
+	"net/netip"
+	"os"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// packet is what the shim looks at in an IP packet
+type packet struct {
+	proto uint8
+	src   netip.AddrPort
+	dst   netip.AddrPort
+}
+
+// flow is a direction of a connection
+type flow struct {
+	proto    uint8
+	src, dst netip.AddrPort
+}
+
+// shim sits between wireguard-go and the network stack of a node,
+// doing what the kernel would: it sends the packets that are not for
+// the node back out when the node forwards, and filters what is
+// delivered to the node like the input chain of the access policy
+type shim struct {
+	tun.Device
+	local    []netip.Addr
+	forwards bool
+	// allow tells whether a new connection may be delivered
+	allow func(packet) bool
+
+	inner   chan []byte
+	forward chan []byte
+	done    chan struct{}
+	once    sync.Once
+
+	mu    sync.Mutex
+	flows map[flow]bool
+}
+
+func newShim(t tun.Device, local []netip.Addr, forwards bool) *shim {
+	s := &shim{
+		Device:   t,
+		local:    local,
+		forwards: forwards,
+		inner:    make(chan []byte),
+		forward:  make(chan []byte, 256),
+		done:     make(chan struct{}),
+		flows:    map[flow]bool{},
+	}
+	go s.readInner()
+	return s
+}
+
+// readInner will pass on what the network stack sends
+func (s *shim) readInner() {
+	bufs, sizes := [][]byte{make([]byte, 65535)}, []int{0}
+	for {
+		n, err := s.Device.Read(bufs, sizes, 0)
+		if err != nil {
+			close(s.inner)
+			return
+		}
+		if n == 0 {
+			continue
+		}
+		b := append([]byte{}, bufs[0][:sizes[0]]...)
+		if p, ok := parse(b); ok {
+			s.track(p)
+		}
+		select {
+		case s.inner <- b:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Read implements tun.Device
+func (s *shim) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	var b []byte
+	select {
+	case b = <-s.forward:
+	case p, ok := <-s.inner:
+		if !ok {
+			return 0, os.ErrClosed
+		}
+		b = p
+	case <-s.done:
+		return 0, os.ErrClosed
+	}
+	sizes[0] = copy(bufs[0][offset:], b)
+	return 1, nil
+}
+
+// Write implements tun.Device
+func (s *shim) Write(bufs [][]byte, offset int) (int, error) {
+	for _, buf := range bufs {
+		b := buf[offset:]
+		p, ok := parse(b)
+		if !ok {
+			continue
+		}
+		if !s.isLocal(p.dst.Addr()) {
+			if s.forwards {
+				select {
+				case s.forward <- append([]byte{}, b...):
+				default:
+				}
+			}
+			continue
+		}
+		if !s.admit(p) {
+			continue
+		}
+		if _, err := s.Device.Write([][]byte{buf}, offset); err != nil {
+			return 0, err
+		}
+	}
+	return len(bufs), nil
+}
+
+// BatchSize implements tun.Device, the shim moves one packet at a time
+func (s *shim) BatchSize() int {
+	return 1
+}
+
+// Close implements tun.Device
+func (s *shim) Close() error {
+	s.once.Do(func() { close(s.done) })
+	return s.Device.Close()
+}
+
+func (s *shim) isLocal(addr netip.Addr) bool {
+	for _, l := range s.local {
+		if l == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// track will remember a connection so that its answers get in
+func (s *shim) track(p packet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flows[flow{p.proto, p.dst, p.src}] = true
+	s.flows[flow{p.proto, p.src, p.dst}] = true
+}
+
+// admit will let in the packets of known connections
+// and the new ones the policy allows
+func (s *shim) admit(p packet) bool {
+	if s.allow == nil {
+		return true
+	}
+	s.mu.Lock()
+	known := s.flows[flow{p.proto, p.src, p.dst}]
+	s.mu.Unlock()
+	if known {
+		return true
+	}
+	if !s.allow(p) {
+		return false
+	}
+	s.track(p)
+	return true
+}
+
+// parse will read the addresses and ports of an IP packet
+func parse(b []byte) (packet, bool) {
+	var p packet
+	var src, dst netip.Addr
+	var l4 []byte
+	switch {
+	case len(b) >= 20 && b[0]>>4 == 4:
+		ihl := int(b[0]&0x0f) * 4
+		if len(b) < ihl {
+			return p, false
+		}
+		p.proto = b[9]
+		src = netip.AddrFrom4([4]byte(b[12:16]))
+		dst = netip.AddrFrom4([4]byte(b[16:20]))
+		l4 = b[ihl:]
+	case len(b) >= 40 && b[0]>>4 == 6:
+		p.proto = b[6]
+		src = netip.AddrFrom16([16]byte(b[8:24]))
+		dst = netip.AddrFrom16([16]byte(b[24:40]))
+		l4 = b[40:]
+	default:
+		return p, false
+	}
+	var sport, dport uint16
+	if (p.proto == 6 || p.proto == 17) && len(l4) >= 4 {
+		sport = uint16(l4[0])<<8 | uint16(l4[1])
+		dport = uint16(l4[2])<<8 | uint16(l4[3])
+	}
+	p.src = netip.AddrPortFrom(src, sport)
+	p.dst = netip.AddrPortFrom(dst, dport)
+	return p, true
+}
@@ -0,0 +1,227 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// Package probe measures whether traffic flows between mesh nodes,
+// using a small UDP and TCP echo service instead of ICMP so that
+// no privileges are needed
+package probe
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/karasz/gomesh/wireguard"
+)
+
+// DefaultPort is where the echo service listens
+const DefaultPort = 51821
+
+// size of the probe packets, a sequence number and a nonce
+const size = 16
+
+// Responder answers the probes of the other nodes
+type Responder struct {
+	// Addr is the host:port to listen on, both UDP and TCP
+	Addr string
+}
+
+// ListenAndServe will echo UDP packets and TCP streams
+// on Addr until ctx is done
+func (r Responder) ListenAndServe(ctx context.Context) error {
+	pc, err := net.ListenPacket("udp", r.Addr)
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", r.Addr)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+		ln.Close()
+	}()
+	go r.serveTCP(ln)
+	buf := make([]byte, 64)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		pc.WriteTo(buf[:n], addr)
+	}
+}
+
+func (r Responder) serveTCP(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			// a prober sends a few packets and goes away
+			conn.SetDeadline(time.Now().Add(time.Minute))
+			io.Copy(conn, io.LimitReader(conn, 64*size))
+		}()
+	}
+}
+
+// Prober measures the round trips to other nodes
+type Prober struct {
+	// Proto is udp or tcp, udp if empty
+	Proto string
+	// Port of the echo service, DefaultPort if zero
+	Port int
+	// Count is the number of probes sent to each node
+	Count int
+	// Interval is the time between two probes to a node
+	Interval time.Duration
+	// Timeout is how long to wait for each answer, a second if zero
+	Timeout time.Duration
+}
+
+// Probe will send Count probes to the target and return the
+// measurement, the From of which is left to the caller
+func (p Prober) Probe(ctx context.Context, t wireguard.ProbeTarget) wireguard.Probe {
+	pb := wireguard.Probe{To: t.Name, At: time.Now()}
+	port := p.Port
+	if port == 0 {
+		port = DefaultPort
+	}
+	proto := p.Proto
+	if proto == "" {
+		proto = "udp"
+	}
+	timeout := p.Timeout
+	if timeout == 0 {
+		timeout = time.Second
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, proto, net.JoinHostPort(t.Address, strconv.Itoa(port)))
+	if err != nil {
+		pb.Sent = p.Count
+		return pb
+	}
+	defer conn.Close()
+
+	nonce := rand.Uint64()
+	var rtts []time.Duration
+	for i := 0; i < p.Count && ctx.Err() == nil; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(p.Interval):
+			}
+		}
+		pb.Sent++
+		rtt, err := exchange(conn, uint64(i), nonce, timeout)
+		if err != nil {
+			// a stream is out of step once an answer is missed
+			if proto != "udp" {
+				pb.Sent = p.Count
+				break
+			}
+			continue
+		}
+		rtts = append(rtts, rtt)
+	}
+	pb.Received = len(rtts)
+	pb.RTT, pb.Jitter = summarize(rtts)
+	return pb
+}
+
+// exchange will send one probe and wait for its echo,
+// dropping late answers to earlier probes
+func exchange(conn net.Conn, seq, nonce uint64, timeout time.Duration) (time.Duration, error) {
+	var out, in [size]byte
+	binary.BigEndian.PutUint64(out[:8], seq)
+	binary.BigEndian.PutUint64(out[8:], nonce)
+	start := time.Now()
+	conn.SetDeadline(start.Add(timeout))
+	if _, err := conn.Write(out[:]); err != nil {
+		return 0, err
+	}
+	for {
+		if _, err := io.ReadFull(conn, in[:]); err != nil {
+			return 0, err
+		}
+		if in == out {
+			return time.Since(start), nil
+		}
+		if binary.BigEndian.Uint64(in[8:]) != nonce {
+			return 0, errors.New("unexpected answer")
+		}
+	}
+}
+
+// summarize will return the average of the round trips and
+// the mean difference between two consecutive ones
+func summarize(rtts []time.Duration) (time.Duration, time.Duration) {
+	if len(rtts) == 0 {
+		return 0, 0
+	}
+	var sum, diff time.Duration
+	for i, rtt := range rtts {
+		sum += rtt
+		if i > 0 {
+			d := rtt - rtts[i-1]
+			if d < 0 {
+				d = -d
+			}
+			diff += d
+		}
+	}
+	avg := sum / time.Duration(len(rtts))
+	if len(rtts) < 2 {
+		return avg, 0
+	}
+	return avg, diff / time.Duration(len(rtts)-1)
+}
+
+// Rotate will return the n targets to probe in the given round,
+// walking through all of them over consecutive rounds so that
+// large meshes are covered without probing everyone every time
+func Rotate(targets []wireguard.ProbeTarget, round, n int) []wireguard.ProbeTarget {
+	if n <= 0 || n >= len(targets) {
+		return targets
+	}
+	sorted := append([]wireguard.ProbeTarget{}, targets...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	start := (round * n) % len(sorted)
+	out := make([]wireguard.ProbeTarget, 0, n)
+	for i := 0; i < n; i++ {
+		out = append(out, sorted[(start+i)%len(sorted)])
+	}
+	return out
+}
@@ -0,0 +1,169 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/karasz/gomesh/wireguard"
+)
+
+// joinRequest is sent by a node redeeming an enrollment token,
+// it only carries the public key of the node
+type joinRequest struct {
+	Token      string
+	Name       string
+	PublicKey  string
+	Endpoint   string
+	ListenPort int
+	Hostname   string
+	// Type is server, client or roaming
+	Type string
+	// Tags are requested by the node, they are only
+	// given to it when an admin approves it
+	Tags []string
+}
+
+// joinResponse holds the registered node and its config,
+// without a private key
+type joinResponse struct {
+	Node   node
+	Config string
+}
+
+// join will register a node presenting a valid enrollment token,
+// giving it an address from the token's network. In networks that
+// require approval the node stays pending until approved
+func (s *Server) join(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	var req joinRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Name == "" {
+		writeError(w, http.StatusBadRequest, errors.New("Name is required"))
+		return
+	}
+	if _, err := wireguard.PublicKey(req.PublicKey); err != nil {
+		writeError(w, http.StatusBadRequest, errors.New("invalid PublicKey"))
+		return
+	}
+	switch req.Type {
+	case "", wireguard.TypeServer, wireguard.TypeClient:
+	case wireguard.TypeRoaming:
+		if req.Endpoint != "" || req.ListenPort != 0 {
+			writeError(w, http.StatusBadRequest, errors.New("roaming nodes have neither an Endpoint nor a ListenPort"))
+			return
+		}
+	default:
+		writeError(w, http.StatusBadRequest, errors.New("invalid Type"))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refresh()
+
+	// do not use up the token for a name that is taken
+	if _, err := s.peers.Get(req.Name); err == nil {
+		writeError(w, http.StatusConflict, errors.New(req.Name+": "+wireguard.ErrPeerExists.Error()))
+		return
+	}
+	store, err := wireguard.LoadTokens()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	t, err := store.Redeem(req.Token, time.Now())
+	if err != nil {
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+	networks, err := wireguard.LoadNetworks()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	nw, err := networks.Get(t.Network)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	addrs, err := s.peers.Allocate(nw)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	now := time.Now().UTC()
+	pr := wireguard.Peer{
+		Name:       req.Name,
+		PublicKey:  req.PublicKey,
+		Address:    addrs,
+		Endpoint:   req.Endpoint,
+		ListenPort: req.ListenPort,
+		Network:    nw.Name,
+		Type:       req.Type,
+		Tags:       t.Tags,
+		Pending:    nw.RequireApproval,
+		Join: &wireguard.JoinInfo{
+			Requested:     now,
+			TokenID:       t.ID,
+			RemoteAddr:    r.RemoteAddr,
+			Hostname:      req.Hostname,
+			UserAgent:     r.UserAgent(),
+			RequestedTags: req.Tags,
+		},
+	}
+	if !pr.Pending {
+		pr.Join.ApprovedBy = "token " + t.ID
+		pr.Join.ApprovedAt = &now
+	}
+	if err = s.peers.AddPeer(pr); err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	if err = store.DumpTokens(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.notify()
+
+	pr, _ = s.peers.Get(req.Name)
+	b, err := s.peers.Render(req.Name, "wg-quick")
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	status := http.StatusCreated
+	if pr.Pending {
+		status = http.StatusAccepted
+	}
+	writeJSON(w, status, joinResponse{Node: newNode(pr), Config: string(b)})
+}
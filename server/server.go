@@ -0,0 +1,533 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// Package server exposes the gomesh registry as a REST API
+package server
+
+import (
+	"bytes"
+	"crypto/subtle"
+	_ "embed" // for the OpenAPI document
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/karasz/gomesh/wireguard"
+)
+
+//go:embed openapi.json
+var openAPI []byte
+
+// MaxWait is the longest a config request may be held open
+const MaxWait = 5 * time.Minute
+
+// maxSignedBody is the largest body a signed request may have
+const maxSignedBody = 1 << 20
+
+// refreshInterval is how often waiting requests look
+// for changes made to the registry file by others
+const refreshInterval = 2 * time.Second
+
+// Server is an http.Handler serving the registry
+type Server struct {
+	mu     sync.Mutex
+	peers  wireguard.Peers
+	tokens []string
+	// nodeTokens are bootstrap tokens by the node they are bound to
+	nodeTokens map[string]string
+	key        string
+	// changed is closed and replaced whenever the registry changes
+	changed chan struct{}
+	// path and mtime of the registry file, it is
+	// reloaded when changed by the command line
+	path  string
+	mtime time.Time
+}
+
+// caller is who made a request, either an admin holding an
+// operator token or a node signing with its key or holding
+// its bootstrap token
+type caller struct {
+	admin bool
+	node  string
+}
+
+// node is how a Peer is shown by the API, without its private key
+type node struct {
+	wireguard.Peer
+	PrivateKey string `json:"PrivateKey,omitempty"`
+	PublicKey  string `json:"PublicKey"`
+}
+
+// New will return a Server for the given registry. Admin requests
+// must carry one of tokens as a bearer token, nodes sign theirs with
+// their WireGuard key or carry their token of nodeTokens, by node
+// name, until they know it. key is the private key of the server
+func New(peers wireguard.Peers, tokens []string, nodeTokens map[string]string, key string) *Server {
+	s := &Server{peers: peers, tokens: tokens, nodeTokens: nodeTokens, key: key, changed: make(chan struct{}), path: wireguard.DatabasePath()}
+	if fi, err := os.Stat(s.path); err == nil {
+		s.mtime = fi.ModTime()
+	}
+	return s
+}
+
+// refresh will reload the registry if its file was changed,
+// it must be called with s.mu held
+func (s *Server) refresh() {
+	fi, err := os.Stat(s.path)
+	if err != nil || fi.ModTime().Equal(s.mtime) {
+		return
+	}
+	peers, err := wireguard.LoadPeers(s.path)
+	if err != nil {
+		return
+	}
+	s.peers, s.mtime = peers, fi.ModTime()
+	s.notify()
+}
+
+// Peers will return the current registry
+func (s *Server) Peers() wireguard.Peers {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refresh()
+	return append(wireguard.Peers{}, s.peers...)
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/openapi.json":
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(openAPI)
+		return
+	case "/v1/server":
+		pub, _ := wireguard.PublicKey(s.key)
+		writeJSON(w, http.StatusOK, map[string]string{"PublicKey": pub})
+		return
+	case "/v1/join":
+		// authenticated by the enrollment token it carries
+		s.join(w, r)
+		return
+	}
+	c, err := s.authenticate(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="gomesh"`)
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 2 || parts[0] != "v1" || parts[1] != "nodes" {
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	// nodes may only fetch their own config, report
+	// themselves and their probes
+	if !c.admin && !nodeAllowed(parts, r.Method, c.node) {
+		writeError(w, http.StatusForbidden, errors.New("forbidden"))
+		return
+	}
+
+	// config requests may wait for changes so they lock on their own
+	if len(parts) == 4 && parts[3] == "config" && r.Method == http.MethodGet {
+		s.getConfig(w, r, parts[2])
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refresh()
+
+	switch {
+	case len(parts) == 2 && r.Method == http.MethodGet:
+		s.listNodes(w, r)
+	case len(parts) == 2 && r.Method == http.MethodPost:
+		s.createNode(w, r)
+	case len(parts) == 3 && r.Method == http.MethodGet:
+		s.getNode(w, r, parts[2])
+	case len(parts) == 3 && r.Method == http.MethodPut:
+		s.updateNode(w, r, parts[2])
+	case len(parts) == 3 && r.Method == http.MethodDelete:
+		s.deleteNode(w, r, parts[2])
+	case len(parts) == 4 && parts[3] == "rotate" && r.Method == http.MethodPost:
+		s.rotateKey(w, r, parts[2])
+	case len(parts) == 4 && parts[3] == "report" && r.Method == http.MethodPost:
+		s.report(w, r, parts[2])
+	case len(parts) == 4 && parts[3] == "probes" && r.Method == http.MethodGet:
+		s.probeTargets(w, r, parts[2])
+	case len(parts) == 4 && parts[3] == "probes" && r.Method == http.MethodPost:
+		s.recordProbes(w, r, parts[2])
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// notify will wake up the requests waiting for changes,
+// it must be called with s.mu held
+func (s *Server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *Server) authenticate(r *http.Request) (caller, error) {
+	h := r.Header.Get("Authorization")
+	if strings.HasPrefix(h, wireguard.SignatureScheme+" ") {
+		if s.key == "" {
+			return caller{}, errors.New("signed requests are not enabled")
+		}
+		lookup := func(name string) (string, error) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.refresh()
+			pr, err := s.peers.Get(name)
+			if err != nil {
+				return "", err
+			}
+			return pr.Public()
+		}
+		// the body is signed too, it is read here and put back
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxSignedBody))
+		if err != nil {
+			return caller{}, err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		name, err := wireguard.VerifyRequest(h, s.key, lookup, r.Method, r.URL.RequestURI(), body, time.Now())
+		return caller{node: name}, err
+	}
+
+	if !strings.HasPrefix(h, "Bearer ") {
+		return caller{}, errors.New("missing bearer token or signature")
+	}
+	given := []byte(strings.TrimPrefix(h, "Bearer "))
+	c, ok := caller{}, false
+	for _, t := range s.tokens {
+		if subtle.ConstantTimeCompare(given, []byte(t)) == 1 {
+			c, ok = caller{admin: true}, true
+		}
+	}
+	for name, t := range s.nodeTokens {
+		if subtle.ConstantTimeCompare(given, []byte(t)) == 1 && !ok {
+			c, ok = caller{node: name}, true
+		}
+	}
+	if !ok {
+		return caller{}, errors.New("invalid bearer token")
+	}
+	return c, nil
+}
+
+func (s *Server) listNodes(w http.ResponseWriter, r *http.Request) {
+	nodes := []node{}
+	for _, pr := range s.peers {
+		nodes = append(nodes, newNode(pr))
+	}
+	writeJSON(w, http.StatusOK, nodes)
+}
+
+func (s *Server) createNode(w http.ResponseWriter, r *http.Request) {
+	var pr wireguard.Peer
+	if err := json.NewDecoder(r.Body).Decode(&pr); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if pr.Name == "" {
+		writeError(w, http.StatusBadRequest, errors.New("Name is required"))
+		return
+	}
+	if err := s.peers.AddPeer(pr); err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	s.notify()
+	pr, _ = s.peers.Get(pr.Name)
+	writeJSON(w, http.StatusCreated, newNode(pr))
+}
+
+func (s *Server) getNode(w http.ResponseWriter, r *http.Request, name string) {
+	pr, err := s.peers.Get(name)
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newNode(pr))
+}
+
+func (s *Server) updateNode(w http.ResponseWriter, r *http.Request, name string) {
+	var pr wireguard.Peer
+	if err := json.NewDecoder(r.Body).Decode(&pr); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if pr.Name == "" {
+		pr.Name = name
+	}
+	if !strings.EqualFold(pr.Name, name) {
+		writeError(w, http.StatusBadRequest, errors.New("Name does not match the path"))
+		return
+	}
+	if err := s.peers.UpdatePeer(pr); err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	s.notify()
+	pr, _ = s.peers.Get(name)
+	writeJSON(w, http.StatusOK, newNode(pr))
+}
+
+func (s *Server) deleteNode(w http.ResponseWriter, r *http.Request, name string) {
+	if err := s.peers.DeletePeer(name); err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	s.notify()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getConfig will return the rendered config of a node, if the
+// If-None-Match header holds its current ETag and a wait is given
+// the request is held until the config changes or the wait is over
+func (s *Server) getConfig(w http.ResponseWriter, r *http.Request, name string) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "wg-quick"
+	}
+	if !knownFormat(format) {
+		writeError(w, http.StatusBadRequest, errors.New("unknown format "+format))
+		return
+	}
+	var wait time.Duration
+	if v := r.URL.Query().Get("wait"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if wait = d; wait > MaxWait {
+			wait = MaxWait
+		}
+	}
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+
+	for {
+		s.mu.Lock()
+		s.refresh()
+		b, err := s.peers.Render(name, format)
+		changed := s.changed
+		s.mu.Unlock()
+		if err != nil {
+			writeError(w, statusOf(err), err)
+			return
+		}
+
+		etag := wireguard.ConfigETag(b)
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			select {
+			case <-changed:
+				continue
+			case <-time.After(refreshInterval):
+				continue
+			case <-timeout.C:
+			case <-r.Context().Done():
+			}
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		if format == "k8s" {
+			w.Header().Set("Content-Type", "application/yaml")
+		} else {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		}
+		w.Write(b)
+		return
+	}
+}
+
+func (s *Server) rotateKey(w http.ResponseWriter, r *http.Request, name string) {
+	pr, err := s.peers.RotateKey(name)
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	s.notify()
+	writeJSON(w, http.StatusOK, newNode(pr))
+}
+
+// reportRequest is what a node reports about itself, the
+// endpoint is taken from the request when none is given
+type reportRequest struct {
+	wireguard.Report
+	// Port is the public UDP port, the node's ListenPort if zero
+	Port int
+}
+
+// report will record the addresses a node can be reached on
+func (s *Server) report(w http.ResponseWriter, r *http.Request, name string) {
+	var req reportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	pr, err := s.peers.Get(name)
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	if req.Endpoint == "" {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if req.Port == 0 {
+			req.Port = pr.ListenPort
+		}
+		req.Endpoint = net.JoinHostPort(host, strconv.Itoa(req.Port))
+	}
+	changed, err := s.peers.Report(name, req.Report)
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	if changed {
+		s.notify()
+	}
+	pr, _ = s.peers.Get(name)
+	writeJSON(w, http.StatusOK, newNode(pr))
+}
+
+// probeTargets will return the nodes a node should probe
+func (s *Server) probeTargets(w http.ResponseWriter, r *http.Request, name string) {
+	pr, err := s.peers.Get(name)
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	links, err := wireguard.LoadLinks()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	targets := s.peers.ProbeTargets(pr, links)
+	if targets == nil {
+		targets = []wireguard.ProbeTarget{}
+	}
+	writeJSON(w, http.StatusOK, targets)
+}
+
+// recordProbes will keep what a node measured towards the others
+func (s *Server) recordProbes(w http.ResponseWriter, r *http.Request, name string) {
+	var probes []wireguard.Probe
+	if err := json.NewDecoder(r.Body).Decode(&probes); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	pr, err := s.peers.Get(name)
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	now := time.Now()
+	for i := range probes {
+		to, err := s.peers.Get(probes[i].To)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		probes[i].From, probes[i].To, probes[i].At = pr.Name, to.Name, now
+	}
+	links, err := wireguard.LoadLinks()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err = links.RecordProbes(probes); err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// nodeAllowed will tell whether a node may make the request
+func nodeAllowed(parts []string, method string, name string) bool {
+	if len(parts) != 4 || !strings.EqualFold(parts[2], name) {
+		return false
+	}
+	switch parts[3] {
+	case "config":
+		return method == http.MethodGet
+	case "report":
+		return method == http.MethodPost
+	case "probes":
+		return method == http.MethodGet || method == http.MethodPost
+	}
+	return false
+}
+
+func newNode(pr wireguard.Peer) node {
+	pub, _ := pr.Public()
+	return node{Peer: pr, PublicKey: pub}
+}
+
+func knownFormat(format string) bool {
+	for _, f := range wireguard.Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+func statusOf(err error) int {
+	switch {
+	case errors.Is(err, wireguard.ErrPeerNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, wireguard.ErrPeerExists), errors.Is(err, wireguard.ErrDNSCollision):
+		return http.StatusConflict
+	case errors.Is(err, wireguard.ErrInvalidReport):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "    ")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,295 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/karasz/gomesh/wireguard"
+)
+
+const (
+	adminToken = "admin-token"
+	nodeToken  = "node-a-token"
+)
+
+// newTestServer will serve a registry of the nodes a and b
+func newTestServer(t *testing.T) (*httptest.Server, wireguard.Peers) {
+	t.Helper()
+	peers, err := wireguard.LoadPeers(filepath.Join(t.TempDir(), "database.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pr := range []wireguard.Peer{
+		{Name: "a", Address: []string{"10.0.0.1/32"}, Endpoint: "192.0.2.1"},
+		{Name: "b", Address: []string{"10.0.0.2/32"}, Endpoint: "192.0.2.2"},
+	} {
+		if err = peers.AddPeer(pr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	key, err := wireguard.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(New(peers, []string{adminToken}, map[string]string{"a": nodeToken}, key))
+	t.Cleanup(ts.Close)
+	return ts, peers
+}
+
+// request will make a request with the given Authorization header
+func request(t *testing.T, ts *httptest.Server, method, path, auth, body string, header ...string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// signed will return the Authorization header of a request
+// signed by name with key
+func signed(t *testing.T, ts *httptest.Server, name, key, method, uri, body string) string {
+	t.Helper()
+	resp := request(t, ts, http.MethodGet, "/v1/server", "", "")
+	var v struct{ PublicKey string }
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	h, err := wireguard.SignRequest(name, key, v.PublicKey, method, uri, []byte(body), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestAuth(t *testing.T) {
+	ts, peers := newTestServer(t)
+	a, _ := peers.Get("a")
+	b, _ := peers.Get("b")
+	report := `{"Endpoint":"192.0.2.10:51820"}`
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		auth   string
+		body   string
+		status int
+	}{
+		{"no credentials", "GET", "/v1/nodes", "", "", http.StatusUnauthorized},
+		{"bad token", "GET", "/v1/nodes", "Bearer nope", "", http.StatusUnauthorized},
+		{"admin", "GET", "/v1/nodes", "Bearer " + adminToken, "", http.StatusOK},
+		{"own config", "GET", "/v1/nodes/a/config", signed(t, ts, "a", a.PrivateKey, "GET", "/v1/nodes/a/config", ""), "", http.StatusOK},
+		{"own report", "POST", "/v1/nodes/a/report", signed(t, ts, "a", a.PrivateKey, "POST", "/v1/nodes/a/report", report), report, http.StatusOK},
+		{"other body", "POST", "/v1/nodes/a/report", signed(t, ts, "a", a.PrivateKey, "POST", "/v1/nodes/a/report", report), `{"Endpoint":"198.51.100.1:51820"}`, http.StatusUnauthorized},
+		{"other config", "GET", "/v1/nodes/b/config", signed(t, ts, "a", a.PrivateKey, "GET", "/v1/nodes/b/config", ""), "", http.StatusForbidden},
+		{"node list", "GET", "/v1/nodes", signed(t, ts, "a", a.PrivateKey, "GET", "/v1/nodes", ""), "", http.StatusForbidden},
+		{"own rotate", "POST", "/v1/nodes/a/rotate", signed(t, ts, "a", a.PrivateKey, "POST", "/v1/nodes/a/rotate", ""), "", http.StatusForbidden},
+		{"wrong key", "GET", "/v1/nodes/a/config", signed(t, ts, "a", b.PrivateKey, "GET", "/v1/nodes/a/config", ""), "", http.StatusUnauthorized},
+		{"unknown node", "GET", "/v1/nodes/c/config", signed(t, ts, "c", a.PrivateKey, "GET", "/v1/nodes/c/config", ""), "", http.StatusUnauthorized},
+		{"server key", "GET", "/v1/server", "", "", http.StatusOK},
+		{"node token own config", "GET", "/v1/nodes/a/config", "Bearer " + nodeToken, "", http.StatusOK},
+		{"node token own report", "POST", "/v1/nodes/a/report", "Bearer " + nodeToken, report, http.StatusOK},
+		{"node token other config", "GET", "/v1/nodes/b/config", "Bearer " + nodeToken, "", http.StatusForbidden},
+		{"node token node list", "GET", "/v1/nodes", "Bearer " + nodeToken, "", http.StatusForbidden},
+		{"node token create", "POST", "/v1/nodes", "Bearer " + nodeToken, `{"Name":"c","Address":["10.0.0.3/24"]}`, http.StatusForbidden},
+		{"node token update", "PUT", "/v1/nodes/a", "Bearer " + nodeToken, `{"Name":"a","Address":["10.0.0.1/24"]}`, http.StatusForbidden},
+		{"node token delete", "DELETE", "/v1/nodes/b", "Bearer " + nodeToken, "", http.StatusForbidden},
+		{"node token rotate", "POST", "/v1/nodes/b/rotate", "Bearer " + nodeToken, "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := request(t, ts, tt.method, tt.path, tt.auth, tt.body)
+			if resp.StatusCode != tt.status {
+				b, _ := io.ReadAll(resp.Body)
+				t.Errorf("got %s %s, expected %d", resp.Status, strings.TrimSpace(string(b)), tt.status)
+			}
+		})
+	}
+}
+
+func TestCRUD(t *testing.T) {
+	ts, _ := newTestServer(t)
+	admin := "Bearer " + adminToken
+	c := `{"Name":"c","Address":["10.0.0.3/32"],"Endpoint":"192.0.2.3"}`
+
+	steps := []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"POST", "/v1/nodes", c, http.StatusCreated},
+		{"POST", "/v1/nodes", c, http.StatusConflict},
+		{"POST", "/v1/nodes", `{"Address":["10.0.0.4/32"]}`, http.StatusBadRequest},
+		{"GET", "/v1/nodes/c", "", http.StatusOK},
+		{"PUT", "/v1/nodes/c", `{"Address":["10.0.0.3/32"],"Endpoint":"192.0.2.33"}`, http.StatusOK},
+		{"PUT", "/v1/nodes/c", `{"Name":"d","Address":["10.0.0.3/32"]}`, http.StatusBadRequest},
+		{"PUT", "/v1/nodes/d", `{"Address":["10.0.0.4/32"],"Endpoint":"192.0.2.4"}`, http.StatusNotFound},
+		{"DELETE", "/v1/nodes/c", "", http.StatusNoContent},
+		{"GET", "/v1/nodes/c", "", http.StatusNotFound},
+		{"DELETE", "/v1/nodes/c", "", http.StatusNotFound},
+		{"PATCH", "/v1/nodes/a", "", http.StatusMethodNotAllowed},
+	}
+	for _, s := range steps {
+		resp := request(t, ts, s.method, s.path, admin, s.body)
+		if resp.StatusCode != s.status {
+			b, _ := io.ReadAll(resp.Body)
+			t.Fatalf("%s %s: got %s %s, expected %d", s.method, s.path, resp.Status, strings.TrimSpace(string(b)), s.status)
+		}
+	}
+
+	resp := request(t, ts, "GET", "/v1/nodes", admin, "")
+	var nodes []map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&nodes); err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 2 {
+		t.Errorf("got %d nodes, expected a and b", len(nodes))
+	}
+	for _, n := range nodes {
+		if _, ok := n["PrivateKey"]; ok {
+			t.Errorf("%v: private key served", n["Name"])
+		}
+		if n["PublicKey"] == "" {
+			t.Errorf("%v: no public key", n["Name"])
+		}
+	}
+}
+
+func TestConfigETag(t *testing.T) {
+	ts, _ := newTestServer(t)
+	admin := "Bearer " + adminToken
+
+	resp := request(t, ts, "GET", "/v1/nodes/a/config", admin, "")
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || etag == "" {
+		t.Fatalf("got %s with ETag %q", resp.Status, etag)
+	}
+	resp = request(t, ts, "GET", "/v1/nodes/a/config", admin, "", "If-None-Match", etag)
+	if resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("unchanged config: got %s", resp.Status)
+	}
+	resp = request(t, ts, "GET", "/v1/nodes/a/config?format=nope", admin, "")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown format: got %s", resp.Status)
+	}
+
+	// a wait without changes ends with 304
+	start := time.Now()
+	resp = request(t, ts, "GET", "/v1/nodes/a/config?wait=200ms", admin, "", "If-None-Match", etag)
+	if resp.StatusCode != http.StatusNotModified || time.Since(start) < 200*time.Millisecond {
+		t.Fatalf("got %s after %s", resp.Status, time.Since(start))
+	}
+
+	// a change ends the wait with the new config
+	done := make(chan *http.Response)
+	go func() {
+		req, _ := http.NewRequest("GET", ts.URL+"/v1/nodes/a/config?wait=1m", nil)
+		req.Header.Set("Authorization", admin)
+		req.Header.Set("If-None-Match", etag)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- resp
+	}()
+	time.Sleep(100 * time.Millisecond)
+	request(t, ts, "POST", "/v1/nodes", admin, `{"Name":"c","Address":["10.0.0.3/32"],"Endpoint":"192.0.2.3"}`)
+	select {
+	case resp := <-done:
+		if resp == nil {
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") == etag || !strings.Contains(string(b), "# Name: c") {
+			t.Errorf("got %s with ETag %s:\n%s", resp.Status, resp.Header.Get("ETag"), b)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the change did not end the wait")
+	}
+}
+
+func TestRotate(t *testing.T) {
+	ts, peers := newTestServer(t)
+	old, _ := peers.Get("a")
+	oldPub, _ := old.Public()
+
+	resp := request(t, ts, "POST", "/v1/nodes/a/rotate", "Bearer "+adminToken, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %s", resp.Status)
+	}
+	var n struct{ PublicKey string }
+	if err := json.NewDecoder(resp.Body).Decode(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n.PublicKey == "" || n.PublicKey == oldPub {
+		t.Fatalf("public key %q did not change", n.PublicKey)
+	}
+
+	resp = request(t, ts, "GET", "/v1/nodes/a/config", signed(t, ts, "a", old.PrivateKey, "GET", "/v1/nodes/a/config", ""), "")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("old key: got %s", resp.Status)
+	}
+	resp = request(t, ts, "GET", "/v1/nodes/a/config", "Bearer "+adminToken, "")
+	c, err := wireguard.ParseConfig(mustRead(t, resp.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = request(t, ts, "GET", "/v1/nodes/a/config", signed(t, ts, "a", c.Interface.PrivateKey, "GET", "/v1/nodes/a/config", ""), "")
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("new key: got %s", resp.Status)
+	}
+	resp = request(t, ts, "POST", "/v1/nodes/c/rotate", "Bearer "+adminToken, "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown node: got %s", resp.Status)
+	}
+}
+
+func mustRead(t *testing.T, r io.Reader) []byte {
+	t.Helper()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
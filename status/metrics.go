@@ -0,0 +1,164 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package status
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/karasz/gomesh/wireguard"
+)
+
+type metric struct {
+	name string
+	help string
+	kind string
+}
+
+var (
+	deviceUp         = metric{"gomesh_device_up", "Whether the WireGuard device could be read.", "gauge"}
+	expectedPeers    = metric{"gomesh_device_expected_peers", "Peers the registry expects on the device.", "gauge"}
+	configuredPeers  = metric{"gomesh_device_configured_peers", "Peers configured on the device.", "gauge"}
+	unknownPeers     = metric{"gomesh_device_unknown_peers", "Peers configured on the device but not in the registry.", "gauge"}
+	peerHealth       = metric{"gomesh_peer_health", "Health of the peer, 1 for its current verdict.", "gauge"}
+	peerHandshake    = metric{"gomesh_peer_last_handshake_timestamp_seconds", "Time of the last handshake with the peer.", "gauge"}
+	peerHandshakeAge = metric{"gomesh_peer_handshake_age_seconds", "Seconds since the last handshake with the peer.", "gauge"}
+	peerRx           = metric{"gomesh_peer_receive_bytes_total", "Bytes received from the peer.", "counter"}
+	peerTx           = metric{"gomesh_peer_transmit_bytes_total", "Bytes sent to the peer.", "counter"}
+	nodeInfo         = metric{"gomesh_node_info", "Nodes of the registry.", "gauge"}
+	nodeKeyAge       = metric{"gomesh_node_key_age_seconds", "Seconds since the node got its current key.", "gauge"}
+)
+
+var healths = []string{Up, Stale, Never, Missing, Unknown}
+
+// WriteMetrics will read the device and write the mesh health in the
+// Prometheus text format, peers are labelled with their registry name,
+// network and tags. If the device cannot be read only gomesh_device_up
+// and the registry metrics are written
+func WriteMetrics(w io.Writer, c Client, device string, peers wireguard.Peers, now time.Time) error {
+	mw := &metricWriter{w: w}
+	st, err := Collect(c, device, peers, now)
+	up := 1
+	if err != nil {
+		up = 0
+	}
+	dev := []string{"device", device}
+	mw.write(deviceUp, dev, float64(up))
+	if err == nil {
+		dev = append(dev, "node", st.Node)
+		mw.write(expectedPeers, dev, float64(st.Expected))
+		mw.write(configuredPeers, dev, float64(st.Configured))
+		unknown := 0
+		for _, p := range st.Peers {
+			if p.Health == Unknown {
+				unknown++
+			}
+		}
+		mw.write(unknownPeers, dev, float64(unknown))
+
+		for _, p := range st.Peers {
+			labels := peerLabels(device, p)
+			for _, h := range healths {
+				v := 0.0
+				if p.Health == h {
+					v = 1
+				}
+				mw.write(peerHealth, append(labels, "health", h), v)
+			}
+			if p.Health == Missing {
+				continue
+			}
+			if p.LastHandshake != nil {
+				mw.write(peerHandshake, labels, float64(p.LastHandshake.Unix()))
+				mw.write(peerHandshakeAge, labels, p.HandshakeAge)
+			}
+			mw.write(peerRx, labels, float64(p.RxBytes))
+			mw.write(peerTx, labels, float64(p.TxBytes))
+		}
+	}
+
+	for _, pr := range peers {
+		labels := []string{"node", pr.Name, "network", pr.Network, "role", pr.Role, "tags", strings.Join(pr.Tags, ",")}
+		mw.write(nodeInfo, append(labels, "pending", fmt.Sprint(pr.Pending)), 1)
+		if pr.KeyCreated != nil {
+			mw.write(nodeKeyAge, labels, now.Sub(*pr.KeyCreated).Seconds())
+		}
+	}
+	return mw.flush()
+}
+
+// peerLabels will name the peer by its registry name, peers
+// the registry does not know by a short form of their key
+func peerLabels(device string, p PeerStatus) []string {
+	name := p.Name
+	if name == "" {
+		name = "unknown:" + p.PublicKey[:8]
+	}
+	return []string{"device", device, "peer", name, "network", p.Network, "tags", strings.Join(p.Tags, ",")}
+}
+
+// metricWriter groups the samples by metric, as the text
+// format wants, and writes them out on flush
+type metricWriter struct {
+	w       io.Writer
+	order   []metric
+	samples map[string][]string
+}
+
+func (mw *metricWriter) write(m metric, labels []string, v float64) {
+	if mw.samples == nil {
+		mw.samples = map[string][]string{}
+	}
+	if _, ok := mw.samples[m.name]; !ok {
+		mw.order = append(mw.order, m)
+	}
+	var b strings.Builder
+	b.WriteString(m.name)
+	if len(labels) > 0 {
+		b.WriteString("{")
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			fmt.Fprintf(&b, "%s=\"%s\"", labels[i], escapeLabel(labels[i+1]))
+		}
+		b.WriteString("}")
+	}
+	b.WriteString(" " + strconv.FormatFloat(v, 'f', -1, 64) + "\n")
+	mw.samples[m.name] = append(mw.samples[m.name], b.String())
+}
+
+func (mw *metricWriter) flush() error {
+	for _, m := range mw.order {
+		if _, err := fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n%s", m.name, m.help, m.name, m.kind, strings.Join(mw.samples[m.name], "")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
@@ -0,0 +1,163 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package status
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/karasz/gomesh/wireguard"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// fakeClient serves the devices it holds
+type fakeClient map[string]*wgtypes.Device
+
+// Device implements Client
+func (c fakeClient) Device(name string) (*wgtypes.Device, error) {
+	if d, ok := c[name]; ok {
+		return d, nil
+	}
+	return nil, errors.New("no such device")
+}
+
+// key will return a private key made of b, and its public key
+func key(t *testing.T, b byte) (string, wgtypes.Key) {
+	t.Helper()
+	var k wgtypes.Key
+	for i := range k {
+		k[i] = b
+	}
+	priv, err := wgtypes.NewKey(k[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv.String(), priv.PublicKey()
+}
+
+func TestWriteMetrics(t *testing.T) {
+	if _, err := wireguard.LoadPeers(filepath.Join(t.TempDir(), "database.json")); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	created := now.Add(-48 * time.Hour)
+
+	webKey, webPub := key(t, 1)
+	dbKey, dbPub := key(t, 2)
+	cacheKey, cachePub := key(t, 3)
+	appKey, _ := key(t, 4)
+	labKey, _ := key(t, 5)
+	_, strayPub := key(t, 6)
+	peers := wireguard.Peers{
+		{Name: "web1", Network: "prod", Address: []string{"10.0.0.1/24"}, Endpoint: "web1.example.com", ListenPort: 51820, PrivateKey: webKey, Role: "web"},
+		{Name: "db1", Network: "prod", Address: []string{"10.0.0.2/24"}, Endpoint: "db1.example.com", ListenPort: 51820, PrivateKey: dbKey, Tags: []string{"db", "eu"}, KeyCreated: &created},
+		{Name: "cache1", Network: "prod", Address: []string{"10.0.0.3/24"}, Endpoint: "cache1.example.com", ListenPort: 51820, PrivateKey: cacheKey},
+		{Name: "app1", Network: "prod", Address: []string{"10.0.0.4/24"}, Endpoint: "app1.example.com", ListenPort: 51820, PrivateKey: appKey},
+		{Name: "lab1", Network: "prod", Address: []string{"10.0.0.5/24"}, PrivateKey: labKey, Pending: true},
+	}
+	c := fakeClient{"wg0": {
+		Name:      "wg0",
+		PublicKey: webPub,
+		Peers: []wgtypes.Peer{
+			{PublicKey: dbPub, Endpoint: &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 51820}, LastHandshakeTime: now.Add(-30 * time.Second), ReceiveBytes: 1000, TransmitBytes: 2000},
+			{PublicKey: cachePub, LastHandshakeTime: now.Add(-10 * time.Minute), ReceiveBytes: 5},
+			{PublicKey: strayPub},
+		},
+	}}
+
+	var b strings.Builder
+	if err := WriteMetrics(&b, c, "wg0", peers, now); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	stray := strayPub.String()[:8]
+	for _, want := range []string{
+		"# HELP gomesh_device_up Whether the WireGuard device could be read.\n# TYPE gomesh_device_up gauge\ngomesh_device_up{device=\"wg0\"} 1\n",
+		`gomesh_device_expected_peers{device="wg0",node="web1"} 3`,
+		`gomesh_device_configured_peers{device="wg0",node="web1"} 3`,
+		`gomesh_device_unknown_peers{device="wg0",node="web1"} 1`,
+		`gomesh_peer_health{device="wg0",peer="db1",network="prod",tags="db,eu",health="up"} 1`,
+		`gomesh_peer_health{device="wg0",peer="db1",network="prod",tags="db,eu",health="stale"} 0`,
+		`gomesh_peer_health{device="wg0",peer="cache1",network="prod",tags="",health="stale"} 1`,
+		`gomesh_peer_health{device="wg0",peer="app1",network="prod",tags="",health="missing"} 1`,
+		fmt.Sprintf(`gomesh_peer_health{device="wg0",peer="unknown:%s",network="",tags="",health="unknown"} 1`, stray),
+		fmt.Sprintf(`gomesh_peer_last_handshake_timestamp_seconds{device="wg0",peer="db1",network="prod",tags="db,eu"} %d`, now.Add(-30*time.Second).Unix()),
+		`gomesh_peer_handshake_age_seconds{device="wg0",peer="db1",network="prod",tags="db,eu"} 30`,
+		`gomesh_peer_handshake_age_seconds{device="wg0",peer="cache1",network="prod",tags=""} 600`,
+		"# TYPE gomesh_peer_receive_bytes_total counter\n",
+		`gomesh_peer_receive_bytes_total{device="wg0",peer="db1",network="prod",tags="db,eu"} 1000`,
+		`gomesh_peer_transmit_bytes_total{device="wg0",peer="db1",network="prod",tags="db,eu"} 2000`,
+		`gomesh_node_info{node="web1",network="prod",role="web",tags="",pending="false"} 1`,
+		`gomesh_node_info{node="lab1",network="prod",role="",tags="",pending="true"} 1`,
+		`gomesh_node_key_age_seconds{node="db1",network="prod",role="",tags="db,eu"} 172800`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("no %q in\n%s", want, out)
+		}
+	}
+	for _, unwanted := range []string{
+		// missing peers have no traffic and pending nodes are not expected
+		`gomesh_peer_receive_bytes_total{device="wg0",peer="app1"`,
+		`peer="lab1"`,
+		`gomesh_peer_handshake_age_seconds{device="wg0",peer="unknown:`,
+	} {
+		if strings.Contains(out, unwanted) {
+			t.Errorf("%q in\n%s", unwanted, out)
+		}
+	}
+	// the samples of a metric follow its one HELP and TYPE
+	for _, m := range []metric{deviceUp, peerHealth, peerRx, nodeInfo} {
+		if n := strings.Count(out, "# TYPE "+m.name+" "); n != 1 {
+			t.Errorf("%s: %d TYPE lines", m.name, n)
+		}
+		i := strings.Index(out, "# TYPE "+m.name+" ")
+		if j := strings.Index(out, "\n"+m.name+"{"); j < i {
+			t.Errorf("%s: samples before TYPE", m.name)
+		}
+	}
+}
+
+func TestWriteMetricsDeviceDown(t *testing.T) {
+	if _, err := wireguard.LoadPeers(filepath.Join(t.TempDir(), "database.json")); err != nil {
+		t.Fatal(err)
+	}
+	peers := wireguard.Peers{{Name: "web1", Network: "prod", Tags: []string{`a"b`}}}
+	var b strings.Builder
+	if err := WriteMetrics(&b, fakeClient{}, "wg0", peers, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP gomesh_device_up Whether the WireGuard device could be read.
+# TYPE gomesh_device_up gauge
+gomesh_device_up{device="wg0"} 0
+# HELP gomesh_node_info Nodes of the registry.
+# TYPE gomesh_node_info gauge
+gomesh_node_info{node="web1",network="prod",role="",tags="a\"b",pending="false"} 1
+`
+	if got := b.String(); got != want {
+		t.Errorf("got\n%s\nexpected\n%s", got, want)
+	}
+}
@@ -0,0 +1,171 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// Package status joins what a WireGuard device is doing
+// with what the registry expects of it
+package status
+
+import (
+	"sort"
+	"time"
+
+	"github.com/karasz/gomesh/wireguard"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Health verdicts of a peer
+const (
+	// Up peers had a handshake within StaleAfter
+	Up = "up"
+	// Stale peers had their last handshake before StaleAfter
+	Stale = "stale"
+	// Never peers are configured but never had a handshake
+	Never = "never"
+	// Missing peers are expected but not configured on the device
+	Missing = "missing"
+	// Unknown peers are configured but not in the registry
+	Unknown = "unknown"
+)
+
+// StaleAfter is how old a handshake may be for the peer to be up,
+// WireGuard renews sessions every two minutes while there is traffic
+const StaleAfter = 3 * time.Minute
+
+// Client reads WireGuard devices, *wgctrl.Client is one
+type Client interface {
+	Device(name string) (*wgtypes.Device, error)
+}
+
+// PeerStatus is the state of one peer of the device
+type PeerStatus struct {
+	Name      string   `json:",omitempty"`
+	Network   string   `json:",omitempty"`
+	Tags      []string `json:",omitempty"`
+	PublicKey string
+	Endpoint  string `json:",omitempty"`
+	// LastHandshake is nil if there was none
+	LastHandshake *time.Time `json:",omitempty"`
+	// HandshakeAge is in seconds
+	HandshakeAge float64 `json:",omitempty"`
+	RxBytes      int64
+	TxBytes      int64
+	Health       string
+}
+
+// Status is the state of a device
+type Status struct {
+	Device    string
+	PublicKey string
+	// Node is the registry node the device belongs to,
+	// empty if its key is not in the registry
+	Node       string `json:",omitempty"`
+	Expected   int
+	Configured int
+	Peers      []PeerStatus
+}
+
+// Collect will read the device and join its peers with the registry by
+// public key. The peers expected are those of the node's rendered config,
+// or all the registered ones if the device key is not in the registry
+func Collect(c Client, device string, peers wireguard.Peers, now time.Time) (Status, error) {
+	dev, err := c.Device(device)
+	if err != nil {
+		return Status{}, err
+	}
+	st := Status{Device: dev.Name, PublicKey: dev.PublicKey.String(), Configured: len(dev.Peers)}
+
+	byKey := map[string]wireguard.Peer{}
+	for _, pr := range peers {
+		if pub, err := pr.Public(); err == nil {
+			byKey[pub] = pr
+		}
+	}
+
+	expected := map[string]bool{}
+	if self, ok := byKey[st.PublicKey]; ok {
+		st.Node = self.Name
+		cfg, err := peers.Config(self)
+		if err != nil {
+			return st, err
+		}
+		for _, pc := range cfg.Peers {
+			expected[pc.PublicKey] = true
+		}
+	} else {
+		for pub, pr := range byKey {
+			if !pr.Pending {
+				expected[pub] = true
+			}
+		}
+	}
+	st.Expected = len(expected)
+
+	seen := map[string]bool{}
+	for _, dp := range dev.Peers {
+		pub := dp.PublicKey.String()
+		seen[pub] = true
+		ps := PeerStatus{
+			PublicKey: pub,
+			RxBytes:   dp.ReceiveBytes,
+			TxBytes:   dp.TransmitBytes,
+			Health:    health(dp.LastHandshakeTime, now),
+		}
+		if dp.Endpoint != nil {
+			ps.Endpoint = dp.Endpoint.String()
+		}
+		if last := dp.LastHandshakeTime; !last.IsZero() {
+			ps.LastHandshake = &last
+			ps.HandshakeAge = now.Sub(last).Seconds()
+		}
+		if pr, ok := byKey[pub]; ok {
+			ps.Name, ps.Network, ps.Tags = pr.Name, pr.Network, pr.Tags
+		} else {
+			ps.Health = Unknown
+		}
+		st.Peers = append(st.Peers, ps)
+	}
+	for pub := range expected {
+		if !seen[pub] {
+			pr := byKey[pub]
+			st.Peers = append(st.Peers, PeerStatus{Name: pr.Name, Network: pr.Network, Tags: pr.Tags, PublicKey: pub, Health: Missing})
+		}
+	}
+
+	sort.Slice(st.Peers, func(i, j int) bool {
+		if st.Peers[i].Name != st.Peers[j].Name {
+			return st.Peers[i].Name < st.Peers[j].Name
+		}
+		return st.Peers[i].PublicKey < st.Peers[j].PublicKey
+	})
+	return st, nil
+}
+
+func health(last time.Time, now time.Time) string {
+	switch {
+	case last.IsZero():
+		return Never
+	case now.Sub(last) <= StaleAfter:
+		return Up
+	default:
+		return Stale
+	}
+}
@@ -0,0 +1,123 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package wireguard
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// ParseAddress will parse an address with or without a prefix
+// length, a bare address is a single host
+func ParseAddress(a string) (netip.Prefix, error) {
+	a = strings.TrimSpace(a)
+	if strings.Contains(a, "/") {
+		return netip.ParsePrefix(a)
+	}
+	ip, err := netip.ParseAddr(a)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(ip, ip.BitLen()), nil
+}
+
+// Addrs will return the mesh addresses of the Peer,
+// leaving out those that do not parse
+func (pr Peer) Addrs() []netip.Addr {
+	var addrs []netip.Addr
+	for _, a := range pr.Address {
+		if pfx, err := ParseAddress(a); err == nil {
+			addrs = append(addrs, pfx.Addr())
+		}
+	}
+	return addrs
+}
+
+// hostPrefixes will return the mesh addresses of the Peer as
+// single address prefixes, the form they take in AllowedIPs
+func (pr Peer) hostPrefixes() []string {
+	var prefixes []string
+	for _, a := range pr.Addrs() {
+		prefixes = append(prefixes, netip.PrefixFrom(a, a.BitLen()).String())
+	}
+	return prefixes
+}
+
+// normalize will write the addresses of the Peer in canonical form:
+// interface addresses keep their host bits, AllowedIPs are masked
+// and the brackets of an IPv6 endpoint are dropped
+func (pr *Peer) normalize() error {
+	address := make([]string, len(pr.Address))
+	for i, a := range pr.Address {
+		pfx, err := ParseAddress(a)
+		if err != nil {
+			return fmt.Errorf("%s: invalid address %q", pr.Name, a)
+		}
+		address[i] = pfx.String()
+	}
+	allowed := make([]string, len(pr.AllowedIPs))
+	for i, a := range pr.AllowedIPs {
+		pfx, err := ParseAddress(a)
+		if err != nil {
+			return fmt.Errorf("%s: invalid AllowedIPs %q", pr.Name, a)
+		}
+		allowed[i] = pfx.Masked().String()
+	}
+	if pr.Address != nil {
+		pr.Address = address
+	}
+	if pr.AllowedIPs != nil {
+		pr.AllowedIPs = allowed
+	}
+
+	ep := strings.TrimSuffix(strings.TrimPrefix(pr.Endpoint, "["), "]")
+	if _, _, err := net.SplitHostPort(pr.Endpoint); err == nil {
+		return fmt.Errorf("%s: endpoint %q holds a port, set the listen port instead", pr.Name, pr.Endpoint)
+	}
+	if ip, err := netip.ParseAddr(ep); err == nil {
+		ep = ip.String()
+	}
+	pr.Endpoint = ep
+	return nil
+}
+
+// ULA will return an RFC 4193 unique local /48, its global ID
+// is random or, when a seed is given, derived from it
+func ULA(seed string) (netip.Prefix, error) {
+	var id [5]byte
+	if seed == "" {
+		if _, err := rand.Read(id[:]); err != nil {
+			return netip.Prefix{}, err
+		}
+	} else {
+		sum := sha256.Sum256([]byte(seed))
+		copy(id[:], sum[:])
+	}
+	var a [16]byte
+	a[0] = 0xfd
+	copy(a[1:], id[:])
+	return netip.PrefixFrom(netip.AddrFrom16(a), 48), nil
+}
@@ -0,0 +1,170 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package wireguard
+
+import (
+	"net/netip"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseAddress(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"10.0.0.1", "10.0.0.1/32"},
+		{"10.0.0.1/24", "10.0.0.1/24"},
+		{" 10.0.0.1/24 ", "10.0.0.1/24"},
+		{"FD00:0:0::1", "fd00::1/128"},
+		{"fd00::1/64", "fd00::1/64"},
+		{"10.0.0", ""},
+		{"10.0.0.1/33", ""},
+		{"host.example.com", ""},
+	}
+	for _, tt := range tests {
+		pfx, err := ParseAddress(tt.in)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%q: got %s, expected an error", tt.in, pfx)
+			}
+			continue
+		}
+		if err != nil || pfx.String() != tt.want {
+			t.Errorf("%q: got %s, %v, expected %s", tt.in, pfx, err, tt.want)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name string
+		in   Peer
+		want Peer
+		err  bool
+	}{
+		{
+			name: "canonical",
+			in:   Peer{Address: []string{"10.0.0.2/24", "FD00::0002"}, AllowedIPs: []string{"192.168.1.7/24", "2001:DB8:1::5/48", "10.9.9.9"}, Endpoint: "host.example.com"},
+			want: Peer{Address: []string{"10.0.0.2/24", "fd00::2/128"}, AllowedIPs: []string{"192.168.1.0/24", "2001:db8:1::/48", "10.9.9.9/32"}, Endpoint: "host.example.com"},
+		},
+		{
+			name: "bracketed endpoint",
+			in:   Peer{Endpoint: "[2001:DB8::1]"},
+			want: Peer{Endpoint: "2001:db8::1"},
+		},
+		{name: "endpoint with port", in: Peer{Endpoint: "host.example.com:51820"}, err: true},
+		{name: "ipv6 endpoint with port", in: Peer{Endpoint: "[2001:db8::1]:51820"}, err: true},
+		{name: "bad address", in: Peer{Address: []string{"10.0.0.300"}}, err: true},
+		{name: "bad allowed ips", in: Peer{AllowedIPs: []string{"lan"}}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			address := slices.Clone(tt.in.Address)
+			pr := tt.in
+			err := pr.normalize()
+			if tt.err {
+				if err == nil {
+					t.Error("no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(pr, tt.want) {
+				t.Errorf("got %+v, expected %+v", pr, tt.want)
+			}
+			if !reflect.DeepEqual(tt.in.Address, address) {
+				t.Error("the caller's addresses were changed")
+			}
+		})
+	}
+}
+
+func TestULA(t *testing.T) {
+	a, err := ULA("prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ULA("prod")
+	c, _ := ULA("lab")
+	if a != b || a == c {
+		t.Errorf("seeded prefixes: %s %s %s", a, b, c)
+	}
+	r1, _ := ULA("")
+	r2, _ := ULA("")
+	if r1 == r2 {
+		t.Errorf("random prefixes are equal: %s", r1)
+	}
+	fc00 := netip.MustParsePrefix("fc00::/7")
+	for _, p := range []netip.Prefix{a, c, r1, r2} {
+		if p.Bits() != 48 || !fc00.Contains(p.Addr()) || p.Addr().As16()[0] != 0xfd || p != p.Masked() {
+			t.Errorf("%s is not an RFC 4193 /48", p)
+		}
+	}
+}
+
+func TestEndpoint(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to Peer
+		want     string
+	}{
+		{"hostname", Peer{}, Peer{Endpoint: "web1.example.com", ListenPort: 51820}, "web1.example.com:51820"},
+		{"ipv4", Peer{}, Peer{Endpoint: "192.0.2.1", ListenPort: 51820}, "192.0.2.1:51820"},
+		{"ipv6 is bracketed", Peer{}, Peer{Endpoint: "2001:db8::1", ListenPort: 51820}, "[2001:db8::1]:51820"},
+		{"reported", Peer{}, Peer{Endpoint: "2001:db8::1", ListenPort: 51820, ReportedEndpoint: "[2001:db8::9]:4500"}, "[2001:db8::9]:4500"},
+		{"ipv6 lan", Peer{Site: "home", LANAddresses: []string{"fd11::2/64"}}, Peer{Site: "home", LANAddresses: []string{"fd11::3/64"}, ListenPort: 51820}, "[fd11::3]:51820"},
+		{"symmetric nat", Peer{}, Peer{Endpoint: "192.0.2.1", ListenPort: 51820, NAT: NATSymmetric}, ""},
+		{"roaming", Peer{}, Peer{Type: TypeRoaming, ReportedEndpoint: "192.0.2.1:4500"}, ""},
+		{"none", Peer{}, Peer{ListenPort: 51820}, ""},
+	}
+	for _, tt := range tests {
+		if got := endpoint(tt.from, tt.to); got != tt.want {
+			t.Errorf("%s: got %q, expected %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestConfigAllowedIPs(t *testing.T) {
+	tempRegistry(t)
+	p := Peers{
+		{Name: "a", Address: []string{"10.0.0.1/24", "fd00::1/64"}, Endpoint: "2001:db8::1", ListenPort: 51820, PrivateKey: mustKey(t)},
+		{Name: "b", Address: []string{"10.0.0.2/24", "fd00::2/64"}, Endpoint: "2001:db8::2", ListenPort: 51820, PrivateKey: mustKey(t), AllowedIPs: []string{"192.168.1.0/24"}},
+	}
+	c, err := p.Config(p[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := c.String()
+	for _, want := range []string{
+		"Address = 10.0.0.1/24,fd00::1/64\n",
+		"Endpoint = [2001:db8::2]:51820\n",
+		"AllowedIPs = 10.0.0.2/32,fd00::2/128,192.168.1.0/24\n",
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("no %q in\n%s", want, s)
+		}
+	}
+}
@@ -0,0 +1,448 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package wireguard
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// Path is the way a packet from one Peer to an address
+// of another takes through the rendered configs
+type Path struct {
+	From    string
+	To      string
+	Address string `json:",omitempty"`
+	// Hops are the Peers the packet goes through, From and To included
+	Hops   []string
+	OK     bool
+	Reason string `json:",omitempty"`
+}
+
+// pathKey tells the paths of an Analysis apart
+type pathKey struct {
+	from, to, address string
+}
+
+func (path Path) key() pathKey {
+	return pathKey{path.From, path.To, path.Address}
+}
+
+// Overlap is a prefix a Peer routes to several of its peers,
+// WireGuard silently keeps only one of them
+type Overlap struct {
+	Node   string
+	Prefix string
+	Peers  []string
+}
+
+// SinglePoint is a Peer that pairs of other Peers
+// cannot do without
+type SinglePoint struct {
+	Node  string
+	Pairs [][2]string
+}
+
+// Analysis is what Analyze found out about the mesh
+type Analysis struct {
+	Paths        []Path
+	Unreachable  []Path
+	Overlaps     []Overlap
+	Asymmetric   [][2]Path
+	SinglePoints []SinglePoint
+}
+
+// Problems will tell whether the mesh has unreachable pairs
+// or ambiguous routes
+func (a Analysis) Problems() bool {
+	return len(a.Unreachable) > 0 || len(a.Overlaps) > 0
+}
+
+// routeEntry is an AllowedIPs prefix of a peer in a config
+type routeEntry struct {
+	prefix *net.IPNet
+	peer   string
+}
+
+// table is the routing state of a node as rendered
+type table struct {
+	name  string
+	local []net.IP
+	// kernel are the prefixes the node routes into the
+	// WireGuard interface, routes pick the peer there
+	kernel   []*net.IPNet
+	routes   []routeEntry
+	forwards bool
+}
+
+// lookup will return the peer with the longest
+// AllowedIPs prefix holding ip
+func (t table) lookup(ip net.IP) (string, bool) {
+	best, peer := -1, ""
+	for _, r := range t.routes {
+		if ones, _ := r.prefix.Mask.Size(); r.prefix.Contains(ip) && ones > best {
+			best, peer = ones, r.peer
+		}
+	}
+	return peer, best >= 0
+}
+
+// routed will tell whether the node sends ip into the interface
+func (t table) routed(ip net.IP) bool {
+	for _, k := range t.kernel {
+		if k.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t table) knows(peer string) bool {
+	for _, r := range t.routes {
+		if r.peer == peer {
+			return true
+		}
+	}
+	return false
+}
+
+func (t table) isLocal(ip net.IP) bool {
+	for _, l := range t.local {
+		if l.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// source will return the first local address of the family of dst
+func (t table) source(dst net.IP) net.IP {
+	for _, l := range t.local {
+		if (l.To4() != nil) == (dst.To4() != nil) {
+			return l
+		}
+	}
+	return nil
+}
+
+// tables will render the config of every Peer and read its routing
+// state back: the interface routes of its addresses, the routes
+// wg-quick adds for the AllowedIPs or, with Table = off, those of
+// the PostUp commands, and whether it forwards
+func (p Peers) tables() (map[string]table, []Overlap, error) {
+	tables := map[string]table{}
+	var overlaps []Overlap
+	for _, pr := range p {
+		if pr.Pending {
+			continue
+		}
+		c, err := p.Config(pr)
+		if err != nil {
+			return nil, nil, err
+		}
+		t := table{name: pr.Name, forwards: c.Forwards()}
+		for _, a := range c.Interface.Address {
+			pfx, err := ParseAddress(a)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: invalid address %q", pr.Name, a)
+			}
+			t.local = append(t.local, net.IP(pfx.Addr().AsSlice()))
+			t.kernel = append(t.kernel, ipNet(pfx.Masked()))
+		}
+		if c.Interface.Table == "off" {
+			for _, up := range c.Interface.PostUp {
+				if pfx, ok := routeCommand(up); ok {
+					t.kernel = append(t.kernel, ipNet(pfx))
+				}
+			}
+		}
+		owners := map[string][]string{}
+		var prefixes []string
+		for _, pc := range c.Peers {
+			for _, a := range pc.AllowedIPs {
+				pfx, err := ParseAddress(a)
+				if err != nil {
+					return nil, nil, fmt.Errorf("%s: invalid AllowedIPs %q for %s", pr.Name, a, pc.Name)
+				}
+				ipnet := ipNet(pfx.Masked())
+				key := ipnet.String()
+				if len(owners[key]) == 0 {
+					prefixes = append(prefixes, key)
+				}
+				if !contains(owners[key], pc.Name) {
+					owners[key] = append(owners[key], pc.Name)
+				}
+				t.routes = append(t.routes, routeEntry{prefix: ipnet, peer: pc.Name})
+				if c.Interface.Table != "off" {
+					t.kernel = append(t.kernel, ipnet)
+				}
+			}
+		}
+		for _, key := range prefixes {
+			if len(owners[key]) > 1 {
+				overlaps = append(overlaps, Overlap{Node: pr.Name, Prefix: key, Peers: owners[key]})
+			}
+		}
+		tables[pr.Name] = t
+	}
+	return tables, overlaps, nil
+}
+
+// routeCommand will read the prefix of an
+// "ip route add <prefix> dev %i" command
+func routeCommand(cmd string) (netip.Prefix, bool) {
+	f := strings.Fields(cmd)
+	if len(f) > 1 && (f[1] == "-4" || f[1] == "-6") {
+		f = append(f[:1], f[2:]...)
+	}
+	if len(f) != 6 || f[0] != "ip" || f[1] != "route" || f[2] != "add" || f[4] != "dev" || f[5] != "%i" {
+		return netip.Prefix{}, false
+	}
+	pfx, err := ParseAddress(f[3])
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	return pfx.Masked(), true
+}
+
+func ipNet(pfx netip.Prefix) *net.IPNet {
+	return &net.IPNet{IP: net.IP(pfx.Addr().AsSlice()), Mask: net.CIDRMask(pfx.Bits(), pfx.Addr().BitLen())}
+}
+
+// trace will follow a packet from one Peer to every mesh address of
+// another through the routing tables, down Peers drop everything
+func trace(tables map[string]table, from, to string, down map[string]bool) []Path {
+	dsts := tables[to].local
+	if len(dsts) == 0 {
+		return []Path{{From: from, To: to, Hops: []string{from}, Reason: to + " has no mesh address"}}
+	}
+	var paths []Path
+	for _, dst := range dsts {
+		paths = append(paths, traceAddress(tables, from, to, dst, down))
+	}
+	return paths
+}
+
+// traceAddress will follow a packet from one Peer to dst
+func traceAddress(tables map[string]table, from, to string, dst net.IP, down map[string]bool) Path {
+	path := Path{From: from, To: to, Address: dst.String(), Hops: []string{from}}
+	src := tables[from].source(dst)
+	if src == nil {
+		path.Reason = from + " has no mesh address of the family of " + dst.String()
+		return path
+	}
+	cur, prev := from, ""
+	for len(path.Hops) <= len(tables)+1 {
+		t := tables[cur]
+		if prev != "" {
+			// WireGuard drops what comes from a peer
+			// whose AllowedIPs do not hold the source
+			if back, _ := t.lookup(src); back != prev {
+				path.Reason = fmt.Sprintf("%s drops packets from %s coming through %s", cur, from, prev)
+				return path
+			}
+		}
+		if t.isLocal(dst) {
+			if cur != to {
+				path.Reason = "delivered to " + cur
+				return path
+			}
+			path.OK = true
+			return path
+		}
+		if prev != "" && !t.forwards {
+			path.Reason = cur + " does not forward"
+			return path
+		}
+		next, ok := t.lookup(dst)
+		if !t.routed(dst) || !ok {
+			path.Reason = cur + " has no route to " + dst.String()
+			return path
+		}
+		if down[next] {
+			path.Reason = next + " is down"
+			return path
+		}
+		if !tables[next].knows(cur) {
+			path.Reason = fmt.Sprintf("%s has no tunnel to %s", next, cur)
+			return path
+		}
+		for _, h := range path.Hops {
+			if h == next {
+				path.Reason = "routing loop through " + next
+				return path
+			}
+		}
+		path.Hops = append(path.Hops, next)
+		prev, cur = cur, next
+	}
+	path.Reason = "too many hops"
+	return path
+}
+
+// Analyze will trace every pair of Peers seeing each other through
+// their rendered configs, and look for ambiguous routes, asymmetric
+// paths and the Peers some pairs depend on
+func (p Peers) Analyze() (Analysis, error) {
+	var a Analysis
+	tables, overlaps, err := p.tables()
+	if err != nil {
+		return a, err
+	}
+	a.Overlaps = overlaps
+	a.Paths = p.traceAll(tables, nil)
+	byKey := map[pathKey]Path{}
+	for _, path := range a.Paths {
+		byKey[path.key()] = path
+		if !path.OK {
+			a.Unreachable = append(a.Unreachable, path)
+		}
+	}
+	// the way back is to the address of the same family
+	for _, path := range a.Paths {
+		if path.From > path.To || !path.OK {
+			continue
+		}
+		dst := net.ParseIP(path.Address)
+		src := tables[path.From].source(dst)
+		back, ok := byKey[pathKey{path.To, path.From, src.String()}]
+		if ok && back.OK && !reversed(path.Hops, back.Hops) {
+			a.Asymmetric = append(a.Asymmetric, [2]Path{path, back})
+		}
+	}
+
+	// only the Peers packets go through can be single points
+	transit := map[string]bool{}
+	for _, path := range a.Paths {
+		if path.OK {
+			for _, h := range path.Hops[1 : len(path.Hops)-1] {
+				transit[h] = true
+			}
+		}
+	}
+	for _, pr := range p {
+		if !transit[pr.Name] {
+			continue
+		}
+		sp := SinglePoint{Node: pr.Name}
+		for _, path := range p.traceAll(tables, map[string]bool{pr.Name: true}) {
+			pair := [2]string{path.From, path.To}
+			if !path.OK && byKey[path.key()].OK && !containsPair(sp.Pairs, pair) {
+				sp.Pairs = append(sp.Pairs, pair)
+			}
+		}
+		if len(sp.Pairs) > 0 {
+			a.SinglePoints = append(a.SinglePoints, sp)
+		}
+	}
+	return a, nil
+}
+
+func containsPair(pairs [][2]string, pair [2]string) bool {
+	for _, p := range pairs {
+		if p == pair {
+			return true
+		}
+	}
+	return false
+}
+
+// traceAll will trace every pair of Peers seeing each other,
+// leaving out the down ones
+func (p Peers) traceAll(tables map[string]table, down map[string]bool) []Path {
+	var paths []Path
+	for _, from := range p {
+		for _, to := range p {
+			if !visible(from, to) || down[from.Name] || down[to.Name] {
+				continue
+			}
+			paths = append(paths, trace(tables, from.Name, to.Name, down)...)
+		}
+	}
+	return paths
+}
+
+// Impact is how removing some Peers changes the paths of the others
+type Impact struct {
+	Without []string
+	// Lost are the pairs that could talk before and cannot after
+	Lost []Path
+	// Changed are the pairs that can still talk but another way
+	Changed [][2]Path
+	After   Analysis
+}
+
+// Without will analyze the mesh as it would be after
+// removing the named Peers from the registry
+func (p Peers) Without(before Analysis, names []string) (Impact, error) {
+	im := Impact{Without: names}
+	var rest Peers
+	for _, pr := range p {
+		keep := true
+		for _, n := range names {
+			if strings.EqualFold(pr.Name, n) {
+				keep = false
+			}
+		}
+		if keep {
+			rest = append(rest, pr)
+		}
+	}
+	if len(p)-len(rest) != len(names) {
+		return im, fmt.Errorf("%s: %w", strings.Join(names, ", "), ErrPeerNotFound)
+	}
+	after, err := rest.Analyze()
+	if err != nil {
+		return im, err
+	}
+	im.After = after
+	old := map[pathKey]Path{}
+	for _, path := range before.Paths {
+		old[path.key()] = path
+	}
+	for _, path := range after.Paths {
+		prev, ok := old[path.key()]
+		switch {
+		case !ok || !prev.OK:
+		case !path.OK:
+			im.Lost = append(im.Lost, path)
+		case strings.Join(prev.Hops, " ") != strings.Join(path.Hops, " "):
+			im.Changed = append(im.Changed, [2]Path{prev, path})
+		}
+	}
+	return im, nil
+}
+
+// reversed will tell whether b is a in reverse order
+func reversed(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[len(b)-1-i] {
+			return false
+		}
+	}
+	return true
+}
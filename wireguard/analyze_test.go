@@ -0,0 +1,272 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package wireguard
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// analyzePeers will give the peers keys and, when they have
+// none, an address and an endpoint of their own
+func analyzePeers(t *testing.T, peers ...Peer) Peers {
+	t.Helper()
+	for i := range peers {
+		peers[i].PrivateKey = mustKey(t)
+		if peers[i].ListenPort == 0 {
+			peers[i].ListenPort = 51820
+		}
+	}
+	return Peers(peers)
+}
+
+// summary will show a path as from>to:hops or from>to!reason
+func summary(paths []Path) []string {
+	var out []string
+	for _, p := range paths {
+		s := p.From + ">" + p.To + "@" + p.Address
+		if p.OK {
+			s += ":" + strings.Join(p.Hops, ",")
+		} else {
+			s += "!" + p.Reason
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+func TestAnalyze(t *testing.T) {
+	tests := []struct {
+		name         string
+		peers        []Peer
+		unreachable  []string
+		overlaps     []Overlap
+		singlePoints []SinglePoint
+		paths        int
+	}{
+		{
+			name: "full mesh",
+			peers: []Peer{
+				{Name: "a", Address: []string{"10.0.0.1/24", "fd00::1/64"}, Endpoint: "a.example.com"},
+				{Name: "b", Address: []string{"10.0.0.2/24", "fd00::2/64"}, Endpoint: "b.example.com"},
+				{Name: "c", Address: []string{"10.0.0.3/24", "fd00::3/64"}, Endpoint: "c.example.com"},
+			},
+			// every address of every pair
+			paths: 12,
+		},
+		{
+			name: "overlap",
+			peers: []Peer{
+				{Name: "a", Address: []string{"10.0.0.1/24"}, Endpoint: "a.example.com"},
+				{Name: "b", Address: []string{"10.0.0.2/24"}, Endpoint: "b.example.com", AllowedIPs: []string{"192.168.1.0/24"}},
+				{Name: "c", Address: []string{"10.0.0.3/24"}, Endpoint: "c.example.com", AllowedIPs: []string{"192.168.1.0/24"}},
+			},
+			overlaps: []Overlap{{Node: "a", Prefix: "192.168.1.0/24", Peers: []string{"b", "c"}}},
+			paths:    6,
+		},
+		{
+			name: "unreachable pair",
+			peers: []Peer{
+				{Name: "a", Address: []string{"10.0.0.1/24"}, NAT: NATSymmetric},
+				{Name: "b", Address: []string{"10.0.0.2/24"}, NAT: NATSymmetric},
+			},
+			unreachable: []string{"a>b@10.0.0.2!a has no route to 10.0.0.2", "b>a@10.0.0.1!b has no route to 10.0.0.1"},
+			paths:       2,
+		},
+		{
+			name: "relay",
+			peers: []Peer{
+				{Name: "a", Address: []string{"10.0.0.1/24"}, NAT: NATSymmetric},
+				{Name: "b", Address: []string{"10.0.0.2/24"}, NAT: NATSymmetric},
+				{Name: "relay", Address: []string{"10.0.0.3/24"}, Endpoint: "relay.example.com", Relay: true},
+			},
+			singlePoints: []SinglePoint{{Node: "relay", Pairs: [][2]string{{"a", "b"}, {"b", "a"}}}},
+			paths:        6,
+		},
+		{
+			name: "table off",
+			peers: []Peer{
+				{Name: "a", Address: []string{"10.0.0.1/24"}, Endpoint: "a.example.com", Table: "off"},
+				{Name: "b", Address: []string{"10.0.0.2/24"}, Endpoint: "b.example.com"},
+			},
+			paths: 2,
+		},
+		{
+			// nothing routes the host addresses into the interface
+			name: "table off host addresses",
+			peers: []Peer{
+				{Name: "a", Address: []string{"10.0.0.1/32"}, Endpoint: "a.example.com", Table: "off"},
+				{Name: "b", Address: []string{"10.0.0.2/32"}, Endpoint: "b.example.com"},
+			},
+			unreachable: []string{"a>b@10.0.0.2!a has no route to 10.0.0.2"},
+			paths:       2,
+		},
+		{
+			name: "table off own route",
+			peers: []Peer{
+				{Name: "a", Address: []string{"10.0.0.1/32"}, Endpoint: "a.example.com", Table: "off", PostUp: "ip route add 10.0.0.0/24 dev %i"},
+				{Name: "b", Address: []string{"10.0.0.2/32"}, Endpoint: "b.example.com"},
+			},
+			paths: 2,
+		},
+		{
+			name: "no address",
+			peers: []Peer{
+				{Name: "a", Address: []string{"10.0.0.1/24"}, Endpoint: "a.example.com"},
+				{Name: "b", Endpoint: "b.example.com"},
+			},
+			unreachable: []string{"a>b@!b has no mesh address", "b>a@10.0.0.1!b has no mesh address of the family of 10.0.0.1"},
+			paths:       2,
+		},
+		{
+			name: "ipv6 only peer",
+			peers: []Peer{
+				{Name: "a", Address: []string{"10.0.0.1/24", "fd00::1/64"}, Endpoint: "a.example.com"},
+				{Name: "b", Address: []string{"fd00::2/64"}, Endpoint: "b.example.com"},
+			},
+			unreachable: []string{"b>a@10.0.0.1!b has no mesh address of the family of 10.0.0.1"},
+			paths:       3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempRegistry(t)
+			p := analyzePeers(t, tt.peers...)
+			a, err := p.Analyze()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(a.Paths) != tt.paths {
+				t.Errorf("got %d paths %v, expected %d", len(a.Paths), summary(a.Paths), tt.paths)
+			}
+			if got := summary(a.Unreachable); !reflect.DeepEqual(got, tt.unreachable) {
+				t.Errorf("unreachable: got %v, expected %v", got, tt.unreachable)
+			}
+			if !reflect.DeepEqual(a.Overlaps, tt.overlaps) {
+				t.Errorf("overlaps: got %v, expected %v", a.Overlaps, tt.overlaps)
+			}
+			if !reflect.DeepEqual(a.SinglePoints, tt.singlePoints) {
+				t.Errorf("single points: got %v, expected %v", a.SinglePoints, tt.singlePoints)
+			}
+			if a.Problems() != (len(tt.unreachable) > 0 || len(tt.overlaps) > 0) {
+				t.Errorf("Problems: %v", a.Problems())
+			}
+			if len(a.Asymmetric) > 0 {
+				t.Errorf("asymmetric: %v", a.Asymmetric)
+			}
+		})
+	}
+}
+
+func TestAnalyzeRelayHops(t *testing.T) {
+	tempRegistry(t)
+	p := analyzePeers(t,
+		Peer{Name: "a", Address: []string{"10.0.0.1/24"}, NAT: NATSymmetric},
+		Peer{Name: "b", Address: []string{"10.0.0.2/24"}, NAT: NATSymmetric},
+		Peer{Name: "relay", Address: []string{"10.0.0.3/24"}, Endpoint: "relay.example.com", Relay: true},
+	)
+	a, err := p.Analyze()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"a>b@10.0.0.2:a,relay,b",
+		"a>relay@10.0.0.3:a,relay",
+		"b>a@10.0.0.1:b,relay,a",
+		"b>relay@10.0.0.3:b,relay",
+		"relay>a@10.0.0.1:relay,a",
+		"relay>b@10.0.0.2:relay,b",
+	}
+	if got := summary(a.Paths); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, expected %v", got, want)
+	}
+}
+
+func TestWithout(t *testing.T) {
+	tempRegistry(t)
+	p := analyzePeers(t,
+		Peer{Name: "a", Address: []string{"10.0.0.1/24"}, NAT: NATSymmetric},
+		Peer{Name: "b", Address: []string{"10.0.0.2/24"}, NAT: NATSymmetric},
+		Peer{Name: "relay1", Address: []string{"10.0.0.3/24"}, Endpoint: "relay1.example.com", Relay: true},
+		Peer{Name: "c", Address: []string{"10.0.0.4/24"}, Endpoint: "c.example.com"},
+	)
+	before, err := p.Analyze()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before.Problems() {
+		t.Fatalf("problems before: %v", summary(before.Unreachable))
+	}
+
+	im, err := p.Without(before, []string{"RELAY1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a>b@10.0.0.2!a has no route to 10.0.0.2", "b>a@10.0.0.1!b has no route to 10.0.0.1"}
+	if got := summary(im.Lost); !reflect.DeepEqual(got, want) {
+		t.Errorf("lost: got %v, expected %v", got, want)
+	}
+	if !im.After.Problems() {
+		t.Error("no problems after")
+	}
+
+	// c takes no part in the paths of the others
+	im, err = p.Without(before, []string{"c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(im.Lost) != 0 || len(im.Changed) != 0 || im.After.Problems() {
+		t.Errorf("without c: lost %v, changed %v", summary(im.Lost), im.Changed)
+	}
+
+	if _, err = p.Without(before, []string{"nope"}); !errors.Is(err, ErrPeerNotFound) {
+		t.Errorf("unknown node: got %v", err)
+	}
+}
+
+func TestRouteCommand(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"ip route add 10.0.0.2/32 dev %i", "10.0.0.2/32"},
+		{"ip -6 route add fd00::2/128 dev %i", "fd00::2/128"},
+		{"ip route add 192.168.1.7/24 dev %i", "192.168.1.0/24"},
+		{"ip route del 10.0.0.2/32 dev %i", ""},
+		{"ip route add 10.0.0.2/32 dev eth0", ""},
+		{"ip route add 10.0.0.2/32 via 10.0.0.1 dev %i", ""},
+		{"sysctl -q -w net.ipv4.ip_forward=1", ""},
+	}
+	for _, tt := range tests {
+		pfx, ok := routeCommand(tt.in)
+		if got := ""; ok {
+			got = pfx.String()
+			if got != tt.want {
+				t.Errorf("%q: got %s, expected %s", tt.in, got, tt.want)
+			}
+		} else if tt.want != "" {
+			t.Errorf("%q: no route, expected %s", tt.in, tt.want)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package wireguard
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// AnsibleOptions holds the settings used by ExportAnsible
+type AnsibleOptions struct {
+	// InventoryFormat is either ini or yaml
+	InventoryFormat string
+	// VaultPassword, when set, is used to encrypt the private keys
+	VaultPassword []byte
+}
+
+type ansiblePeer struct {
+	Name       string   `yaml:"name"`
+	PublicKey  string   `yaml:"public_key"`
+	Endpoint   string   `yaml:"endpoint,omitempty"`
+	AllowedIPs []string `yaml:"allowed_ips"`
+}
+
+type ansibleHostVars struct {
+	Interface  string        `yaml:"wireguard_interface"`
+	Address    []string      `yaml:"wireguard_address"`
+	PrivateKey interface{}   `yaml:"wireguard_private_key,omitempty"`
+	ListenPort int           `yaml:"wireguard_listen_port,omitempty"`
+	FwMark     int           `yaml:"wireguard_fwmark,omitempty"`
+	DNS        string        `yaml:"wireguard_dns,omitempty"`
+	MTU        int           `yaml:"wireguard_mtu,omitempty"`
+	Table      string        `yaml:"wireguard_table,omitempty"`
+	PreUp      []string      `yaml:"wireguard_preup,omitempty"`
+	PostUp     []string      `yaml:"wireguard_postup,omitempty"`
+	PreDown    []string      `yaml:"wireguard_predown,omitempty"`
+	PostDown   []string      `yaml:"wireguard_postdown,omitempty"`
+	SaveConfig bool          `yaml:"wireguard_save_config,omitempty"`
+	Peers      []ansiblePeer `yaml:"wireguard_peers"`
+}
+
+// ExportAnsible will write an inventory with groups made from the
+// roles and tags of the Peers and a host_vars file for every Peer
+func (p Peers) ExportAnsible(folder string, opts AnsibleOptions) error {
+	if err := os.MkdirAll(filepath.Join(folder, "host_vars"), 0775); err != nil {
+		return err
+	}
+
+	var inventory []byte
+	var err error
+	switch opts.InventoryFormat {
+	case "ini", "":
+		inventory = []byte(p.iniInventory())
+		err = os.WriteFile(filepath.Join(folder, "inventory.ini"), inventory, 0644)
+	case "yaml":
+		if inventory, err = p.yamlInventory(); err != nil {
+			return err
+		}
+		err = os.WriteFile(filepath.Join(folder, "inventory.yml"), inventory, 0644)
+	default:
+		err = fmt.Errorf("unknown inventory format %q", opts.InventoryFormat)
+	}
+	if err != nil {
+		return err
+	}
+
+	for i := range p {
+		hv, err := p.hostVars(p[i], opts.VaultPassword)
+		if err != nil {
+			return err
+		}
+		b, err := encodeYAML(hv)
+		if err != nil {
+			return err
+		}
+		// without a vault password the private key is in clear text
+		err = os.WriteFile(filepath.Join(folder, "host_vars", p[i].Name+".yml"), append([]byte("---\n"), b...), 0600)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p Peers) hostVars(pr Peer, password []byte) (ansibleHostVars, error) {
+	c, err := p.Config(pr)
+	if err != nil {
+		return ansibleHostVars{}, err
+	}
+
+	hv := ansibleHostVars{
+		Interface:  interfaceName("", pr.Name),
+		Address:    c.Interface.Address,
+		ListenPort: c.Interface.ListenPort,
+		FwMark:     c.Interface.FwMark,
+		DNS:        c.Interface.DNS,
+		MTU:        c.Interface.MTU,
+		Table:      c.Interface.Table,
+		PreUp:      c.Interface.PreUp,
+		PostUp:     c.Interface.PostUp,
+		PreDown:    c.Interface.PreDown,
+		PostDown:   c.Interface.PostDown,
+		SaveConfig: c.Interface.SaveConfig,
+		Peers:      []ansiblePeer{},
+	}
+	// joined nodes hold their own key, they get none
+	switch {
+	case c.Interface.PrivateKey == "":
+	case len(password) > 0:
+		v, err := VaultEncrypt([]byte(c.Interface.PrivateKey), password)
+		if err != nil {
+			return hv, err
+		}
+		hv.PrivateKey = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!vault", Style: yaml.LiteralStyle, Value: v}
+	default:
+		hv.PrivateKey = c.Interface.PrivateKey
+	}
+	for _, pc := range c.Peers {
+		hv.Peers = append(hv.Peers, ansiblePeer{Name: pc.Name, PublicKey: pc.PublicKey, Endpoint: pc.Endpoint, AllowedIPs: pc.AllowedIPs})
+	}
+	return hv, nil
+}
+
+// groups will return the inventory groups and their members,
+// a role_<role> group for every role and a tag_<tag> for every tag
+func (p Peers) groups() map[string][]string {
+	g := map[string][]string{}
+	for _, pr := range p {
+		if pr.Role != "" {
+			name := "role_" + groupName(pr.Role)
+			g[name] = append(g[name], pr.Name)
+		}
+		for _, t := range pr.Tags {
+			name := "tag_" + groupName(t)
+			g[name] = append(g[name], pr.Name)
+		}
+	}
+	return g
+}
+
+func (p Peers) iniInventory() string {
+	var b strings.Builder
+	b.WriteString("[mesh]\n")
+	for _, pr := range p {
+		b.WriteString(pr.Name)
+		if pr.Endpoint != "" {
+			b.WriteString(" ansible_host=" + pr.Endpoint)
+		}
+		b.WriteString("\n")
+	}
+
+	groups := p.groups()
+	for _, name := range sortedKeys(groups) {
+		b.WriteString(fmt.Sprintf("\n[%s]\n", name))
+		for _, h := range groups[name] {
+			b.WriteString(h + "\n")
+		}
+	}
+	return b.String()
+}
+
+func (p Peers) yamlInventory() ([]byte, error) {
+	hosts := map[string]interface{}{}
+	for _, pr := range p {
+		vars := map[string]string{}
+		if pr.Endpoint != "" {
+			vars["ansible_host"] = pr.Endpoint
+		}
+		hosts[pr.Name] = vars
+	}
+
+	children := map[string]interface{}{
+		"mesh": map[string]interface{}{"hosts": hosts},
+	}
+	for name, members := range p.groups() {
+		h := map[string]interface{}{}
+		for _, m := range members {
+			h[m] = map[string]string{}
+		}
+		children[name] = map[string]interface{}{"hosts": h}
+	}
+
+	inv := map[string]interface{}{
+		"all": map[string]interface{}{"children": children},
+	}
+	b, err := encodeYAML(inv)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("---\n"), b...), nil
+}
+
+// groupName will turn s into a valid ansible group name
+func groupName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,93 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package wireguard
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestHostVars(t *testing.T) {
+	tempRegistry(t)
+	own, err := PublicKey(mustKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := Peers{
+		{Name: "Web1", Address: []string{"10.0.0.1/24"}, Endpoint: "web1.example.com", ListenPort: 51820, PrivateKey: mustKey(t)},
+		{Name: "database-primary-eu", Address: []string{"10.0.0.2/24"}, Endpoint: "db.example.com", ListenPort: 51820, PrivateKey: mustKey(t)},
+		// joined with its own key
+		{Name: "laptop1", Address: []string{"10.0.0.3/24"}, PublicKey: own},
+	}
+	password := []byte("vault password")
+	tests := []struct {
+		peer      Peer
+		password  []byte
+		iface     string
+		key       string
+		encrypted bool
+	}{
+		{peer: p[0], iface: "web1", key: p[0].PrivateKey},
+		{peer: p[0], password: password, iface: "web1", key: p[0].PrivateKey, encrypted: true},
+		{peer: p[1], iface: interfaceName("", "database-primary-eu"), key: p[1].PrivateKey},
+		{peer: p[2], password: password, iface: "laptop1"},
+		{peer: p[2], iface: "laptop1"},
+	}
+	for _, tt := range tests {
+		hv, err := p.hostVars(tt.peer, tt.password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hv.Interface != tt.iface || len(hv.Interface) > 15 {
+			t.Errorf("%s: interface %q, expected %q", tt.peer.Name, hv.Interface, tt.iface)
+		}
+		b, err := encodeYAML(hv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var vars map[string]yaml.Node
+		if err = yaml.Unmarshal(b, &vars); err != nil {
+			t.Fatal(err)
+		}
+		key, ok := vars["wireguard_private_key"]
+		switch {
+		case tt.key == "":
+			if ok {
+				t.Errorf("%s: got a private key:\n%s", tt.peer.Name, b)
+			}
+		case tt.encrypted:
+			got, err := vaultDecrypt(t, key.Value, tt.password)
+			if key.Tag != "!vault" || err != nil || string(got) != tt.key {
+				t.Errorf("%s: vault %s %q: %v", tt.peer.Name, key.Tag, got, err)
+			}
+		default:
+			if key.Value != tt.key {
+				t.Errorf("%s: key %q", tt.peer.Name, key.Value)
+			}
+		}
+	}
+	if name := interfaceName("", "database-primary-eu"); len(name) != 15 || strings.Contains(name, "database") {
+		t.Errorf("long name not hashed: %q", name)
+	}
+}
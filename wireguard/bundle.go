@@ -0,0 +1,173 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package wireguard
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+)
+
+// BundleOptions holds the settings used by Bundle
+type BundleOptions struct {
+	// Format is the config format, one of Formats
+	Format string
+	// EncryptTo are age or SSH public keys the bundle is encrypted to
+	EncryptTo []string
+}
+
+type bundleFile struct {
+	name string
+	mode int64
+	body []byte
+}
+
+// Bundle will write a .tar.gz to w holding everything the named Peer
+// needs to join the mesh: the config, its private key in a separate
+// file, an install script and a manifest of checksums
+func (p Peers) Bundle(w io.Writer, peername string, opts BundleOptions) error {
+	pr, err := p.Get(peername)
+	if err != nil {
+		return err
+	}
+	// joined nodes generated their own key and only registered the public one
+	if pr.PrivateKey == "" {
+		return fmt.Errorf("%s: private key not in the registry, the node keeps its own", pr.Name)
+	}
+
+	c, err := p.Config(pr)
+	if err != nil {
+		return err
+	}
+	keyPath := "/etc/wireguard/" + pr.Name + ".key"
+	if opts.Format == "wg-quick" || opts.Format == "" {
+		c = c.WithKeyFile(keyPath)
+	}
+	confName, conf, err := render(c, opts.Format)
+	if err != nil {
+		return err
+	}
+
+	files := []bundleFile{
+		{name: confName, mode: 0600, body: conf},
+		{name: pr.Name + ".key", mode: 0600, body: []byte(pr.PrivateKey + "\n")},
+		{name: "install.sh", mode: 0755, body: []byte(installScript(pr.Name, confName, keyPath, opts.Format))},
+	}
+	var manifest strings.Builder
+	for _, f := range files {
+		// sha256sum -c compatible
+		manifest.WriteString(fmt.Sprintf("%x  %s\n", sha256.Sum256(f.body), f.name))
+	}
+	files = append(files, bundleFile{name: "MANIFEST.sha256", mode: 0644, body: []byte(manifest.String())})
+
+	if len(opts.EncryptTo) > 0 {
+		recipients, err := parseRecipients(opts.EncryptTo)
+		if err != nil {
+			return err
+		}
+		aw, err := age.Encrypt(w, recipients...)
+		if err != nil {
+			return err
+		}
+		if err = writeTarball(aw, pr.Name, files); err != nil {
+			return err
+		}
+		return aw.Close()
+	}
+	return writeTarball(w, pr.Name, files)
+}
+
+func writeTarball(w io.Writer, dir string, files []bundleFile) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: dir + "/", Mode: 0700, ModTime: now}); err != nil {
+		return err
+	}
+	for _, f := range files {
+		hdr := &tar.Header{Typeflag: tar.TypeReg, Name: dir + "/" + f.name, Mode: f.mode, Size: int64(len(f.body)), ModTime: now}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(f.body); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// parseRecipients accepts native age recipients (age1...)
+// as well as ssh-ed25519 and ssh-rsa host keys
+func parseRecipients(keys []string) ([]age.Recipient, error) {
+	var recipients []age.Recipient
+	for _, k := range keys {
+		var r age.Recipient
+		var err error
+		if strings.HasPrefix(k, "age1") {
+			r, err = age.ParseX25519Recipient(k)
+		} else {
+			r, err = agessh.ParseRecipient(k)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("recipient %q: %v", k, err)
+		}
+		recipients = append(recipients, r)
+	}
+	return recipients, nil
+}
+
+func installScript(name, confName, keyPath, format string) string {
+	var b strings.Builder
+	b.WriteString("#!/bin/sh\n")
+	b.WriteString(fmt.Sprintf("# Installs the gomesh bundle of %s\n", name))
+	b.WriteString("set -eu\n\n")
+	b.WriteString("cd \"$(dirname \"$0\")\"\n")
+	b.WriteString("if command -v sha256sum >/dev/null 2>&1; then\n\tsha256sum -c MANIFEST.sha256\nfi\n\n")
+	b.WriteString("umask 077\nmkdir -p /etc/wireguard\n")
+	b.WriteString(fmt.Sprintf("install -m 600 %s %s\n", shellQuote(name+".key"), shellQuote(keyPath)))
+	if format == "k8s" {
+		b.WriteString(fmt.Sprintf("kubectl apply -f %s\n", shellQuote(confName)))
+		return b.String()
+	}
+	b.WriteString(fmt.Sprintf("install -m 600 %s %s\n\n", shellQuote(confName), shellQuote("/etc/wireguard/"+confName)))
+	b.WriteString("if command -v systemctl >/dev/null 2>&1; then\n")
+	b.WriteString(fmt.Sprintf("\tsystemctl enable --now %s\n", shellQuote("wg-quick@"+name)))
+	b.WriteString("else\n")
+	b.WriteString(fmt.Sprintf("\twg-quick up %s\n", shellQuote(name)))
+	b.WriteString("fi\n")
+	return b.String()
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,83 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package wireguard
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestBundle(t *testing.T) {
+	tempRegistry(t)
+	own, err := PublicKey(mustKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := Peers{
+		{Name: "Web1", Address: []string{"10.0.0.1/24"}, Endpoint: "web1.example.com", ListenPort: 51820, PrivateKey: mustKey(t)},
+		// joined with its own key
+		{Name: "laptop1", Address: []string{"10.0.0.2/24"}, PublicKey: own},
+	}
+
+	var b bytes.Buffer
+	if err = p.Bundle(&b, "web1", BundleOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = string(body)
+	}
+	if files["Web1/Web1.key"] != p[0].PrivateKey+"\n" {
+		t.Errorf("key file %q", files["Web1/Web1.key"])
+	}
+	if !strings.Contains(files["Web1/Web1.conf"], "PostUp = wg set %i private-key /etc/wireguard/Web1.key") {
+		t.Errorf("config does not read the key file:\n%s", files["Web1/Web1.conf"])
+	}
+
+	if err = p.Bundle(io.Discard, "laptop1", BundleOptions{}); err == nil || !strings.Contains(err.Error(), "private key") {
+		t.Errorf("joined node: %v", err)
+	}
+	if err = p.Bundle(io.Discard, "web2", BundleOptions{}); !errors.Is(err, ErrPeerNotFound) {
+		t.Errorf("missing node: %v", err)
+	}
+}
@@ -0,0 +1,277 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package wireguard
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Config is the rendered configuration of a single node
+type Config struct {
+	Name      string
+	Interface Interface
+	Peers     []PeerConfig
+}
+
+// Interface is the [Interface] section of a config
+type Interface struct {
+	PrivateKey string
+	Address    []string
+	ListenPort int
+	FwMark     int
+	DNS        string
+	MTU        int
+	Table      string
+	PreUp      []string
+	PostUp     []string
+	PreDown    []string
+	PostDown   []string
+	SaveConfig bool
+}
+
+// PeerConfig is a [Peer] section of a config
+type PeerConfig struct {
+	Name       string
+	PublicKey  string
+	Endpoint   string
+	AllowedIPs []string
+
+	PersistentKeepalive int
+}
+
+// Config will build the configuration of the given Peer
+// as seen from inside the mesh
+func (p Peers) Config(pr Peer) (Config, error) {
+	c := Config{
+		Name: pr.Name,
+		Interface: Interface{
+			PrivateKey: pr.PrivateKey,
+			Address:    pr.Address,
+			ListenPort: pr.ListenPort,
+			FwMark:     pr.FwMark,
+			DNS:        pr.DNS,
+			MTU:        pr.MTU,
+			Table:      pr.Table,
+			PreUp:      nonEmpty(pr.PreUp),
+			PostUp:     nonEmpty(pr.PostUp),
+			PreDown:    nonEmpty(pr.PreDown),
+			PostDown:   nonEmpty(pr.PostDown),
+			SaveConfig: pr.SaveConfig,
+		},
+	}
+
+	if c.Interface.DNS == "" && pr.Network != "" {
+		networks, err := LoadNetworks()
+		if err != nil {
+			return c, err
+		}
+		if nw, err := networks.Get(pr.Network); err == nil {
+			c.Interface.DNS = nw.DNS
+		}
+	}
+
+	links, err := LoadLinks()
+	if err != nil {
+		return c, err
+	}
+
+	// the addresses of Peers reached through a relay
+	// are routed to the relay
+	relayed := map[string][]string{}
+	// wg-quick only routes the AllowedIPs itself
+	// unless Table is off
+	var routes []string
+	for j := range p {
+		// pending Peers neither see nor are seen by the mesh
+		if !visible(pr, p[j]) {
+			continue
+		}
+		r := p.route(pr, p[j], links)
+		if r.Via != "" {
+			relayed[r.Via] = append(relayed[r.Via], p.allowedIPs(p[j])...)
+		}
+		if r.OK() {
+			routes = append(routes, p.served(p[j])...)
+		}
+		if !r.Direct {
+			continue
+		}
+		pub, err := p[j].Public()
+		if err != nil {
+			return c, err
+		}
+		c.Peers = append(c.Peers, PeerConfig{
+			Name:       p[j].Name,
+			PublicKey:  pub,
+			Endpoint:   links.endpoint(pr, p[j]),
+			AllowedIPs: p.allowedIPs(p[j]),
+
+			PersistentKeepalive: links.keepalive(pr, p[j]),
+		})
+	}
+	for i := range c.Peers {
+		c.Peers[i].AllowedIPs = append(c.Peers[i].AllowedIPs, relayed[c.Peers[i].Name]...)
+	}
+
+	if pr.Relay {
+		var all []string
+		for j := range p {
+			if visible(pr, p[j]) {
+				all = append(all, p[j].Address...)
+			}
+		}
+		up, down := forwarding(hasIPv6(all))
+		c.Interface.PostUp = append(c.Interface.PostUp, up...)
+		c.Interface.PostDown = append(c.Interface.PostDown, down...)
+	}
+	up, down := gatewayRules(pr.Subnets)
+	for _, u := range up {
+		if !contains(c.Interface.PostUp, u) {
+			c.Interface.PostUp = append(c.Interface.PostUp, u)
+		}
+	}
+	for _, d := range down {
+		if !contains(c.Interface.PostDown, d) {
+			c.Interface.PostDown = append(c.Interface.PostDown, d)
+		}
+	}
+	pol, err := LoadPolicy()
+	if err != nil {
+		return c, err
+	}
+	up, down = pol.firewall(p, pr, "gomesh")
+	c.Interface.PostUp = append(c.Interface.PostUp, up...)
+	c.Interface.PostDown = append(c.Interface.PostDown, down...)
+	if pr.Table == "off" {
+		for _, r := range routes {
+			c.Interface.PostUp = append(c.Interface.PostUp, "ip route add "+r+" dev %i")
+			c.Interface.PostDown = append(c.Interface.PostDown, "ip route del "+r+" dev %i")
+		}
+	}
+
+	return c, nil
+}
+
+// allowedIPs will return the addresses routed to a Peer: its own
+// mesh addresses, not the subnet they are in, its AllowedIPs and
+// the subnets it is the active gateway of
+func (p Peers) allowedIPs(pr Peer) []string {
+	ips := append(pr.hostPrefixes(), pr.AllowedIPs...)
+	return append(ips, p.served(pr)...)
+}
+
+// Forwards will tell whether the node forwards
+// traffic between its peers
+func (c Config) Forwards() bool {
+	for _, up := range c.Interface.PostUp {
+		if strings.Contains(up, "ip_forward=1") {
+			return true
+		}
+	}
+	return false
+}
+
+// WithKeyFile returns a copy of the config that does not hold the
+// private key but loads it from path when the interface comes up
+func (c Config) WithKeyFile(path string) Config {
+	c.Interface.PrivateKey = ""
+	c.Interface.PostUp = append([]string{fmt.Sprintf("wg set %%i private-key %s", path)}, c.Interface.PostUp...)
+	return c
+}
+
+// String will return the config in wg-quick format
+func (c Config) String() string {
+	var b strings.Builder
+
+	// write the interface section
+	b.WriteString("[Interface]\n")
+	b.WriteString(fmt.Sprintf("# Name: %s\n", strings.ToLower(c.Name)))
+	b.WriteString(fmt.Sprintf("Address = %s\n", strings.Join(c.Interface.Address, ",")))
+	if c.Interface.PrivateKey != "" {
+		b.WriteString(fmt.Sprintf("PrivateKey = %s\n", c.Interface.PrivateKey))
+	}
+	if c.Interface.ListenPort != 0 {
+		b.WriteString(fmt.Sprintf("ListenPort = %d\n", c.Interface.ListenPort))
+	}
+	if c.Interface.FwMark != 0 {
+		b.WriteString(fmt.Sprintf("FwMark = %d\n", c.Interface.FwMark))
+	}
+	if c.Interface.DNS != "" {
+		b.WriteString(fmt.Sprintf("DNS = %s\n", c.Interface.DNS))
+	}
+	if c.Interface.MTU != 0 {
+		b.WriteString(fmt.Sprintf("MTU = %d\n", c.Interface.MTU))
+	}
+	if c.Interface.Table != "" {
+		b.WriteString(fmt.Sprintf("Table = %s\n", c.Interface.Table))
+	}
+	writeAll(&b, "PreUp", c.Interface.PreUp)
+	writeAll(&b, "PostUp", c.Interface.PostUp)
+	writeAll(&b, "PreDown", c.Interface.PreDown)
+	writeAll(&b, "PostDown", c.Interface.PostDown)
+	if c.Interface.SaveConfig {
+		b.WriteString("SaveConfig = True\n")
+	}
+
+	// write the peers section
+	for _, pc := range c.Peers {
+		b.WriteString("\n[Peer]\n")
+		b.WriteString(fmt.Sprintf("# Name: %s\n", strings.ToLower(pc.Name)))
+		b.WriteString(fmt.Sprintf("PublicKey = %s\n", pc.PublicKey))
+		if pc.Endpoint != "" {
+			b.WriteString(fmt.Sprintf("Endpoint = %s\n", pc.Endpoint))
+		}
+		b.WriteString(fmt.Sprintf("AllowedIPs = %s\n", strings.Join(pc.AllowedIPs, ",")))
+		if pc.PersistentKeepalive != 0 {
+			b.WriteString(fmt.Sprintf("PersistentKeepalive = %d\n", pc.PersistentKeepalive))
+		}
+	}
+
+	return b.String()
+}
+
+// ConfigETag will return the HTTP entity tag of a rendered config
+func ConfigETag(b []byte) string {
+	sum := sha256.Sum256(b)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// writeAll will write a line for each value, values of the registry
+// ending with a newline are written as they are
+func writeAll(b *strings.Builder, key string, values []string) {
+	for _, v := range values {
+		b.WriteString(fmt.Sprintf("%s = %s", key, v))
+		if !strings.HasSuffix(v, "\n") {
+			b.WriteString("\n")
+		}
+	}
+}
+
+func nonEmpty(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return []string{s}
+}
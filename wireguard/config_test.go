@@ -0,0 +1,56 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package wireguard
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConfigStringHooks(t *testing.T) {
+	tempRegistry(t)
+	p := routedPeers(t, "web1", "db1")
+	// hooks are written as the registry holds them
+	p[0].PreUp = "echo pre\n"
+	p[0].PostUp = "echo up"
+	p[0].SaveConfig = true
+
+	c, err := p.Config(p[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[Interface]\n" +
+		"# Name: web1\n" +
+		"Address = 10.0.0.1/32\n" +
+		"PrivateKey = " + p[0].PrivateKey + "\n" +
+		"ListenPort = 51820\n" +
+		"PreUp = echo pre\n" +
+		"PostUp = echo up\n" +
+		"SaveConfig = True\n" +
+		"\n[Peer]\n"
+	if got := c.String(); !strings.HasPrefix(got, want) {
+		t.Errorf("got\n%s\nexpected\n%s", got, want)
+	}
+	if _, err = ParseConfig([]byte(c.String())); err != nil {
+		t.Error(err)
+	}
+}
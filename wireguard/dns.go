@@ -0,0 +1,280 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package wireguard
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrDNSCollision is returned when two Peers get the same DNS name
+var ErrDNSCollision = errors.New("DNS name collision")
+
+// DefaultDomain is the DNS domain of the mesh when none is given
+const DefaultDomain = "mesh"
+
+// DNSRecord is an address of a Peer and the name it is known by
+type DNSRecord struct {
+	Name string
+	Peer string
+	IP   net.IP
+}
+
+// ZoneOptions holds the settings used by ExportZone
+type ZoneOptions struct {
+	Domain string
+	// Nameserver is the NS of the zones, ns.<domain> if empty
+	Nameserver string
+	// ZoneDir is where the zone files are found by CoreDNS
+	ZoneDir string
+	TTL     int
+	Serial  uint32
+}
+
+// DNSName will return the name of the Peer, <node>.<network>.<domain>
+// or <node>.<domain> for Peers without a network
+func DNSName(pr Peer, domain string) string {
+	labels := []string{dnsLabel(pr.Name)}
+	if pr.Network != "" {
+		labels = append(labels, dnsLabel(pr.Network))
+	}
+	if domain != "" {
+		labels = append(labels, strings.Trim(domain, "."))
+	}
+	return strings.Join(labels, ".")
+}
+
+// DNSRecords will return a record for every address of the Peers in
+// the mesh, it fails if names collide once made valid DNS labels
+func (p Peers) DNSRecords(domain string) ([]DNSRecord, error) {
+	var records []DNSRecord
+	owner := map[string]string{}
+	for _, pr := range p {
+		if pr.Pending {
+			continue
+		}
+		if dnsLabel(pr.Name) == "" {
+			return nil, fmt.Errorf("%s has no valid DNS label", pr.Name)
+		}
+		name := DNSName(pr, domain)
+		if o, ok := owner[name]; ok {
+			return nil, fmt.Errorf("%s and %s both become %s: %w", o, pr.Name, name, ErrDNSCollision)
+		}
+		owner[name] = pr.Name
+		for _, a := range pr.Address {
+			pfx, err := ParseAddress(a)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid address %q", pr.Name, a)
+			}
+			records = append(records, DNSRecord{Name: name, Peer: pr.Name, IP: net.IP(pfx.Addr().AsSlice())})
+		}
+	}
+	return records, nil
+}
+
+// checkDNSName will fail if the Peer would get
+// the same DNS name as one already registered
+func (p Peers) checkDNSName(pr Peer) error {
+	if dnsLabel(pr.Name) == "" {
+		return fmt.Errorf("%s has no valid DNS label", pr.Name)
+	}
+	name := DNSName(pr, "")
+	for _, o := range p {
+		// the Peer it replaces
+		if strings.EqualFold(o.Name, pr.Name) {
+			continue
+		}
+		if DNSName(o, "") == name {
+			return fmt.Errorf("%s and %s both become %s: %w", o.Name, pr.Name, name, ErrDNSCollision)
+		}
+	}
+	return nil
+}
+
+// WriteHosts will write an /etc/hosts fragment naming the Peers
+func (p Peers) WriteHosts(w io.Writer, domain string) error {
+	records, err := p.DNSRecords(domain)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "# gomesh %s\n", domain)
+	for _, r := range records {
+		if _, err = fmt.Fprintf(w, "%s\t%s\n", r.IP, r.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GenerateHosts will write the hosts fragment to folder/hosts,
+// or to standard out if so instructed
+func (p Peers) GenerateHosts(folder string, domain string) error {
+	var b strings.Builder
+	if err := p.WriteHosts(&b, domain); err != nil {
+		return err
+	}
+	_, err := writeOutput(filepath.Join(folder, "hosts"), []byte(b.String()))
+	return err
+}
+
+// ExportZone will write the forward zone of the mesh domain, the
+// reverse zones of the addresses and CoreDNS and dnsmasq snippets
+// serving them
+func (p Peers) ExportZone(folder string, opts ZoneOptions) error {
+	if opts.Domain == "" {
+		opts.Domain = DefaultDomain
+	}
+	opts.Domain = strings.Trim(opts.Domain, ".")
+	if opts.Nameserver == "" {
+		opts.Nameserver = "ns." + opts.Domain
+	}
+	if opts.ZoneDir == "" {
+		opts.ZoneDir = "/etc/coredns"
+	}
+	if opts.TTL == 0 {
+		opts.TTL = 300
+	}
+	if opts.Serial == 0 {
+		opts.Serial = uint32(time.Now().Unix())
+	}
+	records, err := p.DNSRecords(opts.Domain)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(folder, 0775); err != nil {
+		return err
+	}
+
+	zones := map[string][]string{opts.Domain: nil}
+	for _, r := range records {
+		rr := "A"
+		if r.IP.To4() == nil {
+			rr = "AAAA"
+		}
+		zones[opts.Domain] = append(zones[opts.Domain], fmt.Sprintf("%s\tIN\t%s\t%s", relative(r.Name, opts.Domain), rr, r.IP))
+		origin, name := reverseName(r.IP)
+		zones[origin] = append(zones[origin], fmt.Sprintf("%s\tIN\tPTR\t%s.", name, r.Name))
+	}
+
+	origins := make([]string, 0, len(zones))
+	for o := range zones {
+		origins = append(origins, o)
+	}
+	sort.Strings(origins)
+	var corefile strings.Builder
+	for _, o := range origins {
+		if err = os.WriteFile(filepath.Join(folder, o+".zone"), []byte(zoneFile(o, zones[o], opts)), 0644); err != nil {
+			return err
+		}
+		fmt.Fprintf(&corefile, "%s {\n    file %s\n}\n", o, path.Join(opts.ZoneDir, o+".zone"))
+	}
+	if err = os.WriteFile(filepath.Join(folder, "Corefile"), []byte(corefile.String()), 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(folder, "dnsmasq.conf"), []byte(dnsmasqConf(records)), 0644)
+}
+
+func zoneFile(origin string, lines []string, opts ZoneOptions) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "$ORIGIN %s.\n", origin)
+	fmt.Fprintf(&b, "$TTL %d\n", opts.TTL)
+	fmt.Fprintf(&b, "@\tIN\tSOA\t%s. hostmaster.%s. %d 3600 600 86400 %d\n", opts.Nameserver, opts.Domain, opts.Serial, opts.TTL)
+	fmt.Fprintf(&b, "@\tIN\tNS\t%s.\n", opts.Nameserver)
+	for _, l := range lines {
+		b.WriteString(l + "\n")
+	}
+	return b.String()
+}
+
+// dnsmasqConf will return host-record lines, dnsmasq
+// answers the reverse lookups of them too
+func dnsmasqConf(records []DNSRecord) string {
+	var names []string
+	ips := map[string][]string{}
+	for _, r := range records {
+		if _, ok := ips[r.Name]; !ok {
+			names = append(names, r.Name)
+		}
+		ips[r.Name] = append(ips[r.Name], r.IP.String())
+	}
+	var b strings.Builder
+	for _, n := range names {
+		fmt.Fprintf(&b, "host-record=%s,%s\n", n, strings.Join(ips[n], ","))
+	}
+	return b.String()
+}
+
+// ReverseName will return the in-addr.arpa or ip6.arpa name of ip
+func ReverseName(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", v4[3], v4[2], v4[1], v4[0])
+	}
+	const hex = "0123456789abcdef"
+	nibbles := make([]string, 0, 34)
+	for i := len(ip) - 1; i >= 0; i-- {
+		nibbles = append(nibbles, string(hex[ip[i]&0xf]), string(hex[ip[i]>>4]))
+	}
+	return strings.Join(append(nibbles, "ip6", "arpa"), ".")
+}
+
+// reverseName will return the reverse zone of the address, a /24
+// for IPv4 and a /64 for IPv6, and its name relative to it
+func reverseName(ip net.IP) (string, string) {
+	labels := strings.Split(ReverseName(ip), ".")
+	host := 1
+	if ip.To4() == nil {
+		host = 16
+	}
+	return strings.Join(labels[host:], "."), strings.Join(labels[:host], ".")
+}
+
+func relative(name, origin string) string {
+	if name == origin {
+		return "@"
+	}
+	return strings.TrimSuffix(name, "."+origin)
+}
+
+// dnsLabel will turn a name into a valid RFC 1123 label
+func dnsLabel(s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(s) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune('-')
+		}
+	}
+	name := strings.Trim(b.String(), "-")
+	if len(name) > 63 {
+		name = strings.TrimRight(name[:63], "-")
+	}
+	return name
+}
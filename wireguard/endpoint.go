@@ -0,0 +1,191 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package wireguard
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// NAT types a Peer can report being behind
+const (
+	NATNone      = "none"
+	NATCone      = "cone"
+	NATSymmetric = "symmetric"
+)
+
+// Node types, servers have an endpoint, clients listen but have no
+// public endpoint and roaming nodes have neither
+const (
+	TypeServer  = "server"
+	TypeClient  = "client"
+	TypeRoaming = "roaming"
+)
+
+// ErrInvalidReport is returned when a node reports something unusable
+var ErrInvalidReport = errors.New("invalid report")
+
+// DefaultKeepalive is used by Peers behind symmetric NAT and by
+// those without an endpoint, which nobody can reach and so must
+// keep their mappings open
+const DefaultKeepalive = 25
+
+// Report is what a node tells the control plane
+// about the addresses it can be reached on
+type Report struct {
+	// Endpoint is the public host:port the control plane sees
+	Endpoint string
+	// LANAddresses are the local addresses of the node, in
+	// CIDR notation so that Peers on the same LAN can be found
+	LANAddresses []string `json:",omitempty"`
+	NAT          string   `json:",omitempty"`
+	Site         string   `json:",omitempty"`
+}
+
+// Report will record how the named Peer can be reached and
+// return whether anything changed
+func (p *Peers) Report(name string, r Report) (bool, error) {
+	i := p.index(name)
+	if i < 0 {
+		return false, fmt.Errorf("%s: %w", name, ErrPeerNotFound)
+	}
+	if err := validNAT(r.NAT); err != nil {
+		return false, fmt.Errorf("%w: %v", ErrInvalidReport, err)
+	}
+	if r.Endpoint != "" {
+		if _, _, err := net.SplitHostPort(r.Endpoint); err != nil {
+			return false, fmt.Errorf("%w: %v", ErrInvalidReport, err)
+		}
+	}
+	for _, a := range r.LANAddresses {
+		if _, _, err := net.ParseCIDR(a); err != nil && net.ParseIP(a) == nil {
+			return false, fmt.Errorf("%w: LAN address %q", ErrInvalidReport, a)
+		}
+	}
+
+	pr := &(*p)[i]
+	changed := pr.ReportedEndpoint != r.Endpoint || strings.Join(pr.LANAddresses, ",") != strings.Join(r.LANAddresses, ",")
+	pr.ReportedEndpoint, pr.LANAddresses = r.Endpoint, r.LANAddresses
+	// NAT type and site are only overwritten when reported
+	if r.NAT != "" && r.NAT != pr.NAT {
+		pr.NAT, changed = r.NAT, true
+	}
+	if r.Site != "" && r.Site != pr.Site {
+		pr.Site, changed = r.Site, true
+	}
+	if !changed {
+		return false, nil
+	}
+	return true, p.DumpPeers(true)
+}
+
+// endpoint will return the endpoint from should use to reach to:
+// a LAN address when both are on the same site, else the reported
+// public address, else the static one. Peers behind symmetric NAT
+// and roaming Peers have none, they are reached once they talk first
+func endpoint(from, to Peer) string {
+	if to.NAT == NATSymmetric || to.Type == TypeRoaming {
+		return ""
+	}
+	if from.Site != "" && strings.EqualFold(from.Site, to.Site) {
+		if ip := lanAddress(from, to); ip != "" {
+			return net.JoinHostPort(ip, strconv.Itoa(to.ListenPort))
+		}
+	}
+	if to.ReportedEndpoint != "" {
+		return to.ReportedEndpoint
+	}
+	if to.Endpoint == "" {
+		return ""
+	}
+	return net.JoinHostPort(to.Endpoint, strconv.Itoa(to.ListenPort))
+}
+
+// keepalive will return the PersistentKeepalive from should use
+// toward to, Peers nobody can reach keep their tunnels open
+func keepalive(from, to Peer) int {
+	if to.PersistentKeepalive != 0 {
+		return to.PersistentKeepalive
+	}
+	if from.NAT == NATSymmetric {
+		return DefaultKeepalive
+	}
+	if from.Type != "" && from.Type != TypeServer && endpoint(from, to) != "" {
+		return DefaultKeepalive
+	}
+	return to.PersistentKeepalive
+}
+
+// lanAddress will return the LAN address of to sharing a subnet
+// with one of from's, or the first one if none does
+func lanAddress(from, to Peer) string {
+	var first string
+	for _, a := range to.LANAddresses {
+		ip, ipnet, err := net.ParseCIDR(a)
+		if err != nil {
+			ip = net.ParseIP(a)
+		}
+		if ip == nil {
+			continue
+		}
+		if first == "" {
+			first = ip.String()
+		}
+		if ipnet == nil {
+			continue
+		}
+		for _, b := range from.LANAddresses {
+			other, _, err := net.ParseCIDR(b)
+			if err != nil {
+				other = net.ParseIP(b)
+			}
+			if other != nil && ipnet.Contains(other) {
+				return ip.String()
+			}
+		}
+	}
+	return first
+}
+
+func validNAT(nat string) error {
+	switch nat {
+	case "", NATNone, NATCone, NATSymmetric:
+		return nil
+	}
+	return fmt.Errorf("unknown NAT type %q, expected %s, %s or %s", nat, NATNone, NATCone, NATSymmetric)
+}
+
+func validPeerType(pr Peer) error {
+	switch pr.Type {
+	case "", TypeServer, TypeClient:
+		return nil
+	case TypeRoaming:
+		if pr.Endpoint != "" || pr.ListenPort != 0 {
+			return fmt.Errorf("%s: roaming nodes have neither an endpoint nor a listen port", pr.Name)
+		}
+		return nil
+	}
+	return fmt.Errorf("%s: unknown node type %q, expected %s, %s or %s", pr.Name, pr.Type, TypeServer, TypeClient, TypeRoaming)
+}
@@ -0,0 +1,256 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package wireguard
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Edge kinds of a Graph
+const (
+	EdgeDirect  = "direct"
+	EdgeRelayed = "relayed"
+	EdgeGateway = "gateway"
+	EdgeStandby = "standby"
+)
+
+// Graph is the topology of the mesh, the Peers and the subnets
+// they route as nodes and the paths between them as edges
+type Graph struct {
+	Nodes []GraphNode
+	Edges []GraphEdge
+}
+
+// GraphNode is a Peer or, when Kind is subnet, a routed prefix
+type GraphNode struct {
+	ID        string
+	Kind      string
+	Name      string
+	Network   string   `json:",omitempty"`
+	Role      string   `json:",omitempty"`
+	Tags      []string `json:",omitempty"`
+	Relay     bool     `json:",omitempty"`
+	Highlight bool     `json:",omitempty"`
+}
+
+// GraphEdge is a path between two GraphNodes, Via is the relay
+// of relayed edges
+type GraphEdge struct {
+	From      string
+	To        string
+	Kind      string
+	Via       string `json:",omitempty"`
+	Highlight bool   `json:",omitempty"`
+}
+
+// Graph will build the topology from the same routes the
+// configs are rendered from, pending Peers are left out
+func (p Peers) Graph(links Links) Graph {
+	var g Graph
+	ids := map[string]string{}
+	for _, pr := range p {
+		if pr.Pending {
+			continue
+		}
+		ids[pr.Name] = "n" + strconv.Itoa(len(ids))
+		g.Nodes = append(g.Nodes, GraphNode{
+			ID:      ids[pr.Name],
+			Kind:    "node",
+			Name:    pr.Name,
+			Network: pr.Network,
+			Role:    pr.Role,
+			Tags:    pr.Tags,
+			Relay:   pr.Relay,
+		})
+	}
+	for _, r := range p.Routes(links) {
+		switch {
+		case r.Direct:
+			g.Edges = append(g.Edges, GraphEdge{From: ids[r.From], To: ids[r.To], Kind: EdgeDirect})
+		case r.Via != "":
+			g.Edges = append(g.Edges, GraphEdge{From: ids[r.From], To: ids[r.To], Kind: EdgeRelayed, Via: r.Via})
+		}
+	}
+	// a prefix announced by several gateways is a single leaf
+	subnets := map[string]string{}
+	for _, a := range p.Announcements() {
+		if _, ok := ids[a.Peer]; !ok {
+			continue
+		}
+		key := a.Network + "|" + a.Prefix
+		if subnets[key] == "" {
+			subnets[key] = "s" + strconv.Itoa(len(subnets))
+			g.Nodes = append(g.Nodes, GraphNode{ID: subnets[key], Kind: "subnet", Name: a.Prefix, Network: a.Network})
+		}
+		kind := EdgeGateway
+		if !a.Active {
+			kind = EdgeStandby
+		}
+		g.Edges = append(g.Edges, GraphEdge{From: ids[a.Peer], To: subnets[key], Kind: kind})
+	}
+	return g
+}
+
+// Highlight will mark the named node, its neighbours and
+// the edges between them
+func (g *Graph) Highlight(name string) error {
+	id := ""
+	for _, n := range g.Nodes {
+		if n.Kind == "node" && strings.EqualFold(n.Name, name) {
+			id = n.ID
+		}
+	}
+	if id == "" {
+		return fmt.Errorf("%s: %w", name, ErrPeerNotFound)
+	}
+	marked := map[string]bool{id: true}
+	for i, e := range g.Edges {
+		if e.From == id || e.To == id {
+			g.Edges[i].Highlight = true
+			marked[e.From], marked[e.To] = true, true
+		}
+	}
+	for i := range g.Nodes {
+		g.Nodes[i].Highlight = marked[g.Nodes[i].ID]
+	}
+	return nil
+}
+
+// highlighted will tell whether anything is highlighted
+func (g Graph) highlighted() bool {
+	for _, n := range g.Nodes {
+		if n.Highlight {
+			return true
+		}
+	}
+	return false
+}
+
+// label will return the text shown for a node
+func (n GraphNode) label() string {
+	l := n.Name
+	if n.Role != "" {
+		l += " (" + n.Role + ")"
+	}
+	if len(n.Tags) > 0 {
+		l += "\n" + strings.Join(n.Tags, ",")
+	}
+	return l
+}
+
+// WriteDOT will write the Graph in the Graphviz DOT language
+func (g Graph) WriteDOT(w io.Writer) error {
+	var b strings.Builder
+	dim := g.highlighted()
+	b.WriteString("graph mesh {\n")
+	b.WriteString("\tnode [shape=box, style=rounded];\n")
+	for _, n := range g.Nodes {
+		attrs := []string{"label=" + strconv.Quote(n.label())}
+		switch {
+		case n.Kind == "subnet":
+			attrs = append(attrs, "shape=note")
+		case n.Relay:
+			attrs = append(attrs, "shape=doubleoctagon")
+		}
+		if n.Highlight {
+			attrs = append(attrs, `style="rounded,filled,bold"`, `fillcolor="#ffdddd"`, `color="#cc0000"`)
+		} else if dim {
+			attrs = append(attrs, `color="#999999"`, `fontcolor="#999999"`)
+		}
+		fmt.Fprintf(&b, "\t%s [%s];\n", n.ID, strings.Join(attrs, ", "))
+	}
+	for _, e := range g.Edges {
+		var attrs []string
+		switch e.Kind {
+		case EdgeRelayed:
+			attrs = append(attrs, "style=dashed", "label="+strconv.Quote("via "+e.Via))
+		case EdgeStandby:
+			attrs = append(attrs, "style=dotted", `label="standby"`)
+		}
+		if e.Highlight {
+			attrs = append(attrs, `color="#cc0000"`, "penwidth=2")
+		} else if dim {
+			attrs = append(attrs, `color="#cccccc"`)
+		}
+		fmt.Fprintf(&b, "\t%s -- %s", e.From, e.To)
+		if len(attrs) > 0 {
+			fmt.Fprintf(&b, " [%s]", strings.Join(attrs, ", "))
+		}
+		b.WriteString(";\n")
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteMermaid will write the Graph as a Mermaid flowchart
+func (g Graph) WriteMermaid(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("graph LR\n")
+	var marked []string
+	for _, n := range g.Nodes {
+		label := strings.ReplaceAll(mermaidText(n.label()), "\n", "<br/>")
+		switch {
+		case n.Kind == "subnet":
+			fmt.Fprintf(&b, "    %s{{\"%s\"}}\n", n.ID, label)
+		case n.Relay:
+			fmt.Fprintf(&b, "    %s((\"%s\"))\n", n.ID, label)
+		default:
+			fmt.Fprintf(&b, "    %s[\"%s\"]\n", n.ID, label)
+		}
+		if n.Highlight {
+			marked = append(marked, n.ID)
+		}
+	}
+	var links []string
+	for i, e := range g.Edges {
+		switch e.Kind {
+		case EdgeRelayed:
+			fmt.Fprintf(&b, "    %s -.-|\"via %s\"| %s\n", e.From, mermaidText(e.Via), e.To)
+		case EdgeStandby:
+			fmt.Fprintf(&b, "    %s -.-|standby| %s\n", e.From, e.To)
+		default:
+			fmt.Fprintf(&b, "    %s --- %s\n", e.From, e.To)
+		}
+		if e.Highlight {
+			links = append(links, strconv.Itoa(i))
+		}
+	}
+	if len(marked) > 0 {
+		b.WriteString("    classDef highlight fill:#ffdddd,stroke:#cc0000,stroke-width:2px\n")
+		fmt.Fprintf(&b, "    class %s highlight\n", strings.Join(marked, ","))
+	}
+	if len(links) > 0 {
+		fmt.Fprintf(&b, "    linkStyle %s stroke:#cc0000,stroke-width:2px\n", strings.Join(links, ","))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// mermaidText will escape the characters Mermaid
+// does not take inside quoted labels
+func mermaidText(s string) string {
+	return strings.ReplaceAll(s, `"`, "#quot;")
+}
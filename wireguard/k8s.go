@@ -0,0 +1,181 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package wireguard
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// KubernetesOptions holds the settings used when
+// rendering configs as Kubernetes manifests
+type KubernetesOptions struct {
+	Namespace  string
+	Labels     map[string]string
+	NamePrefix string
+	Kustomize  bool
+}
+
+// KeyMountPath is where the private key Secret is expected
+// to be mounted inside the WireGuard container
+const KeyMountPath = "/etc/wireguard/privatekey"
+
+var k8sOptions KubernetesOptions
+
+var (
+	// dns1123Label is a namespace, or a label of an object name
+	dns1123Label = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+	// labelName is the name part of a label key, and a label value
+	labelName = regexp.MustCompile(`^[A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?$`)
+)
+
+// SetKubernetesOptions will set the options used by the k8s format,
+// it fails if they would not make valid object names and labels
+func SetKubernetesOptions(o KubernetesOptions) error {
+	if o.Namespace != "" && (len(o.Namespace) > 63 || !dns1123Label.MatchString(o.Namespace)) {
+		return fmt.Errorf("namespace %q is not a valid DNS-1123 label", o.Namespace)
+	}
+	// the prefix is followed by the node name, it may end with a dash
+	if o.NamePrefix != "" && !isDNS1123Subdomain(o.NamePrefix+"x") {
+		return fmt.Errorf("name prefix %q does not make valid DNS-1123 names", o.NamePrefix)
+	}
+	for k, v := range o.Labels {
+		if err := validLabel(k, v); err != nil {
+			return err
+		}
+	}
+	k8sOptions = o
+	return nil
+}
+
+// isDNS1123Subdomain will tell whether s can name a Secret or a ConfigMap
+func isDNS1123Subdomain(s string) bool {
+	if len(s) > 253 {
+		return false
+	}
+	for _, l := range strings.Split(s, ".") {
+		if len(l) > 63 || !dns1123Label.MatchString(l) {
+			return false
+		}
+	}
+	return true
+}
+
+// validLabel will fail if k is not a label key, an optional DNS-1123
+// prefix and a name, or v not a label value
+func validLabel(k, v string) error {
+	name := k
+	if prefix, n, ok := strings.Cut(k, "/"); ok {
+		if !isDNS1123Subdomain(prefix) {
+			return fmt.Errorf("label %q: prefix is not a valid DNS-1123 subdomain", k)
+		}
+		name = n
+	}
+	if len(name) > 63 || !labelName.MatchString(name) {
+		return fmt.Errorf("label %q: invalid key", k)
+	}
+	if len(v) > 63 || (v != "" && !labelName.MatchString(v)) {
+		return fmt.Errorf("label %q: invalid value %q", k, v)
+	}
+	return nil
+}
+
+type k8sMetadata struct {
+	Name      string            `yaml:"name"`
+	Namespace string            `yaml:"namespace,omitempty"`
+	Labels    map[string]string `yaml:"labels,omitempty"`
+}
+
+type k8sObject struct {
+	APIVersion string            `yaml:"apiVersion"`
+	Kind       string            `yaml:"kind"`
+	Metadata   k8sMetadata       `yaml:"metadata"`
+	Type       string            `yaml:"type,omitempty"`
+	StringData map[string]string `yaml:"stringData,omitempty"`
+	Data       map[string]string `yaml:"data,omitempty"`
+}
+
+type kustomization struct {
+	APIVersion string   `yaml:"apiVersion"`
+	Kind       string   `yaml:"kind"`
+	Namespace  string   `yaml:"namespace,omitempty"`
+	Resources  []string `yaml:"resources"`
+}
+
+// kubernetesManifests will render the config as a Secret holding the
+// private key and a ConfigMap holding everything else
+func kubernetesManifests(c Config) ([]byte, error) {
+	name := dnsLabel(c.Name)
+	if name == "" || !isDNS1123Subdomain(k8sOptions.NamePrefix+name) {
+		return nil, fmt.Errorf("%s: %q is not a valid object name", c.Name, k8sOptions.NamePrefix+name)
+	}
+	labels := map[string]string{"app.kubernetes.io/name": "gomesh", "gomesh/node": name}
+	for k, v := range k8sOptions.Labels {
+		labels[k] = v
+	}
+
+	secret := k8sObject{
+		APIVersion: "v1",
+		Kind:       "Secret",
+		Metadata:   k8sMetadata{Name: k8sOptions.NamePrefix + name, Namespace: k8sOptions.Namespace, Labels: labels},
+		Type:       "Opaque",
+		StringData: map[string]string{"privatekey": c.Interface.PrivateKey},
+	}
+	configMap := k8sObject{
+		APIVersion: "v1",
+		Kind:       "ConfigMap",
+		Metadata:   k8sMetadata{Name: k8sOptions.NamePrefix + name, Namespace: k8sOptions.Namespace, Labels: labels},
+		Data:       map[string]string{name + ".conf": c.WithKeyFile(KeyMountPath).String()},
+	}
+
+	return encodeYAML(secret, configMap)
+}
+
+// kustomizationFile will render a kustomization.yaml
+// referencing the given manifest files
+func kustomizationFile(files []string) ([]byte, error) {
+	return encodeYAML(kustomization{
+		APIVersion: "kustomize.config.k8s.io/v1beta1",
+		Kind:       "Kustomization",
+		Namespace:  k8sOptions.Namespace,
+		Resources:  files,
+	})
+}
+
+func encodeYAML(docs ...interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	for _, d := range docs {
+		if err := enc.Encode(d); err != nil {
+			return nil, err
+		}
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
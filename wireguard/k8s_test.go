@@ -0,0 +1,184 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package wireguard
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// k8sFormat will switch to the k8s format with o
+// until the end of the test
+func k8sFormat(t *testing.T, o KubernetesOptions) {
+	t.Helper()
+	if err := SetKubernetesOptions(o); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetFormat("k8s"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		k8sOptions = KubernetesOptions{}
+		outputFormat = "wg-quick"
+	})
+}
+
+// decodeYAML will decode every document of the file
+func decodeYAML(t *testing.T, path string) []map[string]interface{} {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var docs []map[string]interface{}
+	dec := yaml.NewDecoder(f)
+	for {
+		var d map[string]interface{}
+		err := dec.Decode(&d)
+		if errors.Is(err, io.EOF) {
+			return docs
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		docs = append(docs, d)
+	}
+}
+
+func TestKubernetesManifests(t *testing.T) {
+	tempRegistry(t)
+	k8sFormat(t, KubernetesOptions{
+		Namespace:  "mesh",
+		Labels:     map[string]string{"team": "infra", "example.com/tier": "edge"},
+		NamePrefix: "wg-",
+		Kustomize:  true,
+	})
+	p := Peers{
+		{Name: "Web_1", Address: []string{"10.0.0.1/24"}, Endpoint: "web1.example.com", ListenPort: 51820, PrivateKey: mustKey(t)},
+		{Name: "db1", Address: []string{"10.0.0.2/24"}, Endpoint: "db1.example.com", ListenPort: 51820, PrivateKey: mustKey(t)},
+	}
+	dir := t.TempDir()
+	if err := p.GenerateConfigs(dir, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	docs := decodeYAML(t, filepath.Join(dir, "web-1.yaml"))
+	if len(docs) != 2 {
+		t.Fatalf("got %d documents", len(docs))
+	}
+	labels := map[string]interface{}{
+		"app.kubernetes.io/name": "gomesh",
+		"gomesh/node":            "web-1",
+		"team":                   "infra",
+		"example.com/tier":       "edge",
+	}
+	metadata := map[string]interface{}{"name": "wg-web-1", "namespace": "mesh", "labels": labels}
+	secret, configMap := docs[0], docs[1]
+	if secret["apiVersion"] != "v1" || secret["kind"] != "Secret" || secret["type"] != "Opaque" {
+		t.Errorf("secret: %v", secret)
+	}
+	if !reflect.DeepEqual(secret["metadata"], metadata) {
+		t.Errorf("secret metadata: %v", secret["metadata"])
+	}
+	if !reflect.DeepEqual(secret["stringData"], map[string]interface{}{"privatekey": p[0].PrivateKey}) {
+		t.Errorf("secret data: %v", secret["stringData"])
+	}
+
+	if configMap["apiVersion"] != "v1" || configMap["kind"] != "ConfigMap" {
+		t.Errorf("configmap: %v", configMap)
+	}
+	if !reflect.DeepEqual(configMap["metadata"], metadata) {
+		t.Errorf("configmap metadata: %v", configMap["metadata"])
+	}
+	data, _ := configMap["data"].(map[string]interface{})
+	conf, _ := data["web-1.conf"].(string)
+	if !strings.Contains(conf, "PostUp = wg set %i private-key "+KeyMountPath+"\n") || !strings.Contains(conf, "Endpoint = db1.example.com:51820\n") {
+		t.Errorf("config:\n%s", conf)
+	}
+	if strings.Contains(conf, "PrivateKey") || strings.Contains(conf, p[0].PrivateKey) {
+		t.Errorf("the private key is in the ConfigMap:\n%s", conf)
+	}
+
+	docs = decodeYAML(t, filepath.Join(dir, "kustomization.yaml"))
+	want := map[string]interface{}{
+		"apiVersion": "kustomize.config.k8s.io/v1beta1",
+		"kind":       "Kustomization",
+		"namespace":  "mesh",
+		"resources":  []interface{}{"web-1.yaml", "db1.yaml"},
+	}
+	if len(docs) != 1 || !reflect.DeepEqual(docs[0], want) {
+		t.Errorf("kustomization: %v", docs)
+	}
+}
+
+func TestSetKubernetesOptions(t *testing.T) {
+	t.Cleanup(func() { k8sOptions = KubernetesOptions{} })
+	tests := []struct {
+		name string
+		o    KubernetesOptions
+		ok   bool
+	}{
+		{"none", KubernetesOptions{}, true},
+		{"valid", KubernetesOptions{Namespace: "mesh-1", NamePrefix: "prod.wg-", Labels: map[string]string{"app.kubernetes.io/part-of": "mesh", "Tier": "Edge_1", "empty": ""}}, true},
+		{"namespace with dots", KubernetesOptions{Namespace: "mesh.prod"}, false},
+		{"uppercase namespace", KubernetesOptions{Namespace: "Mesh"}, false},
+		{"uppercase prefix", KubernetesOptions{NamePrefix: "WG-"}, false},
+		{"prefix with underscore", KubernetesOptions{NamePrefix: "wg_"}, false},
+		{"prefix starting with a dash", KubernetesOptions{NamePrefix: "-wg"}, false},
+		{"long prefix", KubernetesOptions{NamePrefix: strings.Repeat("a", 64)}, false},
+		{"label key", KubernetesOptions{Labels: map[string]string{"team!": "infra"}}, false},
+		{"label key prefix", KubernetesOptions{Labels: map[string]string{"Example.com/team": "infra"}}, false},
+		{"empty label name", KubernetesOptions{Labels: map[string]string{"example.com/": "infra"}}, false},
+		{"label value", KubernetesOptions{Labels: map[string]string{"team": "infra ops"}}, false},
+		{"long label value", KubernetesOptions{Labels: map[string]string{"team": strings.Repeat("a", 64)}}, false},
+		{"label value ending with a dot", KubernetesOptions{Labels: map[string]string{"team": "infra."}}, false},
+	}
+	kept := KubernetesOptions{Namespace: "kept"}
+	for _, tt := range tests {
+		k8sOptions = kept
+		err := SetKubernetesOptions(tt.o)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got %v", tt.name, err)
+		}
+		if err != nil && !reflect.DeepEqual(k8sOptions, kept) {
+			t.Errorf("%s: invalid options were set", tt.name)
+		}
+	}
+}
+
+func TestKubernetesManifestsName(t *testing.T) {
+	k8sFormat(t, KubernetesOptions{NamePrefix: strings.Repeat("a", 60) + "."})
+	if _, err := kubernetesManifests(Config{Name: strings.Repeat("b", 63)}); err != nil {
+		t.Errorf("valid name: %v", err)
+	}
+	if _, err := kubernetesManifests(Config{Name: "--"}); err == nil {
+		t.Error("a name without a DNS label was rendered")
+	}
+}
@@ -23,6 +23,12 @@ THE SOFTWARE.
 package wireguard
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
@@ -47,3 +53,47 @@ func PublicKey(a string) (string, error) {
 	}
 	return k.PublicKey().String(), nil
 }
+
+// Fingerprint will return the SHA256 fingerprint of a base64
+// encoded public key, for humans to compare
+func Fingerprint(public string) (string, error) {
+	k, err := wgtypes.ParseKey(public)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(k[:])
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:]), nil
+}
+
+// SharedKey will return the X25519 shared secret of a base64
+// encoded private key and a base64 encoded public key
+func SharedKey(private, public string) ([]byte, error) {
+	priv, err := wgtypes.ParseKey(private)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := wgtypes.ParseKey(public)
+	if err != nil {
+		return nil, err
+	}
+	return curve25519.X25519(priv[:], pub[:])
+}
+
+// LoadOrCreateKey will read a base64 encoded private key from
+// path, creating the file with a new key if it does not exist
+func LoadOrCreateKey(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err == nil {
+		k := strings.TrimSpace(string(b))
+		_, err = wgtypes.ParseKey(k)
+		return k, err
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	k, err := GenerateKey()
+	if err != nil {
+		return "", err
+	}
+	return k, os.WriteFile(path, []byte(k+"\n"), 0600)
+}
@@ -0,0 +1,147 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package wireguard
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Link holds what is known about the path between two Peers
+type Link struct {
+	// A and B are the names of the Peers, A sorts first
+	A string
+	B string
+	// NoDirect marks pairs that cannot have a tunnel of their own,
+	// their traffic goes through a relay
+	NoDirect bool `json:",omitempty"`
+	// Weight is the cost of the Link in the routed mode,
+	// derived from the probes when zero
+	Weight int `json:",omitempty"`
+	// Disabled links get no tunnel, their traffic
+	// goes through a relay if there is one
+	Disabled bool `json:",omitempty"`
+	// Keepalive is the PersistentKeepalive of both ends,
+	// the settings of the Peers apply when zero
+	Keepalive int `json:",omitempty"`
+	// Endpoints hold, by the name of the Peer using it, the
+	// endpoint it reaches the other end on, overriding the
+	// one it would be given otherwise
+	Endpoints map[string]string `json:",omitempty"`
+	// MTU of the tunnel of the Link in the routed mode
+	MTU   int    `json:",omitempty"`
+	Notes string `json:",omitempty"`
+	// Probes are the latest measurements of each direction
+	Probes []Probe `json:",omitempty"`
+}
+
+// Links are the links known to the registry, pairs
+// without a Link have nothing special about them
+type Links []Link
+
+// LoadLinks will load the links kept next to the registry
+func LoadLinks() (Links, error) {
+	var l Links
+	return l, loadSidecar("links.json", &l)
+}
+
+// DumpLinks will write the links next to the registry
+func (l Links) DumpLinks() error {
+	return dumpSidecar("links.json", l)
+}
+
+// Get will return the Link between a and b,
+// an empty one if there is nothing known about it
+func (l Links) Get(a, b string) Link {
+	if i := l.index(a, b); i >= 0 {
+		return l[i]
+	}
+	a, b = linkKey(a, b)
+	return Link{A: a, B: b}
+}
+
+// Set will record the Link between its two Peers
+func (l *Links) Set(ln Link) error {
+	ln.A, ln.B = linkKey(ln.A, ln.B)
+	endpoints := map[string]string{}
+	for from, ep := range ln.Endpoints {
+		from = strings.ToLower(from)
+		if from != ln.A && from != ln.B {
+			return fmt.Errorf("%s is not an end of the link between %s and %s", from, ln.A, ln.B)
+		}
+		if ep == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(ep); err != nil {
+			return fmt.Errorf("invalid endpoint %q: %v", ep, err)
+		}
+		endpoints[from] = ep
+	}
+	ln.Endpoints = nil
+	if len(endpoints) > 0 {
+		ln.Endpoints = endpoints
+	}
+	if i := l.index(ln.A, ln.B); i >= 0 {
+		(*l)[i] = ln
+	} else {
+		*l = append(*l, ln)
+	}
+	return l.DumpLinks()
+}
+
+func (l Links) index(a, b string) int {
+	a, b = linkKey(a, b)
+	for i := range l {
+		if strings.EqualFold(l[i].A, a) && strings.EqualFold(l[i].B, b) {
+			return i
+		}
+	}
+	return -1
+}
+
+// endpoint will return the endpoint from reaches to on,
+// the override of their Link if there is one
+func (l Links) endpoint(from, to Peer) string {
+	if ep := l.Get(from.Name, to.Name).Endpoints[strings.ToLower(from.Name)]; ep != "" {
+		return ep
+	}
+	return endpoint(from, to)
+}
+
+// keepalive will return the PersistentKeepalive from uses
+// towards to, the one of their Link if set
+func (l Links) keepalive(from, to Peer) int {
+	if k := l.Get(from.Name, to.Name).Keepalive; k != 0 {
+		return k
+	}
+	return keepalive(from, to)
+}
+
+// linkKey will return the names of a pair in a stable order
+func linkKey(a, b string) (string, string) {
+	a, b = strings.ToLower(a), strings.ToLower(b)
+	if b < a {
+		return b, a
+	}
+	return a, b
+}
@@ -0,0 +1,299 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package wireguard
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// meshConfColumns are the columns of a wg-meshconf database.csv
+var meshConfColumns = []string{"Name", "Address", "Endpoint", "AllowedIPs", "ListenPort", "PersistentKeepalive", "FwMark", "PrivateKey", "DNS", "MTU", "Table", "PreUp", "PostUp", "PreDown", "PostDown", "SaveConfig"}
+
+// ReadMeshConf will read Peers from a wg-meshconf database.csv,
+// columns gomesh does not know about are kept in Peer.Extra
+func ReadMeshConf(r io.Reader) (Peers, error) {
+	cr := csv.NewReader(r)
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	header := records[0]
+	var p Peers
+	for n, record := range records[1:] {
+		var pr Peer
+		for i, col := range header {
+			v := strings.TrimSpace(record[i])
+			if err := pr.setMeshConf(col, v); err != nil {
+				return nil, fmt.Errorf("line %d: %s: %v", n+2, col, err)
+			}
+		}
+		if pr.Name == "" {
+			return nil, fmt.Errorf("line %d: missing Name", n+2)
+		}
+		p = append(p, pr)
+	}
+	return p, nil
+}
+
+func (pr *Peer) setMeshConf(col, v string) error {
+	var err error
+	switch col {
+	case "Name":
+		pr.Name = v
+	case "Address":
+		pr.Address = splitCell(v)
+	case "Endpoint":
+		pr.Endpoint = v
+	case "AllowedIPs":
+		pr.AllowedIPs = splitCell(v)
+	case "ListenPort":
+		pr.ListenPort, err = atoiCell(v)
+	case "PersistentKeepalive":
+		pr.PersistentKeepalive, err = atoiCell(v)
+	case "FwMark":
+		pr.FwMark, err = atoiCell(v)
+	case "PrivateKey":
+		pr.PrivateKey = v
+	case "DNS":
+		pr.DNS = v
+	case "MTU":
+		pr.MTU, err = atoiCell(v)
+	case "Table":
+		pr.Table = v
+	case "PreUp":
+		pr.PreUp = v
+	case "PostUp":
+		pr.PostUp = v
+	case "PreDown":
+		pr.PreDown = v
+	case "PostDown":
+		pr.PostDown = v
+	case "SaveConfig":
+		if v != "" {
+			pr.SaveConfig, err = strconv.ParseBool(strings.ToLower(v))
+		}
+	case "Role":
+		pr.Role = v
+	case "Tags":
+		pr.Tags = splitCell(v)
+	default:
+		if pr.Extra == nil {
+			pr.Extra = map[string]string{}
+		}
+		pr.Extra[col] = v
+	}
+	return err
+}
+
+// WriteMeshConf will write the Peers as a wg-meshconf database.csv,
+// Role and Tags as well as any Extra attributes are written as
+// additional columns after the wg-meshconf ones
+func (p Peers) WriteMeshConf(w io.Writer) error {
+	header := append([]string{}, meshConfColumns...)
+	var hasRole, hasTags bool
+	extra := map[string]bool{}
+	for _, pr := range p {
+		hasRole = hasRole || pr.Role != ""
+		hasTags = hasTags || len(pr.Tags) > 0
+		for k := range pr.Extra {
+			extra[k] = true
+		}
+	}
+	if hasRole {
+		header = append(header, "Role")
+	}
+	if hasTags {
+		header = append(header, "Tags")
+	}
+	var extraCols []string
+	for k := range extra {
+		extraCols = append(extraCols, k)
+	}
+	sort.Strings(extraCols)
+	header = append(header, extraCols...)
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, pr := range p {
+		record := make([]string, len(header))
+		for i, col := range header {
+			record[i] = pr.meshConf(col)
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func (pr Peer) meshConf(col string) string {
+	switch col {
+	case "Name":
+		return pr.Name
+	case "Address":
+		return strings.Join(pr.Address, ",")
+	case "Endpoint":
+		return pr.Endpoint
+	case "AllowedIPs":
+		return strings.Join(pr.AllowedIPs, ",")
+	case "ListenPort":
+		return itoaCell(pr.ListenPort)
+	case "PersistentKeepalive":
+		return itoaCell(pr.PersistentKeepalive)
+	case "FwMark":
+		return itoaCell(pr.FwMark)
+	case "PrivateKey":
+		return pr.PrivateKey
+	case "DNS":
+		return pr.DNS
+	case "MTU":
+		return itoaCell(pr.MTU)
+	case "Table":
+		return pr.Table
+	case "PreUp":
+		return pr.PreUp
+	case "PostUp":
+		return pr.PostUp
+	case "PreDown":
+		return pr.PreDown
+	case "PostDown":
+		return pr.PostDown
+	case "SaveConfig":
+		if pr.SaveConfig {
+			return "True"
+		}
+		return ""
+	case "Role":
+		return pr.Role
+	case "Tags":
+		return strings.Join(pr.Tags, ",")
+	default:
+		return pr.Extra[col]
+	}
+}
+
+// splitCell will split a multi-value cell, wg-meshconf
+// separates the values with commas
+func splitCell(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// atoiCell treats an empty cell as zero
+func atoiCell(v string) (int, error) {
+	if v == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(v)
+}
+
+// itoaCell writes zero as an empty cell
+func itoaCell(i int) string {
+	if i == 0 {
+		return ""
+	}
+	return strconv.Itoa(i)
+}
+
+// mergeMeshConf will update the Peer with what a wg-meshconf row
+// carries, keeping the fields the registry alone knows about
+func (pr *Peer) mergeMeshConf(in Peer) {
+	key, created := pr.PrivateKey, pr.KeyCreated
+	for _, col := range meshConfColumns {
+		pr.setMeshConf(col, in.meshConf(col))
+	}
+	// a row without a key keeps the registered one
+	if in.PrivateKey == "" {
+		pr.PrivateKey = key
+	} else if in.PrivateKey != key {
+		now := time.Now().UTC()
+		pr.PublicKey, created = "", &now
+	}
+	pr.KeyCreated = created
+	// Role and Tags are optional columns
+	if in.Role != "" {
+		pr.Role = in.Role
+	}
+	if len(in.Tags) > 0 {
+		pr.Tags = in.Tags
+	}
+	for k, v := range in.Extra {
+		if pr.Extra == nil {
+			pr.Extra = map[string]string{}
+		}
+		pr.Extra[k] = v
+	}
+}
+
+// Import will add the given Peers to the register, updating registered
+// Peers with the same name with the fields of the wg-meshconf format
+// only. They are checked like added ones and nothing is imported if
+// any of them is invalid
+func (p *Peers) Import(in Peers) error {
+	next := append(Peers{}, *p...)
+	for _, row := range in {
+		pr := row
+		i := next.index(row.Name)
+		if i >= 0 {
+			pr = next[i]
+			pr.mergeMeshConf(row)
+		}
+		if pr.PrivateKey == "" && pr.PublicKey == "" {
+			k, err := GenerateKey()
+			if err != nil {
+				return err
+			}
+			pr.PrivateKey = k
+		}
+		if _, err := pr.Public(); err != nil {
+			return fmt.Errorf("peer %s: invalid private key: %v", pr.Name, err)
+		}
+		if err := next.validate(&pr); err != nil {
+			return err
+		}
+		if i >= 0 {
+			next[i] = pr
+		} else {
+			next = append(next, pr)
+		}
+	}
+	*p = next
+	return p.DumpPeers(true)
+}
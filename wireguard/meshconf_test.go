@@ -0,0 +1,193 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package wireguard
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMeshConfRoundTrip(t *testing.T) {
+	key, _ := GenerateKey()
+	in := Peers{
+		{Name: "web1", Address: []string{"10.0.0.2/32", "fd00::2/128"}, Endpoint: "web1.example.com", ListenPort: 51820,
+			AllowedIPs: []string{"192.168.1.0/24"}, PersistentKeepalive: 25, FwMark: 42, PrivateKey: key, DNS: "10.0.0.1",
+			MTU: 1420, Table: "off", PreUp: "echo pre", PostUp: "echo up", PreDown: "echo predown", PostDown: "echo down",
+			SaveConfig: true, Role: "web", Tags: []string{"prod", "web"}, Extra: map[string]string{"Owner": "ops"}},
+		{Name: "db1", Address: []string{"10.0.0.3/32"}, ListenPort: 51821, PrivateKey: key},
+	}
+	var b bytes.Buffer
+	if err := in.WriteMeshConf(&b); err != nil {
+		t.Fatal(err)
+	}
+	header := strings.SplitN(b.String(), "\n", 2)[0]
+	if !strings.HasPrefix(header, strings.Join(meshConfColumns, ",")) || !strings.HasSuffix(header, ",Role,Tags,Owner") {
+		t.Errorf("header %q", header)
+	}
+	out, err := ReadMeshConf(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// db1 has no extra attributes, an empty Owner cell is kept
+	in[1].Extra = map[string]string{"Owner": ""}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("got\n%+v\nexpected\n%+v", out, in)
+	}
+}
+
+func TestReadMeshConfErrors(t *testing.T) {
+	tests := map[string]string{
+		"missing name": "Name,Address\n,10.0.0.2/32\n",
+		"bad port":     "Name,ListenPort\na,http\n",
+		"short line":   "Name,Address\na\n",
+	}
+	for name, csv := range tests {
+		if _, err := ReadMeshConf(strings.NewReader(csv)); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestImport(t *testing.T) {
+	tests := []struct {
+		name string
+		in   Peer
+		ok   bool
+	}{
+		{"valid", Peer{Name: "c", Address: []string{"10.0.0.3/32"}}, true},
+		{"replaces", Peer{Name: "A", Address: []string{"10.0.0.9/32"}}, true},
+		{"dns collision", Peer{Name: "b.", Address: []string{"10.0.0.4/32"}}, false},
+		{"bad address", Peer{Name: "d", Address: []string{"10.0.0"}}, false},
+		{"bad allowed ips", Peer{Name: "d", Address: []string{"10.0.0.4/32"}, AllowedIPs: []string{"lan"}}, false},
+		{"bad nat", Peer{Name: "d", Address: []string{"10.0.0.4/32"}, NAT: "full"}, false},
+		{"bad type", Peer{Name: "d", Address: []string{"10.0.0.4/32"}, Type: "phone"}, false},
+		{"roaming with endpoint", Peer{Name: "d", Address: []string{"10.0.0.4/32"}, Type: TypeRoaming, Endpoint: "d.example.com"}, false},
+		{"endpoint with port", Peer{Name: "d", Address: []string{"10.0.0.4/32"}, Endpoint: "d.example.com:51820"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempRegistry(t)
+			p := Peers{
+				{Name: "a", Address: []string{"10.0.0.1/32"}, PrivateKey: mustKey(t)},
+				{Name: "b", Address: []string{"10.0.0.2/32"}, PrivateKey: mustKey(t)},
+			}
+			err := p.Import(Peers{{Name: "e", Address: []string{"10.0.0.5/32"}}, tt.in})
+			if tt.ok != (err == nil) {
+				t.Fatalf("got %v", err)
+			}
+			if !tt.ok {
+				if len(p) != 2 {
+					t.Errorf("%d peers after a failed import", len(p))
+				}
+				return
+			}
+			if len(p) != 3 && len(p) != 4 {
+				t.Errorf("%d peers", len(p))
+			}
+			if _, err := p.Get("e"); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestImportNormalizes(t *testing.T) {
+	tempRegistry(t)
+	var p Peers
+	in := Peers{{Name: "a", Address: []string{" 10.0.0.1/24", "FD00:0::1"}, AllowedIPs: []string{"192.168.1.7/24", "10.1.1.1"}, Endpoint: "[2001:DB8::1]"}}
+	if err := p.Import(in); err != nil {
+		t.Fatal(err)
+	}
+	want := Peer{Address: []string{"10.0.0.1/24", "fd00::1/128"}, AllowedIPs: []string{"192.168.1.0/24", "10.1.1.1/32"}, Endpoint: "2001:db8::1"}
+	if got := p[0]; !reflect.DeepEqual(got.Address, want.Address) || !reflect.DeepEqual(got.AllowedIPs, want.AllowedIPs) || got.Endpoint != want.Endpoint {
+		t.Errorf("got %v %v %s", got.Address, got.AllowedIPs, got.Endpoint)
+	}
+}
+
+func TestImportKeepsRegistryFields(t *testing.T) {
+	tempRegistry(t)
+	own, err := PublicKey(mustKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	joined := &JoinInfo{Requested: created, TokenID: "t1", RemoteAddr: "192.0.2.7"}
+	p := Peers{
+		{Name: "gw1", Network: "prod", Address: []string{"10.0.0.1/24"}, Endpoint: "gw1.example.com", ListenPort: 51820,
+			PrivateKey: mustKey(t), KeyCreated: &created, Role: "gateway", Type: TypeServer,
+			Subnets: []Subnet{{Prefix: "192.168.10.0/24", Masquerade: true}}},
+		{Name: "laptop1", Network: "prod", Address: []string{"10.0.0.2/24"}, PublicKey: own, KeyCreated: &created,
+			Pending: true, Join: joined, Subnets: []Subnet{{Prefix: "192.168.20.0/24", Standby: true}}},
+	}
+	before := append(Peers{}, p...)
+
+	// export, change what the format carries and import again
+	var b bytes.Buffer
+	if err := p.WriteMeshConf(&b); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := ReadMeshConf(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows[0].MTU = 1380
+	rows[1].Endpoint = "laptop1.example.com"
+	if err = p.Import(rows); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, got := range p {
+		want := before[i]
+		if got.Network != want.Network || got.Pending != want.Pending || !reflect.DeepEqual(got.Join, want.Join) ||
+			!reflect.DeepEqual(got.Subnets, want.Subnets) || !reflect.DeepEqual(got.KeyCreated, want.KeyCreated) ||
+			got.Type != want.Type || got.Role != want.Role || got.PublicKey != want.PublicKey || got.PrivateKey != want.PrivateKey {
+			t.Errorf("%s: got\n%+v\nexpected\n%+v", want.Name, got, want)
+		}
+	}
+	if p[0].MTU != 1380 || p[1].Endpoint != "laptop1.example.com" {
+		t.Errorf("imported fields were not updated: %d %s", p[0].MTU, p[1].Endpoint)
+	}
+	if len(p.PendingPeers()) != 1 {
+		t.Error("importing approved the pending node")
+	}
+
+	// a new key in the file is a new key
+	rows[0].PrivateKey = mustKey(t)
+	if err = p.Import(rows[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if p[0].PrivateKey != rows[0].PrivateKey || p[0].KeyCreated.Equal(created) {
+		t.Errorf("key %s created %v", p[0].PrivateKey, p[0].KeyCreated)
+	}
+}
+
+func mustKey(t *testing.T) string {
+	t.Helper()
+	k, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
@@ -0,0 +1,215 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package wireguard
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// Network is a group of Peers sharing an address range,
+// Peers only see the Peers of their own network
+type Network struct {
+	Name   string
+	Prefix string
+	// Prefix6 is the IPv6 prefix of a dual-stack network,
+	// Peers get an address from each prefix
+	Prefix6 string `json:",omitempty"`
+	// RequireApproval keeps joining Peers pending
+	// until an admin approves them
+	RequireApproval bool `json:",omitempty"`
+	// DNS is used by the Peers of the network that have no
+	// DNS of their own, like the address of the mesh DNS server
+	DNS string `json:",omitempty"`
+}
+
+// Networks are the networks known to the registry
+type Networks []Network
+
+// ErrNetworkNotFound is returned when the named Network does not exist
+var ErrNetworkNotFound = errors.New("network not found")
+
+// LoadNetworks will load the networks kept next to the registry
+func LoadNetworks() (Networks, error) {
+	var n Networks
+	return n, loadSidecar("networks.json", &n)
+}
+
+// DumpNetworks will write the networks next to the registry
+func (n Networks) DumpNetworks() error {
+	return dumpSidecar("networks.json", n)
+}
+
+// AddNetwork will add a Network
+func (n *Networks) AddNetwork(nw Network) error {
+	if err := nw.normalize(); err != nil {
+		return err
+	}
+	if _, err := n.Get(nw.Name); err == nil {
+		return fmt.Errorf("network %s already exists", nw.Name)
+	}
+	*n = append(*n, nw)
+	return n.DumpNetworks()
+}
+
+// UpdateNetwork will replace the Network of the same name
+func (n *Networks) UpdateNetwork(nw Network) error {
+	if err := nw.normalize(); err != nil {
+		return err
+	}
+	for i := range *n {
+		if strings.EqualFold((*n)[i].Name, nw.Name) {
+			(*n)[i] = nw
+			return n.DumpNetworks()
+		}
+	}
+	return fmt.Errorf("%s: %w", nw.Name, ErrNetworkNotFound)
+}
+
+// DeleteNetwork will delete the named Network
+func (n *Networks) DeleteNetwork(name string) error {
+	for i := range *n {
+		if strings.EqualFold((*n)[i].Name, name) {
+			*n = append((*n)[:i], (*n)[i+1:]...)
+			return n.DumpNetworks()
+		}
+	}
+	return fmt.Errorf("%s: %w", name, ErrNetworkNotFound)
+}
+
+// Get will return the named Network
+func (n Networks) Get(name string) (Network, error) {
+	for _, nw := range n {
+		if strings.EqualFold(nw.Name, name) {
+			return nw, nil
+		}
+	}
+	return Network{}, fmt.Errorf("%s: %w", name, ErrNetworkNotFound)
+}
+
+// Prefixes will return the prefixes of the Network,
+// the IPv4 one first
+func (nw Network) Prefixes() ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range []string{nw.Prefix, nw.Prefix6} {
+		if s == "" {
+			continue
+		}
+		pfx, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("network %s: %v", nw.Name, err)
+		}
+		prefixes = append(prefixes, pfx.Masked())
+	}
+	switch {
+	case len(prefixes) == 0:
+		return nil, fmt.Errorf("network %s has no prefix", nw.Name)
+	case nw.Prefix6 != "" && !prefixes[len(prefixes)-1].Addr().Is6():
+		return nil, fmt.Errorf("network %s: %s is not an IPv6 prefix", nw.Name, nw.Prefix6)
+	case len(prefixes) == 2 && !prefixes[0].Addr().Is4():
+		return nil, fmt.Errorf("network %s: the prefix of a dual-stack network must be IPv4", nw.Name)
+	}
+	return prefixes, nil
+}
+
+// normalize will check the prefixes of the Network
+// and write them in canonical form
+func (nw *Network) normalize() error {
+	prefixes, err := nw.Prefixes()
+	if err != nil {
+		return err
+	}
+	if nw.Prefix != "" {
+		nw.Prefix = prefixes[0].String()
+	}
+	if nw.Prefix6 != "" {
+		nw.Prefix6 = prefixes[len(prefixes)-1].String()
+	}
+	return nil
+}
+
+// Allocate will return the first host address of each prefix
+// of the Network that none of the Peers uses
+func (p Peers) Allocate(nw Network) ([]string, error) {
+	prefixes, err := nw.Prefixes()
+	if err != nil {
+		return nil, err
+	}
+	used := map[netip.Addr]bool{}
+	for _, pr := range p {
+		for _, a := range pr.Addrs() {
+			used[a] = true
+		}
+	}
+
+	var addresses []string
+	for _, pfx := range prefixes {
+		a, ok := allocate(pfx, used)
+		if !ok {
+			return nil, fmt.Errorf("network %s is full", nw.Name)
+		}
+		addresses = append(addresses, netip.PrefixFrom(a, a.BitLen()).String())
+	}
+	return addresses, nil
+}
+
+// allocate will return the first unused host address of pfx
+func allocate(pfx netip.Prefix, used map[netip.Addr]bool) (netip.Addr, bool) {
+	// the first address is the network itself
+	for a := pfx.Addr().Next(); pfx.Contains(a); a = a.Next() {
+		if a.Is4() && pfx.Bits() < 31 && !pfx.Contains(a.Next()) {
+			// the IPv4 broadcast address
+			break
+		}
+		if !used[a] {
+			return a, true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// loadSidecar will decode a JSON file kept next to the registry,
+// a missing file leaves v untouched
+func loadSidecar(suffix string, v interface{}) error {
+	f, err := os.Open(SidecarPath(suffix))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewDecoder(f).Decode(v)
+}
+
+// dumpSidecar will write v as JSON next to the registry
+func dumpSidecar(suffix string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(SidecarPath(suffix), b, 0600)
+}
@@ -0,0 +1,116 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package wireguard
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNetworkPrefixes(t *testing.T) {
+	tests := []struct {
+		name string
+		nw   Network
+		want Network
+		err  bool
+	}{
+		{name: "ipv4", nw: Network{Prefix: "10.0.0.7/24"}, want: Network{Prefix: "10.0.0.0/24"}},
+		{name: "ipv6 only", nw: Network{Prefix: "FD00::/48"}, want: Network{Prefix: "fd00::/48"}},
+		{name: "dual-stack", nw: Network{Prefix: "10.0.0.0/24", Prefix6: "fd00:1::/48"}, want: Network{Prefix: "10.0.0.0/24", Prefix6: "fd00:1::/48"}},
+		{name: "ipv6 in Prefix6 only", nw: Network{Prefix6: "fd00:1::/48"}, want: Network{Prefix6: "fd00:1::/48"}},
+		{name: "none", nw: Network{}, err: true},
+		{name: "bad prefix", nw: Network{Prefix: "10.0.0.0"}, err: true},
+		{name: "ipv4 Prefix6", nw: Network{Prefix: "10.0.0.0/24", Prefix6: "10.1.0.0/24"}, err: true},
+		{name: "two ipv6", nw: Network{Prefix: "fd00::/48", Prefix6: "fd01::/48"}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nw := tt.nw
+			err := nw.normalize()
+			if tt.err != (err != nil) {
+				t.Fatalf("got %v", err)
+			}
+			if !tt.err && !reflect.DeepEqual(nw, tt.want) {
+				t.Errorf("got %+v, expected %+v", nw, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	tests := []struct {
+		name  string
+		nw    Network
+		peers Peers
+		want  []string
+		err   bool
+	}{
+		{
+			name: "first host",
+			nw:   Network{Prefix: "10.0.0.0/24"},
+			want: []string{"10.0.0.1/32"},
+		},
+		{
+			name:  "skips used addresses",
+			nw:    Network{Prefix: "10.0.0.0/24"},
+			peers: Peers{{Address: []string{"10.0.0.1/24"}}, {Address: []string{"10.0.0.3"}}},
+			want:  []string{"10.0.0.2/32"},
+		},
+		{
+			name:  "dual-stack",
+			nw:    Network{Prefix: "10.0.0.0/24", Prefix6: "fd00:1::/48"},
+			peers: Peers{{Address: []string{"10.0.0.1/32", "fd00:1::1/128"}}, {Address: []string{"fd00:1::2/64"}}},
+			want:  []string{"10.0.0.2/32", "fd00:1::3/128"},
+		},
+		{
+			name: "ipv6 only",
+			nw:   Network{Prefix: "fd00:2::/64"},
+			want: []string{"fd00:2::1/128"},
+		},
+		{
+			name:  "no broadcast",
+			nw:    Network{Prefix: "10.0.0.0/30"},
+			peers: Peers{{Address: []string{"10.0.0.1/32"}}, {Address: []string{"10.0.0.2/32"}}},
+			err:   true,
+		},
+		{
+			name:  "full ipv6",
+			nw:    Network{Prefix: "10.0.0.0/24", Prefix6: "fd00::/127"},
+			peers: Peers{{Address: []string{"fd00::1/128"}}},
+			err:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.peers.Allocate(tt.nw)
+			if tt.err {
+				if err == nil {
+					t.Errorf("got %v, expected an error", got)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, %v, expected %v", got, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package wireguard
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseConfig will parse a config in wg-quick format,
+// the inverse of Config.String
+func ParseConfig(b []byte) (Config, error) {
+	var c Config
+	var section string
+	var pc *PeerConfig
+
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(line, "# Name:") {
+			name := strings.TrimSpace(strings.TrimPrefix(line, "# Name:"))
+			if pc != nil {
+				pc.Name = name
+			} else {
+				c.Name = name
+			}
+			continue
+		}
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if line == "" {
+			continue
+		}
+		switch strings.ToLower(line) {
+		case "[interface]":
+			section, pc = "interface", nil
+			continue
+		case "[peer]":
+			c.Peers = append(c.Peers, PeerConfig{})
+			section, pc = "peer", &c.Peers[len(c.Peers)-1]
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return c, fmt.Errorf("line %d: expected key = value", n)
+		}
+		key, value := strings.ToLower(strings.TrimSpace(kv[0])), strings.TrimSpace(kv[1])
+		var err error
+		switch section {
+		case "interface":
+			err = c.Interface.set(key, value)
+		case "peer":
+			err = pc.set(key, value)
+		default:
+			err = fmt.Errorf("%s outside of a section", kv[0])
+		}
+		if err != nil {
+			return c, fmt.Errorf("line %d: %v", n, err)
+		}
+	}
+	return c, s.Err()
+}
+
+func (i *Interface) set(key, value string) error {
+	var err error
+	switch key {
+	case "privatekey":
+		i.PrivateKey = value
+	case "address":
+		i.Address = append(i.Address, splitCell(value)...)
+	case "listenport":
+		i.ListenPort, err = strconv.Atoi(value)
+	case "fwmark":
+		i.FwMark, err = strconv.Atoi(value)
+	case "dns":
+		i.DNS = value
+	case "mtu":
+		i.MTU, err = strconv.Atoi(value)
+	case "table":
+		i.Table = value
+	case "preup":
+		i.PreUp = append(i.PreUp, value)
+	case "postup":
+		i.PostUp = append(i.PostUp, value)
+	case "predown":
+		i.PreDown = append(i.PreDown, value)
+	case "postdown":
+		i.PostDown = append(i.PostDown, value)
+	case "saveconfig":
+		i.SaveConfig, err = strconv.ParseBool(value)
+	default:
+		err = fmt.Errorf("unknown interface key %q", key)
+	}
+	return err
+}
+
+func (pc *PeerConfig) set(key, value string) error {
+	var err error
+	switch key {
+	case "publickey":
+		pc.PublicKey = value
+	case "endpoint":
+		pc.Endpoint = value
+	case "allowedips":
+		pc.AllowedIPs = append(pc.AllowedIPs, splitCell(value)...)
+	case "persistentkeepalive":
+		if value != "off" {
+			pc.PersistentKeepalive, err = strconv.Atoi(value)
+		}
+	default:
+		err = fmt.Errorf("unknown peer key %q", key)
+	}
+	return err
+}
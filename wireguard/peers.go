@@ -23,12 +23,14 @@ package wireguard
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
-	"text/tabwriter"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 // Peers is a map containing all
@@ -36,7 +38,18 @@ import (
 type Peers []Peer
 
 var dbFile string
+
+// ErrPeerExists is returned when adding a Peer whose name is taken
+var ErrPeerExists = errors.New("peer already exists")
+
+// ErrPeerNotFound is returned when the named Peer is not registered
+var ErrPeerNotFound = errors.New("peer not found")
+
 var useStdOut bool
+var outputFormat = "wg-quick"
+
+// Formats are the config formats GenerateConfigs can write
+var Formats = []string{"wg-quick", "k8s"}
 
 //Peer is a Wireguard Peer
 type Peer struct {
@@ -55,6 +68,51 @@ type Peer struct {
 	PreDown    string
 	PostDown   string
 	SaveConfig bool
+	Role       string   `json:",omitempty"`
+	Tags       []string `json:",omitempty"`
+	// PersistentKeepalive is written in the [Peer] sections
+	// describing this Peer, like wg-meshconf does
+	PersistentKeepalive int `json:",omitempty"`
+	// Extra holds attributes imported from other tools
+	// that gomesh does not know about
+	Extra map[string]string `json:",omitempty"`
+	// Network the Peer belongs to, Peers only see
+	// the Peers of their own network
+	Network string `json:",omitempty"`
+	// PublicKey is only kept for Peers that hold
+	// their own private key, like those that joined
+	PublicKey string `json:",omitempty"`
+	// Pending Peers joined a network requiring approval and
+	// are left out of the configs until they are approved
+	Pending bool      `json:",omitempty"`
+	Join    *JoinInfo `json:",omitempty"`
+	// Site groups Peers on the same LAN, they
+	// reach each other on their LAN addresses
+	Site string `json:",omitempty"`
+	// NAT is the kind of NAT the Peer is behind
+	NAT string `json:",omitempty"`
+	// ReportedEndpoint and LANAddresses are reported by the node,
+	// ReportedEndpoint is preferred over Endpoint when set
+	ReportedEndpoint string   `json:",omitempty"`
+	LANAddresses     []string `json:",omitempty"`
+	// Relay Peers forward the traffic of pairs
+	// that cannot have a tunnel of their own
+	Relay bool `json:",omitempty"`
+	// Subnets are the LAN prefixes the Peer routes into the mesh
+	Subnets []Subnet `json:",omitempty"`
+	// KeyCreated is when the Peer got its current key
+	KeyCreated *time.Time `json:",omitempty"`
+	// Type is server, client or roaming, the default is server
+	Type string `json:",omitempty"`
+}
+
+// Public will return the public key of the Peer
+func (pr Peer) Public() (string, error) {
+	if pr.PrivateKey == "" && pr.PublicKey != "" {
+		_, err := wgtypes.ParseKey(pr.PublicKey)
+		return pr.PublicKey, err
+	}
+	return PublicKey(pr.PrivateKey)
 }
 
 // LoadPeers will load the register with Peers
@@ -80,12 +138,35 @@ func LoadPeers(peersPath string) (Peers, error) {
 	return p, nil
 }
 
+// SidecarPath will return the path of a file kept next to the
+// registry, for database.json and suffix tokens.json it is
+// database.tokens.json
+func SidecarPath(suffix string) string {
+	return strings.TrimSuffix(dbFile, filepath.Ext(dbFile)) + "." + suffix
+}
+
+// DatabasePath will return the path of the registry
+func DatabasePath() string {
+	return dbFile
+}
+
 // SetOutput will instruct to use standard out if called with true
 // argument or files if called with false
 func SetOutput(out bool) {
 	useStdOut = out
 }
 
+// SetFormat will select the format used by GenerateConfigs
+func SetFormat(format string) error {
+	for _, f := range Formats {
+		if f == format {
+			outputFormat = format
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown format %q, use one of %s", format, strings.Join(Formats, ", "))
+}
+
 func (p Peers) peerExists(pr Peer) bool {
 	result := false
 
@@ -100,118 +181,221 @@ func (p Peers) peerExists(pr Peer) bool {
 }
 
 //AddPeer will add a Peer to the register
-func (p Peers) AddPeer(pr Peer) error {
-	if pr.PrivateKey == "" {
+func (p *Peers) AddPeer(pr Peer) error {
+	if p.peerExists(pr) {
+		return fmt.Errorf("%s: %w", pr.Name, ErrPeerExists)
+	}
+	if err := p.validate(&pr); err != nil {
+		return err
+	}
+	if pr.PrivateKey == "" && pr.PublicKey == "" {
 		k, err := GenerateKey()
 		if err != nil {
 			return err
 		}
 		pr.PrivateKey = k
 	}
+	if pr.KeyCreated == nil {
+		now := time.Now().UTC()
+		pr.KeyCreated = &now
+	}
 
-	if pr.ListenPort == 0 {
+	// roaming Peers do not listen
+	if pr.ListenPort == 0 && pr.Type != TypeRoaming {
 		pr.ListenPort = 51820
 	}
-	p = append(p, pr)
+	*p = append(*p, pr)
 	err := p.DumpPeers(true)
 	return err
 }
 
-//DeletePeer will delete the named Peer from the register
-func (p Peers) DeletePeer(pr string) {
-	if len(p) == 0 {
-		return
+// validate will check a Peer about to be registered and
+// write its addresses in canonical form
+func (p Peers) validate(pr *Peer) error {
+	if err := validNAT(pr.NAT); err != nil {
+		return fmt.Errorf("%s: %w", pr.Name, err)
 	}
-	index := 0
-	for i := range p {
-		if p[i].Name == pr {
-			index = i
+	if err := validPeerType(*pr); err != nil {
+		return err
+	}
+	if err := pr.normalize(); err != nil {
+		return err
+	}
+	return p.checkDNSName(*pr)
+}
+
+// UpdatePeer will replace the registered Peer having the same
+// name, the private key is kept if none is given
+func (p *Peers) UpdatePeer(pr Peer) error {
+	i := p.index(pr.Name)
+	if i < 0 {
+		return fmt.Errorf("%s: %w", pr.Name, ErrPeerNotFound)
+	}
+	if err := p.validate(&pr); err != nil {
+		return err
+	}
+	if pr.PrivateKey == "" && pr.PublicKey == "" {
+		pr.PrivateKey = (*p)[i].PrivateKey
+		pr.PublicKey = (*p)[i].PublicKey
+	}
+	if pr.KeyCreated == nil {
+		pr.KeyCreated = (*p)[i].KeyCreated
+		if pr.PrivateKey != (*p)[i].PrivateKey || pr.PublicKey != (*p)[i].PublicKey {
+			now := time.Now().UTC()
+			pr.KeyCreated = &now
 		}
 	}
+	if pr.ListenPort == 0 && pr.Type != TypeRoaming {
+		pr.ListenPort = 51820
+	}
+	// what the node reported is kept
+	if pr.ReportedEndpoint == "" && pr.LANAddresses == nil {
+		pr.ReportedEndpoint = (*p)[i].ReportedEndpoint
+		pr.LANAddresses = (*p)[i].LANAddresses
+	}
+	if pr.Join == nil {
+		pr.Join = (*p)[i].Join
+	}
+	// only Approve lets a Peer into the mesh
+	pr.Pending = (*p)[i].Pending
+	if pr.Subnets == nil {
+		pr.Subnets = (*p)[i].Subnets
+	}
+	(*p)[i] = pr
+	return p.DumpPeers(true)
+}
 
-	p = append(p[:index], p[index+1:]...)
-	err := p.DumpPeers(true)
+//DeletePeer will delete the named Peer from the register
+func (p *Peers) DeletePeer(pr string) error {
+	index := p.index(pr)
+	if index < 0 {
+		return fmt.Errorf("%s: %w", pr, ErrPeerNotFound)
+	}
+
+	*p = append((*p)[:index], (*p)[index+1:]...)
+	return p.DumpPeers(true)
+}
+
+// Get will return the named Peer
+func (p Peers) Get(name string) (Peer, error) {
+	i := p.index(name)
+	if i < 0 {
+		return Peer{}, fmt.Errorf("%s: %w", name, ErrPeerNotFound)
+	}
+	return p[i], nil
+}
+
+// RotateKey will give the named Peer a new private key
+func (p *Peers) RotateKey(name string) (Peer, error) {
+	i := p.index(name)
+	if i < 0 {
+		return Peer{}, fmt.Errorf("%s: %w", name, ErrPeerNotFound)
+	}
+	k, err := GenerateKey()
 	if err != nil {
-		fmt.Println(err)
+		return Peer{}, err
 	}
+	now := time.Now().UTC()
+	(*p)[i].PrivateKey = k
+	(*p)[i].PublicKey = ""
+	(*p)[i].KeyCreated = &now
+	return (*p)[i], p.DumpPeers(true)
+}
+
+// Render will return the config of the named Peer in the given format
+func (p Peers) Render(name string, format string) ([]byte, error) {
+	pr, err := p.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	c, err := p.Config(pr)
+	if err != nil {
+		return nil, err
+	}
+	_, b, err := render(c, format)
+	return b, err
+}
+
+func (p Peers) index(name string) int {
+	for i := range p {
+		if strings.EqualFold(p[i].Name, name) {
+			return i
+		}
+	}
+	return -1
 }
 
 //GenerateConfigs will generate the Wireguard mesh
 //configs in the specified folder
 func (p Peers) GenerateConfigs(folder string, peername string) error {
 	var err error
+	var files []string
 	if err = os.MkdirAll(folder, 0775); err != nil {
 		return err
 	}
-	if peername == "" {
-		for i := range p {
-			err = p.dumpConfig(p[i], folder)
+	for i := range p {
+		if peername != "" && p[i].Name != peername {
+			continue
 		}
-	} else {
-		for j := range p {
-			if p[j].Name == peername {
-				err = p.dumpConfig(p[j], folder)
-			}
+		f, err := p.dumpConfig(p[i], folder)
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+	if outputFormat == "k8s" && k8sOptions.Kustomize {
+		b, err := kustomizationFile(files)
+		if err != nil {
+			return err
 		}
+		_, err = writeOutput(filepath.Join(folder, "kustomization.yaml"), b)
+		return err
 	}
 	return err
 }
 
-func (p Peers) dumpConfig(pr Peer, folder string) error {
-	var err error
-	var b strings.Builder
-
-	// write the interface section
-	b.WriteString("[Interface]\n")
-	b.WriteString(fmt.Sprintf("# Name: %s\n", strings.ToLower(pr.Name)))
-	b.WriteString(fmt.Sprintf("Address = %s\n", strings.Join(pr.Address, ",")))
-	b.WriteString(fmt.Sprintf("PrivateKey = %s\n", pr.PrivateKey))
-	b.WriteString(fmt.Sprintf("Endpoint = %s:%d\n", pr.Endpoint, pr.ListenPort))
-	if pr.PreUp != "" {
-		b.WriteString(fmt.Sprintf("PreUp = %s", pr.PreUp))
-	}
-	if pr.PostUp != "" {
-		b.WriteString(fmt.Sprintf("PostUp = %s", pr.PostUp))
-	}
-	if pr.PreDown != "" {
-		b.WriteString(fmt.Sprintf("PreDown = %s", pr.PreDown))
-	}
-	if pr.PostDown != "" {
-		b.WriteString(fmt.Sprintf("PostDown = %s", pr.PostDown))
-	}
-	if pr.SaveConfig {
-		b.WriteString(fmt.Sprintf("SaveConfig = True"))
-	}
-
-	// write the peers section
-	for j := range p {
-		if p[j].Name != pr.Name {
-			b.WriteString("\n[Peer]\n")
-			b.WriteString(fmt.Sprintf("# Name: %s\n", strings.ToLower(p[j].Name)))
-			pub, err := PublicKey(p[j].PrivateKey)
-			if err != nil {
-				return err
-			}
-			b.WriteString(fmt.Sprintf("PublicKeyKey = %s\n", pub))
-			b.WriteString(fmt.Sprintf("Endpoint = %s:%d\n", p[j].Endpoint, p[j].ListenPort))
-			allIPs := append(p[j].Address, p[j].AllowedIPs...)
-			b.WriteString(fmt.Sprintf("AllowedIPs = %s\n", strings.Join(allIPs, ",")))
+// dumpConfig will write the config of the Peer in the selected
+// format and return the name of the file it was written to
+func (p Peers) dumpConfig(pr Peer, folder string) (string, error) {
+	c, err := p.Config(pr)
+	if err != nil {
+		return "", err
+	}
 
-		}
+	name, b, err := render(c, outputFormat)
+	if err != nil {
+		return "", err
+	}
+
+	return writeOutput(filepath.Join(folder, name), b)
+}
 
+// render will return the file name and the contents
+// of the config in the given format
+func render(c Config, format string) (string, []byte, error) {
+	switch format {
+	case "k8s":
+		b, err := kubernetesManifests(c)
+		return dnsLabel(c.Name) + ".yaml", b, err
+	default:
+		return c.Name + ".conf", []byte(c.String()), nil
 	}
-	if !useStdOut {
-		configFile := folder + "/" + pr.Name + ".conf"
-		f, err := os.OpenFile(configFile, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			return err
-		}
-		_, err = f.WriteString(b.String())
-		return err
-	} else {
-		fmt.Println(b.String())
+}
+
+// writeOutput will write b to configFile or to standard out
+// if so instructed, returning the base name of the file
+func writeOutput(configFile string, b []byte) (string, error) {
+	if useStdOut {
+		fmt.Println(string(b))
+		return filepath.Base(configFile), nil
 	}
-	return err
+	f, err := os.OpenFile(configFile, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	_, err = f.Write(b)
+	return filepath.Base(configFile), err
 }
 
 // DumpPeers will generate a JSON file at the provided location with the
@@ -248,28 +432,3 @@ func (p Peers) DumpPeers(overwrite bool) error {
 	}
 	return err
 }
-
-// PrettyPrint will print a table with the peers
-func (p Peers) PrettyPrint(brief bool) {
-	if len(p) == 0 {
-		return
-	}
-	const padding = 3
-	tw := tabwriter.NewWriter(os.Stdout, 0, 0, padding, ' ', tabwriter.AlignRight|tabwriter.Debug)
-
-	if !brief {
-		fmt.Fprintln(tw, "NAME\t", "PRIVATEKEY\t", "ADDRESS\t", "LISTENPORT\t", "ENDPOINT\t", "ALLOWEDIPS\t", "FWMARK\t", "DNS\t", "MTU\t", "TABLE\t", "PREUP\t", "POSTUP\t", "PREDOWN\t", "POSTDOWN\t", "SAVE\t")
-		for _, v := range p {
-			fmt.Fprintln(tw, v.Name+"\t", v.PrivateKey+"\t", strings.Join(v.Address, ",")+"\t", strconv.Itoa(v.ListenPort)+"\t", v.Endpoint+"\t", strings.Join(v.AllowedIPs, ",")+"\t", strconv.Itoa(v.FwMark)+"\t", v.DNS+"\t", strconv.Itoa(v.MTU)+"\t", v.Table+"\t", v.PreUp+"\t", v.PostUp+"\t", v.PreDown+"\t", v.PostDown+"\t", strconv.FormatBool(v.SaveConfig)+"\t")
-
-		}
-	} else {
-		fmt.Fprintln(tw, "NAME\t", "PRIVATEKEY\t", "ADDRESS\t", "LISTENPORT\t", "ENDPOINT\t")
-		for _, v := range p {
-			fmt.Fprintln(tw, v.Name+"\t", v.PrivateKey+"\t", "["+strings.Join(v.Address, ",")+"]\t", strconv.Itoa(v.ListenPort)+"\t", v.Endpoint+"\t")
-		}
-	}
-
-	tw.Flush()
-
-}
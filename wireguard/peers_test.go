@@ -0,0 +1,66 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package wireguard
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// tempRegistry will point the registry and its sidecar
+// files at a fresh directory
+func tempRegistry(t *testing.T) {
+	t.Helper()
+	old := dbFile
+	dbFile = filepath.Join(t.TempDir(), "database.json")
+	t.Cleanup(func() { dbFile = old })
+}
+
+func TestUpdatePeerKeepsPending(t *testing.T) {
+	tempRegistry(t)
+	var p Peers
+	if err := p.AddPeer(Peer{Name: "laptop", Address: []string{"10.0.0.2/32"}, Endpoint: "laptop.example.com", Pending: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.UpdatePeer(Peer{Name: "laptop", Address: []string{"10.0.0.2/32"}, Endpoint: "laptop.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	pr, _ := p.Get("laptop")
+	if !pr.Pending {
+		t.Fatal("UpdatePeer approved a pending peer")
+	}
+
+	if err := p.Approve("laptop", "admin", nil, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.UpdatePeer(Peer{Name: "laptop", Address: []string{"10.0.0.2/32"}, Endpoint: "laptop.example.com", Pending: true}); err != nil {
+		t.Fatal(err)
+	}
+	pr, _ = p.Get("laptop")
+	if pr.Pending {
+		t.Error("UpdatePeer made an approved peer pending")
+	}
+	if pr.Join == nil || pr.Join.ApprovedBy != "admin" {
+		t.Errorf("approval not kept: %+v", pr.Join)
+	}
+}
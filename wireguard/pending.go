@@ -0,0 +1,100 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package wireguard
+
+import (
+	"fmt"
+	"time"
+)
+
+// JoinInfo records how a Peer asked to join and who approved it
+type JoinInfo struct {
+	Requested     time.Time
+	TokenID       string
+	RemoteAddr    string
+	Hostname      string     `json:",omitempty"`
+	UserAgent     string     `json:",omitempty"`
+	RequestedTags []string   `json:",omitempty"`
+	ApprovedBy    string     `json:",omitempty"`
+	ApprovedAt    *time.Time `json:",omitempty"`
+}
+
+// PendingPeers will return the Peers waiting for approval
+func (p Peers) PendingPeers() Peers {
+	var out Peers
+	for _, pr := range p {
+		if pr.Pending {
+			out = append(out, pr)
+		}
+	}
+	return out
+}
+
+// Approve will let the named pending Peer into the mesh, recording
+// who approved it and when. The requested tags are given to the
+// Peer unless tags is not nil
+func (p *Peers) Approve(name string, by string, tags []string, now time.Time) error {
+	i := p.index(name)
+	if i < 0 {
+		return fmt.Errorf("%s: %w", name, ErrPeerNotFound)
+	}
+	pr := &(*p)[i]
+	if !pr.Pending {
+		return fmt.Errorf("%s is not pending", pr.Name)
+	}
+	if pr.Join == nil {
+		pr.Join = &JoinInfo{}
+	}
+	if tags == nil {
+		tags = pr.Join.RequestedTags
+	}
+	for _, t := range tags {
+		if !contains(pr.Tags, t) {
+			pr.Tags = append(pr.Tags, t)
+		}
+	}
+	pr.Pending = false
+	pr.Join.ApprovedBy = by
+	pr.Join.ApprovedAt = &now
+	return p.DumpPeers(true)
+}
+
+// Reject will remove the named pending Peer
+func (p *Peers) Reject(name string) error {
+	pr, err := p.Get(name)
+	if err != nil {
+		return err
+	}
+	if !pr.Pending {
+		return fmt.Errorf("%s is not pending", pr.Name)
+	}
+	return p.DeletePeer(name)
+}
+
+func contains(l []string, s string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
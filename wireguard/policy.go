@@ -0,0 +1,352 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package wireguard
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Policy is an access-control list, once a policy file exists the
+// traffic a node receives over the mesh is dropped unless allowed
+type Policy struct {
+	Rules []PolicyRule
+}
+
+// PolicyRule allows traffic from the Peers matching Src
+// to the Peers matching Dst on Ports, on all ports if empty
+type PolicyRule struct {
+	Line  int
+	Text  string
+	Src   Selector
+	Dst   Selector
+	Ports []PortRange
+}
+
+// Selector picks Peers by name, tag, role or network, an
+// empty Kind picks every Peer
+type Selector struct {
+	Kind  string
+	Value string
+}
+
+// PortRange is a protocol and its ports, all ports if From is zero
+type PortRange struct {
+	Proto string
+	From  int
+	To    int
+}
+
+var protocols = []string{"tcp", "udp", "icmp", "sctp"}
+
+// LoadPolicy will load the policy kept next to the registry,
+// it returns nil if there is none
+func LoadPolicy() (*Policy, error) {
+	f, err := os.Open(SidecarPath("policy"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParsePolicy(f)
+}
+
+// ParsePolicy will read a policy made of lines like
+//
+//	allow tag:web -> tag:db port 5432/tcp
+//
+// blank lines and lines starting with # are ignored
+func ParsePolicy(r io.Reader) (*Policy, error) {
+	pol := &Policy{}
+	s := bufio.NewScanner(r)
+	line := 0
+	for s.Scan() {
+		line++
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		rule, err := parseRule(text)
+		if err != nil {
+			return nil, fmt.Errorf("policy line %d: %v", line, err)
+		}
+		rule.Line, rule.Text = line, text
+		pol.Rules = append(pol.Rules, rule)
+	}
+	return pol, s.Err()
+}
+
+func parseRule(text string) (PolicyRule, error) {
+	var rule PolicyRule
+	f := strings.Fields(text)
+	if len(f) < 4 || f[0] != "allow" || f[2] != "->" {
+		return rule, fmt.Errorf("expected allow <selector> -> <selector> [port <ports>]")
+	}
+	var err error
+	if rule.Src, err = parseSelector(f[1]); err != nil {
+		return rule, err
+	}
+	if rule.Dst, err = parseSelector(f[3]); err != nil {
+		return rule, err
+	}
+	switch {
+	case len(f) == 4:
+	case len(f) == 6 && f[4] == "port":
+		for _, spec := range strings.Split(f[5], ",") {
+			pr, err := parsePortRange(spec)
+			if err != nil {
+				return rule, err
+			}
+			rule.Ports = append(rule.Ports, pr)
+		}
+	default:
+		return rule, fmt.Errorf("unexpected %q", strings.Join(f[4:], " "))
+	}
+	return rule, nil
+}
+
+func parseSelector(s string) (Selector, error) {
+	if s == "*" || s == "any" {
+		return Selector{}, nil
+	}
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return Selector{Kind: "node", Value: s}, nil
+	}
+	sel := Selector{Kind: s[:i], Value: s[i+1:]}
+	switch sel.Kind {
+	case "node", "tag", "role", "network":
+	default:
+		return sel, fmt.Errorf("unknown selector %q, expected node, tag, role or network", sel.Kind)
+	}
+	if sel.Value == "" {
+		return sel, fmt.Errorf("empty selector %q", s)
+	}
+	return sel, nil
+}
+
+// parsePortRange will parse 5432/tcp, 8000-8100/tcp or tcp
+func parsePortRange(s string) (PortRange, error) {
+	var pr PortRange
+	ports := ""
+	if i := strings.Index(s, "/"); i >= 0 {
+		ports, pr.Proto = s[:i], s[i+1:]
+	} else {
+		pr.Proto = s
+	}
+	pr.Proto = strings.ToLower(pr.Proto)
+	if !contains(protocols, pr.Proto) {
+		return pr, fmt.Errorf("unknown protocol %q", pr.Proto)
+	}
+	if ports == "" {
+		return pr, nil
+	}
+	if pr.Proto == "icmp" {
+		return pr, fmt.Errorf("icmp has no ports")
+	}
+	from, to := ports, ports
+	if i := strings.Index(ports, "-"); i >= 0 {
+		from, to = ports[:i], ports[i+1:]
+	}
+	var err error
+	if pr.From, err = strconv.Atoi(from); err != nil {
+		return pr, fmt.Errorf("invalid port %q", from)
+	}
+	if pr.To, err = strconv.Atoi(to); err != nil {
+		return pr, fmt.Errorf("invalid port %q", to)
+	}
+	if pr.From < 1 || pr.To > 65535 || pr.From > pr.To {
+		return pr, fmt.Errorf("invalid port range %q", ports)
+	}
+	return pr, nil
+}
+
+// Matches will tell whether the Peer is selected
+func (s Selector) Matches(pr Peer) bool {
+	switch s.Kind {
+	case "":
+		return true
+	case "node":
+		return strings.EqualFold(pr.Name, s.Value)
+	case "tag":
+		return contains(pr.Tags, s.Value)
+	case "role":
+		return pr.Role == s.Value
+	case "network":
+		return pr.Network == s.Value
+	}
+	return false
+}
+
+func (s Selector) String() string {
+	if s.Kind == "" {
+		return "*"
+	}
+	return s.Kind + ":" + s.Value
+}
+
+// covers will tell whether the port range lets port/proto through
+func (pr PortRange) covers(proto string, port int) bool {
+	return pr.Proto == proto && (pr.From == 0 || (port >= pr.From && port <= pr.To))
+}
+
+// Allowed will return the rule letting traffic from src reach dst
+// on port/proto, ok is false if none does. Without a policy all
+// traffic is allowed
+func (pol *Policy) Allowed(src, dst Peer, proto string, port int) (rule PolicyRule, ok bool) {
+	if pol == nil {
+		return rule, true
+	}
+	for _, r := range pol.Rules {
+		if !r.Src.Matches(src) || !r.Dst.Matches(dst) {
+			continue
+		}
+		if len(r.Ports) == 0 {
+			return r, true
+		}
+		for _, pr := range r.Ports {
+			if pr.covers(proto, port) {
+				return r, true
+			}
+		}
+	}
+	return rule, false
+}
+
+// firewall will return the nftables commands filtering the traffic
+// the Peer receives on its WireGuard interface, to be run from
+// PostUp, and the PostDown commands removing them, all in the
+// nftables table of the given name
+func (pol *Policy) firewall(p Peers, dst Peer, table string) ([]string, []string) {
+	if pol == nil {
+		return nil, nil
+	}
+	up := []string{
+		"nft add table inet " + table,
+		"nft add chain inet " + table + ` input { type filter hook input priority 0 \; policy accept \; }`,
+		"nft add rule inet " + table + " input iifname %i ct state established,related accept",
+	}
+	for _, r := range pol.nftRules(p, dst) {
+		up = append(up, "nft add rule inet "+table+" input iifname %i "+r)
+	}
+	up = append(up, "nft add rule inet "+table+" input iifname %i drop")
+	return up, []string{"nft delete table inet " + table}
+}
+
+// Ruleset will return the nftables ruleset of the Peer as a file
+// loadable with nft -f, iface is its WireGuard interface
+func (pol *Policy) Ruleset(p Peers, dst Peer, iface string) string {
+	var b strings.Builder
+	b.WriteString("table inet gomesh {\n")
+	b.WriteString("\tchain input {\n")
+	b.WriteString("\t\ttype filter hook input priority 0; policy accept;\n")
+	fmt.Fprintf(&b, "\t\tiifname %q ct state established,related accept\n", iface)
+	for _, r := range pol.nftRules(p, dst) {
+		fmt.Fprintf(&b, "\t\tiifname %q %s\n", iface, r)
+	}
+	fmt.Fprintf(&b, "\t\tiifname %q drop\n", iface)
+	b.WriteString("\t}\n}\n")
+	return b.String()
+}
+
+// nftRules will return the accept rules of the Peer
+// without the interface match
+func (pol *Policy) nftRules(p Peers, dst Peer) []string {
+	var out []string
+	for _, r := range pol.Rules {
+		if !r.Dst.Matches(dst) {
+			continue
+		}
+		var v4, v6 []string
+		for _, src := range p {
+			if !visible(src, dst) || !r.Src.Matches(src) {
+				continue
+			}
+			// interface addresses keep their prefix length,
+			// only the host itself is let in
+			for _, a := range src.Addrs() {
+				if a.Is4() {
+					v4 = append(v4, a.String())
+				} else {
+					v6 = append(v6, a.String())
+				}
+			}
+		}
+		for _, match := range portMatches(r.Ports) {
+			if len(v4) > 0 {
+				out = append(out, nftRule("ip saddr { "+strings.Join(v4, ", ")+" }", match, "accept"))
+			}
+			if len(v6) > 0 {
+				out = append(out, nftRule("ip6 saddr { "+strings.Join(v6, ", ")+" }", match, "accept"))
+			}
+		}
+	}
+	return out
+}
+
+func nftRule(parts ...string) string {
+	var nonEmpty []string
+	for _, p := range parts {
+		if p != "" {
+			nonEmpty = append(nonEmpty, p)
+		}
+	}
+	return strings.Join(nonEmpty, " ")
+}
+
+// portMatches will return the nftables matches for the ports,
+// one per protocol, or a single empty match for all traffic
+func portMatches(ports []PortRange) []string {
+	if len(ports) == 0 {
+		return []string{""}
+	}
+	byProto := map[string][]string{}
+	all := map[string]bool{}
+	for _, pr := range ports {
+		switch {
+		case pr.From == 0:
+			all[pr.Proto] = true
+		case pr.From == pr.To:
+			byProto[pr.Proto] = append(byProto[pr.Proto], strconv.Itoa(pr.From))
+		default:
+			byProto[pr.Proto] = append(byProto[pr.Proto], fmt.Sprintf("%d-%d", pr.From, pr.To))
+		}
+	}
+	var out []string
+	for _, proto := range protocols {
+		switch {
+		case all[proto] && proto == "icmp":
+			out = append(out, "meta l4proto { icmp, ipv6-icmp }")
+		case all[proto]:
+			out = append(out, "meta l4proto "+proto)
+		case len(byProto[proto]) > 0:
+			out = append(out, fmt.Sprintf("%s dport { %s }", proto, strings.Join(byProto[proto], ", ")))
+		}
+	}
+	return out
+}
@@ -0,0 +1,196 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package wireguard
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePolicy(t *testing.T) {
+	tests := []struct {
+		line string
+		want PolicyRule
+		err  bool
+	}{
+		{line: "allow * -> *", want: PolicyRule{}},
+		{line: "allow any -> web1", want: PolicyRule{Dst: Selector{"node", "web1"}}},
+		{line: "allow tag:web -> tag:db port 5432/tcp", want: PolicyRule{Src: Selector{"tag", "web"}, Dst: Selector{"tag", "db"}, Ports: []PortRange{{"tcp", 5432, 5432}}}},
+		{line: "allow role:admin -> network:prod port 22/TCP,8000-8100/tcp,icmp", want: PolicyRule{Src: Selector{"role", "admin"}, Dst: Selector{"network", "prod"},
+			Ports: []PortRange{{"tcp", 22, 22}, {"tcp", 8000, 8100}, {"icmp", 0, 0}}}},
+		{line: "deny * -> *", err: true},
+		{line: "allow * *", err: true},
+		{line: "allow group:x -> *", err: true},
+		{line: "allow tag: -> *", err: true},
+		{line: "allow * -> * port 80/http", err: true},
+		{line: "allow * -> * port 8/icmp", err: true},
+		{line: "allow * -> * port 0/tcp", err: true},
+		{line: "allow * -> * port 90-80/tcp", err: true},
+		{line: "allow * -> * port 70000/udp", err: true},
+		{line: "allow * -> * ports 80/tcp", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			pol, err := ParsePolicy(strings.NewReader("# comment\n\n" + tt.line + "\n"))
+			if tt.err {
+				if err == nil {
+					t.Error("no error")
+				} else if !strings.Contains(err.Error(), "line 3") {
+					t.Errorf("error without the line: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.want.Line, tt.want.Text = 3, tt.line
+			if len(pol.Rules) != 1 || !reflect.DeepEqual(pol.Rules[0], tt.want) {
+				t.Errorf("got %+v, expected %+v", pol.Rules, tt.want)
+			}
+		})
+	}
+}
+
+var policyPeers = Peers{
+	{Name: "web1", Address: []string{"10.0.0.2/24", "fd00::2/64"}, Tags: []string{"web"}},
+	{Name: "web2", Address: []string{"10.0.0.3/32"}, Tags: []string{"web"}},
+	{Name: "db1", Address: []string{"10.0.0.4/24"}, Tags: []string{"db"}},
+	{Name: "admin", Address: []string{"10.0.0.5/24"}, Role: "admin"},
+	{Name: "other", Address: []string{"10.1.0.1/24"}, Network: "other", Role: "admin"},
+}
+
+func TestPolicyAllowed(t *testing.T) {
+	pol, err := ParsePolicy(strings.NewReader(`
+allow tag:web -> tag:db port 5432/tcp
+allow role:admin -> * port 22/tcp,icmp
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		src, dst string
+		proto    string
+		port     int
+		line     int
+	}{
+		{"web1", "db1", "tcp", 5432, 2},
+		{"web1", "db1", "tcp", 22, 0},
+		{"web1", "db1", "udp", 5432, 0},
+		{"db1", "web1", "tcp", 5432, 0},
+		{"admin", "web2", "tcp", 22, 3},
+		{"admin", "web2", "icmp", 0, 3},
+		{"admin", "web2", "tcp", 80, 0},
+	}
+	for _, tt := range tests {
+		src, _ := policyPeers.Get(tt.src)
+		dst, _ := policyPeers.Get(tt.dst)
+		rule, ok := pol.Allowed(src, dst, tt.proto, tt.port)
+		if ok != (tt.line != 0) || rule.Line != tt.line {
+			t.Errorf("%s -> %s %d/%s: got line %d, %v, expected line %d", tt.src, tt.dst, tt.port, tt.proto, rule.Line, ok, tt.line)
+		}
+	}
+	var none *Policy
+	if _, ok := none.Allowed(policyPeers[0], policyPeers[2], "tcp", 1); !ok {
+		t.Error("no policy denies traffic")
+	}
+}
+
+func TestPolicyNftRules(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		dst    string
+		want   []string
+	}{
+		{
+			name:   "host addresses only",
+			policy: "allow tag:web -> tag:db port 5432/tcp",
+			dst:    "db1",
+			want: []string{
+				"ip saddr { 10.0.0.2, 10.0.0.3 } tcp dport { 5432 } accept",
+				"ip6 saddr { fd00::2 } tcp dport { 5432 } accept",
+			},
+		},
+		{
+			name:   "not the destination",
+			policy: "allow tag:web -> tag:db port 5432/tcp",
+			dst:    "web1",
+		},
+		{
+			name:   "other networks are left out",
+			policy: "allow role:admin -> * port 22/tcp,8000-8100/tcp,icmp",
+			dst:    "db1",
+			want: []string{
+				"ip saddr { 10.0.0.5 } tcp dport { 22, 8000-8100 } accept",
+				"ip saddr { 10.0.0.5 } meta l4proto { icmp, ipv6-icmp } accept",
+			},
+		},
+		{
+			name:   "all ports",
+			policy: "allow node:db1 -> web2",
+			dst:    "web2",
+			want:   []string{"ip saddr { 10.0.0.4 } accept"},
+		},
+		{
+			name:   "all of a protocol",
+			policy: "allow node:db1 -> web2 port udp",
+			dst:    "web2",
+			want:   []string{"ip saddr { 10.0.0.4 } meta l4proto udp accept"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pol, err := ParsePolicy(strings.NewReader(tt.policy))
+			if err != nil {
+				t.Fatal(err)
+			}
+			dst, _ := policyPeers.Get(tt.dst)
+			if got := pol.nftRules(policyPeers, dst); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got\n%s\nexpected\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestPolicyFirewall(t *testing.T) {
+	pol, err := ParsePolicy(strings.NewReader("allow tag:web -> tag:db port 5432/tcp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, _ := policyPeers.Get("db1")
+	up, down := pol.firewall(policyPeers, db, "gomesh")
+	if len(up) != 6 || up[len(up)-1] != "nft add rule inet gomesh input iifname %i drop" {
+		t.Errorf("PostUp:\n%s", strings.Join(up, "\n"))
+	}
+	if !reflect.DeepEqual(down, []string{"nft delete table inet gomesh"}) {
+		t.Errorf("PostDown: %v", down)
+	}
+	rs := pol.Ruleset(policyPeers, db, "wg0")
+	if !strings.Contains(rs, "\t\tiifname \"wg0\" ip saddr { 10.0.0.2, 10.0.0.3 } tcp dport { 5432 } accept\n") {
+		t.Errorf("ruleset:\n%s", rs)
+	}
+	var none *Policy
+	if up, down := none.firewall(policyPeers, db, "gomesh"); up != nil || down != nil {
+		t.Error("no policy has firewall rules")
+	}
+}
@@ -0,0 +1,357 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package wireguard
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// PrintOptions control what Print writes and how
+type PrintOptions struct {
+	// Output is one of table, wide, json, yaml or csv
+	Output string
+	// Columns to print, the default depends on Output
+	Columns []string
+	// Where holds column=value filters, all must match
+	Where []string
+	// Name is a glob the Peer names must match
+	Name string
+	// SortBy is the column to sort on
+	SortBy string
+	// ShowSecrets allows the privatekey column
+	ShowSecrets bool
+}
+
+type column struct {
+	name   string
+	secret bool
+	value  func(Peer) interface{}
+}
+
+// columns are all the columns Print knows about, in wide order
+var columns = []column{
+	{name: "name", value: func(p Peer) interface{} { return p.Name }},
+	{name: "role", value: func(p Peer) interface{} { return p.Role }},
+	{name: "type", value: func(p Peer) interface{} {
+		if p.Type == "" {
+			return TypeServer
+		}
+		return p.Type
+	}},
+	{name: "tags", value: func(p Peer) interface{} { return p.Tags }},
+	{name: "network", value: func(p Peer) interface{} { return p.Network }},
+	{name: "pending", value: func(p Peer) interface{} { return p.Pending }},
+	{name: "address", value: func(p Peer) interface{} { return p.Address }},
+	{name: "listenport", value: func(p Peer) interface{} { return p.ListenPort }},
+	{name: "endpoint", value: func(p Peer) interface{} { return p.Endpoint }},
+	{name: "reported", value: func(p Peer) interface{} { return p.ReportedEndpoint }},
+	{name: "lan", value: func(p Peer) interface{} { return p.LANAddresses }},
+	{name: "site", value: func(p Peer) interface{} { return p.Site }},
+	{name: "nat", value: func(p Peer) interface{} { return p.NAT }},
+	{name: "relay", value: func(p Peer) interface{} { return p.Relay }},
+	{name: "subnets", value: func(p Peer) interface{} {
+		var s []string
+		for _, sn := range p.Subnets {
+			s = append(s, sn.Prefix)
+		}
+		return s
+	}},
+	{name: "publickey", value: func(p Peer) interface{} { k, _ := p.Public(); return k }},
+	{name: "keycreated", value: func(p Peer) interface{} {
+		if p.KeyCreated == nil {
+			return ""
+		}
+		return p.KeyCreated.Format(time.RFC3339)
+	}},
+	{name: "privatekey", secret: true, value: func(p Peer) interface{} { return p.PrivateKey }},
+	{name: "allowedips", value: func(p Peer) interface{} { return p.AllowedIPs }},
+	{name: "fwmark", value: func(p Peer) interface{} { return p.FwMark }},
+	{name: "dns", value: func(p Peer) interface{} { return p.DNS }},
+	{name: "mtu", value: func(p Peer) interface{} { return p.MTU }},
+	{name: "table", value: func(p Peer) interface{} { return p.Table }},
+	{name: "preup", value: func(p Peer) interface{} { return p.PreUp }},
+	{name: "postup", value: func(p Peer) interface{} { return p.PostUp }},
+	{name: "predown", value: func(p Peer) interface{} { return p.PreDown }},
+	{name: "postdown", value: func(p Peer) interface{} { return p.PostDown }},
+	{name: "saveconfig", value: func(p Peer) interface{} { return p.SaveConfig }},
+}
+
+var tableColumns = []string{"name", "role", "address", "listenport", "endpoint", "publickey"}
+
+// Columns returns the names of the columns Print knows about
+func Columns() []string {
+	names := make([]string, len(columns))
+	for i, c := range columns {
+		names[i] = c.name
+	}
+	return names
+}
+
+func lookupColumn(name string) (column, error) {
+	for _, c := range columns {
+		if c.name == strings.ToLower(name) {
+			return c, nil
+		}
+	}
+	return column{}, fmt.Errorf("unknown column %q, use one of %s", name, strings.Join(Columns(), ", "))
+}
+
+// cell is a single named value of a printed row
+type cell struct {
+	name  string
+	value interface{}
+}
+
+// row keeps the column order when marshalled to JSON or YAML
+type row []cell
+
+// MarshalJSON implements json.Marshaler
+func (r row) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, c := range r {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(c.name)
+		v, err := json.Marshal(c.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// MarshalYAML implements yaml.Marshaler
+func (r row) MarshalYAML() (interface{}, error) {
+	n := &yaml.Node{Kind: yaml.MappingNode}
+	for _, c := range r {
+		v := &yaml.Node{}
+		if err := v.Encode(c.value); err != nil {
+			return nil, err
+		}
+		n.Content = append(n.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: c.name}, v)
+	}
+	return n, nil
+}
+
+// cellString will format a value for table and csv output
+func cellString(v interface{}) string {
+	switch t := v.(type) {
+	case []string:
+		return strings.Join(t, ",")
+	case int:
+		return strconv.Itoa(t)
+	case bool:
+		return strconv.FormatBool(t)
+	default:
+		return fmt.Sprint(t)
+	}
+}
+
+// matches reports whether the value of c for pr equals want,
+// for list columns any of the elements may match
+func (c column) matches(pr Peer, want string) bool {
+	if l, ok := c.value(pr).([]string); ok {
+		for _, v := range l {
+			if strings.EqualFold(v, want) {
+				return true
+			}
+		}
+		return false
+	}
+	return strings.EqualFold(cellString(c.value(pr)), want)
+}
+
+// Print will write the Peers to w as selected by opts
+func (p Peers) Print(w io.Writer, opts PrintOptions) error {
+	names := opts.Columns
+	if len(names) == 0 {
+		names = tableColumns
+		if opts.Output != "table" && opts.Output != "" {
+			names = nil
+			for _, c := range columns {
+				if !c.secret || opts.ShowSecrets {
+					names = append(names, c.name)
+				}
+			}
+		}
+	}
+	var cols []column
+	for _, n := range names {
+		c, err := lookupColumn(n)
+		if err != nil {
+			return err
+		}
+		if c.secret && !opts.ShowSecrets {
+			return fmt.Errorf("column %s is only shown with --show-secrets", c.name)
+		}
+		cols = append(cols, c)
+	}
+
+	peers, err := p.filter(opts)
+	if err != nil {
+		return err
+	}
+
+	var rows []row
+	for _, pr := range peers {
+		r := make(row, len(cols))
+		for i, c := range cols {
+			r[i] = cell{name: c.name, value: c.value(pr)}
+		}
+		rows = append(rows, r)
+	}
+
+	switch opts.Output {
+	case "table", "wide", "":
+		const padding = 3
+		tw := tabwriter.NewWriter(w, 0, 0, padding, ' ', tabwriter.AlignRight|tabwriter.Debug)
+		for _, c := range cols {
+			fmt.Fprint(tw, strings.ToUpper(c.name)+"\t")
+		}
+		fmt.Fprintln(tw)
+		for _, r := range rows {
+			for _, c := range r {
+				fmt.Fprint(tw, cellString(c.value)+"\t")
+			}
+			fmt.Fprintln(tw)
+		}
+		return tw.Flush()
+	case "csv":
+		cw := csv.NewWriter(w)
+		record := make([]string, len(cols))
+		for i, c := range cols {
+			record[i] = c.name
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+		for _, r := range rows {
+			for i, c := range r {
+				record[i] = cellString(c.value)
+			}
+			if err := cw.Write(record); err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	case "json":
+		if rows == nil {
+			rows = []row{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "    ")
+		return enc.Encode(rows)
+	case "yaml":
+		if rows == nil {
+			rows = []row{}
+		}
+		b, err := encodeYAML(rows)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	default:
+		return fmt.Errorf("unknown output %q, use one of table, wide, json, yaml, csv", opts.Output)
+	}
+}
+
+// filter will return the Peers matching opts, sorted if asked to
+func (p Peers) filter(opts PrintOptions) (Peers, error) {
+	type where struct {
+		c    column
+		want string
+	}
+	var wheres []where
+	for _, w := range opts.Where {
+		kv := strings.SplitN(w, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid filter %q, expected column=value", w)
+		}
+		c, err := lookupColumn(kv[0])
+		if err != nil {
+			return nil, err
+		}
+		if c.secret {
+			return nil, fmt.Errorf("cannot filter on column %s", c.name)
+		}
+		wheres = append(wheres, where{c, kv[1]})
+	}
+	if opts.Name != "" {
+		if _, err := path.Match(opts.Name, ""); err != nil {
+			return nil, fmt.Errorf("invalid name pattern %q: %v", opts.Name, err)
+		}
+	}
+
+	var out Peers
+	for _, pr := range p {
+		if opts.Name != "" {
+			if ok, _ := path.Match(opts.Name, pr.Name); !ok {
+				continue
+			}
+		}
+		keep := true
+		for _, w := range wheres {
+			if !w.c.matches(pr, w.want) {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			out = append(out, pr)
+		}
+	}
+
+	if opts.SortBy != "" {
+		c, err := lookupColumn(opts.SortBy)
+		if err != nil {
+			return nil, err
+		}
+		sort.SliceStable(out, func(i, j int) bool {
+			a, b := c.value(out[i]), c.value(out[j])
+			if x, ok := a.(int); ok {
+				return x < b.(int)
+			}
+			return cellString(a) < cellString(b)
+		})
+	}
+	return out, nil
+}
@@ -0,0 +1,201 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package wireguard
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+var printPeers = Peers{
+	{Name: "web1", Role: "web", Address: []string{"10.0.0.2/32"}, ListenPort: 51820, Endpoint: "web1.example.com", Tags: []string{"prod", "web"}, PrivateKey: "c2VjcmV0"},
+	{Name: "db1", Role: "db", Address: []string{"10.0.0.3/32"}, ListenPort: 51821, Endpoint: "db1.example.com", Tags: []string{"prod"}, PrivateKey: "c2VjcmV0"},
+	{Name: "laptop", Address: []string{"10.0.0.4/32"}, Type: TypeRoaming, Tags: []string{"dev"}, PrivateKey: "c2VjcmV0"},
+}
+
+// printed will run Print and return the names of the rows
+// of its csv output
+func printed(t *testing.T, opts PrintOptions) []string {
+	t.Helper()
+	opts.Output, opts.Columns = "csv", []string{"name"}
+	var b bytes.Buffer
+	if err := printPeers.Print(&b, opts); err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(&b).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, r := range records[1:] {
+		names = append(names, r[0])
+	}
+	return names
+}
+
+func TestPrintOutputs(t *testing.T) {
+	tests := []struct {
+		output string
+		check  func(t *testing.T, out string)
+	}{
+		{"", func(t *testing.T, out string) {
+			lines := strings.Split(strings.TrimSpace(out), "\n")
+			if len(lines) != 4 || !strings.Contains(lines[0], "NAME|") || !strings.Contains(lines[0], "PUBLICKEY|") {
+				t.Errorf("table:\n%s", out)
+			}
+			if strings.Contains(lines[0], "TAGS") {
+				t.Error("table holds the wide columns")
+			}
+		}},
+		{"wide", func(t *testing.T, out string) {
+			if !strings.Contains(out, "TAGS|") || !strings.Contains(out, "prod,web|") {
+				t.Errorf("wide:\n%s", out)
+			}
+			if strings.Contains(out, "PRIVATEKEY") {
+				t.Error("wide holds the private key")
+			}
+		}},
+		{"json", func(t *testing.T, out string) {
+			var rows []map[string]interface{}
+			if err := json.Unmarshal([]byte(out), &rows); err != nil {
+				t.Fatal(err)
+			}
+			if len(rows) != 3 || rows[0]["name"] != "web1" || rows[2]["type"] != TypeRoaming {
+				t.Errorf("json: %v", rows)
+			}
+			if _, ok := rows[0]["privatekey"]; ok {
+				t.Error("json holds the private key")
+			}
+			// the column order is kept
+			if strings.Index(out, `"name"`) > strings.Index(out, `"role"`) {
+				t.Error("json columns out of order")
+			}
+		}},
+		{"yaml", func(t *testing.T, out string) {
+			var rows []map[string]interface{}
+			if err := yaml.Unmarshal([]byte(out), &rows); err != nil {
+				t.Fatal(err)
+			}
+			if len(rows) != 3 || rows[1]["name"] != "db1" || rows[1]["listenport"] != 51821 {
+				t.Errorf("yaml: %v", rows)
+			}
+		}},
+		{"csv", func(t *testing.T, out string) {
+			records, err := csv.NewReader(strings.NewReader(out)).ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != 4 || records[0][0] != "name" || records[1][0] != "web1" {
+				t.Errorf("csv: %v", records)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.output, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := printPeers.Print(&b, PrintOptions{Output: tt.output}); err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, b.String())
+		})
+	}
+
+	if err := printPeers.Print(&bytes.Buffer{}, PrintOptions{Output: "xml"}); err == nil {
+		t.Error("unknown output accepted")
+	}
+}
+
+func TestPrintEmpty(t *testing.T) {
+	for _, output := range []string{"json", "yaml"} {
+		var b bytes.Buffer
+		if err := (Peers{}).Print(&b, PrintOptions{Output: output}); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.TrimSpace(b.String()); got != "[]" {
+			t.Errorf("%s: got %q, expected []", output, got)
+		}
+	}
+}
+
+func TestPrintFilters(t *testing.T) {
+	tests := []struct {
+		name string
+		opts PrintOptions
+		want string
+		err  bool
+	}{
+		{"all", PrintOptions{}, "web1,db1,laptop", false},
+		{"where", PrintOptions{Where: []string{"role=db"}}, "db1", false},
+		{"where is case insensitive", PrintOptions{Where: []string{"ROLE=WEB"}}, "web1", false},
+		{"where on a list", PrintOptions{Where: []string{"tags=prod"}}, "web1,db1", false},
+		{"all wheres match", PrintOptions{Where: []string{"tags=prod", "role=web"}}, "web1", false},
+		{"where on the default type", PrintOptions{Where: []string{"type=server"}}, "web1,db1", false},
+		{"name glob", PrintOptions{Name: "*1"}, "web1,db1", false},
+		{"sort by name", PrintOptions{SortBy: "name"}, "db1,laptop,web1", false},
+		{"sort by number", PrintOptions{SortBy: "listenport"}, "laptop,web1,db1", false},
+		{"bad where", PrintOptions{Where: []string{"role"}}, "", true},
+		{"unknown column", PrintOptions{Where: []string{"colour=red"}}, "", true},
+		{"where on a secret", PrintOptions{Where: []string{"privatekey=x"}, ShowSecrets: true}, "", true},
+		{"bad glob", PrintOptions{Name: "["}, "", true},
+		{"unknown sort", PrintOptions{SortBy: "colour"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.err {
+				opts := tt.opts
+				opts.Output = "csv"
+				if err := printPeers.Print(&bytes.Buffer{}, opts); err == nil {
+					t.Error("no error")
+				}
+				return
+			}
+			if got := strings.Join(printed(t, tt.opts), ","); got != tt.want {
+				t.Errorf("got %s, expected %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrintSecrets(t *testing.T) {
+	if err := printPeers.Print(&bytes.Buffer{}, PrintOptions{Columns: []string{"name", "privatekey"}}); err == nil {
+		t.Error("private key printed without ShowSecrets")
+	}
+	var b bytes.Buffer
+	if err := printPeers.Print(&b, PrintOptions{Columns: []string{"name", "privatekey"}, ShowSecrets: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "c2VjcmV0") {
+		t.Errorf("private key not printed:\n%s", b.String())
+	}
+	b.Reset()
+	if err := printPeers.Print(&b, PrintOptions{Output: "json", ShowSecrets: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), `"privatekey"`) {
+		t.Error("json with ShowSecrets has no private key")
+	}
+}
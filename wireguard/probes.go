@@ -0,0 +1,129 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package wireguard
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Probe is what a Peer measured towards another one
+type Probe struct {
+	From     string
+	To       string
+	Sent     int
+	Received int
+	// RTT is the average round trip time and Jitter the mean
+	// difference between two consecutive round trips
+	RTT    time.Duration
+	Jitter time.Duration
+	At     time.Time
+}
+
+// Loss will return the share of the probes that got no answer
+func (pb Probe) Loss() float64 {
+	if pb.Sent == 0 {
+		return 0
+	}
+	return float64(pb.Sent-pb.Received) / float64(pb.Sent)
+}
+
+// ProbeTarget is a Peer another one should probe
+type ProbeTarget struct {
+	Name    string
+	Address string
+}
+
+// ProbeTargets will return the Peers pr can reach, directly or
+// through a relay, with the first of their mesh addresses
+func (p Peers) ProbeTargets(pr Peer, links Links) []ProbeTarget {
+	var targets []ProbeTarget
+	for _, other := range p {
+		if !visible(pr, other) || !p.route(pr, other, links).OK() {
+			continue
+		}
+		addrs := other.Addrs()
+		if len(addrs) == 0 {
+			continue
+		}
+		targets = append(targets, ProbeTarget{Name: other.Name, Address: addrs[0].String()})
+	}
+	return targets
+}
+
+// Probe will return the latest measurement made by from, if any
+func (l Link) Probe(from string) (Probe, bool) {
+	for _, pb := range l.Probes {
+		if strings.EqualFold(pb.From, from) {
+			return pb, true
+		}
+	}
+	return Probe{}, false
+}
+
+// Latency will return the average round trip time of the
+// directions of the Link that got answers
+func (l Link) Latency() (time.Duration, bool) {
+	var sum time.Duration
+	n := 0
+	for _, pb := range l.Probes {
+		if pb.Received > 0 {
+			sum += pb.RTT
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, false
+	}
+	return sum / time.Duration(n), true
+}
+
+// RecordProbes will keep the latest Probe of each direction
+// on the Links between the Peers
+func (l *Links) RecordProbes(probes []Probe) error {
+	for _, pb := range probes {
+		if pb.From == "" || pb.To == "" || strings.EqualFold(pb.From, pb.To) {
+			return fmt.Errorf("%w: probe from %q to %q", ErrInvalidReport, pb.From, pb.To)
+		}
+		if pb.Received < 0 || pb.Received > pb.Sent {
+			return fmt.Errorf("%w: %d of %d probes received", ErrInvalidReport, pb.Received, pb.Sent)
+		}
+		i := l.index(pb.From, pb.To)
+		if i < 0 {
+			a, b := linkKey(pb.From, pb.To)
+			*l = append(*l, Link{A: a, B: b})
+			i = len(*l) - 1
+		}
+		ln := &(*l)[i]
+		replaced := false
+		for j := range ln.Probes {
+			if strings.EqualFold(ln.Probes[j].From, pb.From) {
+				ln.Probes[j], replaced = pb, true
+			}
+		}
+		if !replaced {
+			ln.Probes = append(ln.Probes, pb)
+		}
+	}
+	return l.DumpLinks()
+}
@@ -0,0 +1,131 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package wireguard
+
+// Route is the path traffic between two Peers takes
+type Route struct {
+	From string
+	To   string
+	// Via is the relay the traffic goes through, empty when the
+	// Peers have a tunnel of their own or no path at all
+	Via string
+	// Direct is false when the Peers cannot have a tunnel
+	// of their own, Reason tells why
+	Direct bool
+	Reason string
+}
+
+// OK will tell whether the Peers of the Route can talk
+func (r Route) OK() bool {
+	return r.Direct || r.Via != ""
+}
+
+// Routes will return the path taken by every pair of Peers seeing
+// each other
+func (p Peers) Routes(links Links) []Route {
+	var routes []Route
+	for i := range p {
+		for j := i + 1; j < len(p); j++ {
+			if visible(p[i], p[j]) {
+				routes = append(routes, p.route(p[i], p[j], links))
+			}
+		}
+	}
+	return routes
+}
+
+// route will return the path from a to b, going through the
+// first relay with a tunnel to both when they cannot have their own
+func (p Peers) route(a, b Peer, links Links) Route {
+	r := Route{From: a.Name, To: b.Name}
+	if r.Direct, r.Reason = direct(a, b, links); r.Direct {
+		return r
+	}
+	// relays are tried in registry order so that
+	// both ends of a pair agree on the same one
+	for _, relay := range p {
+		if !relay.Relay || !visible(relay, a) || !visible(relay, b) {
+			continue
+		}
+		if ok, _ := direct(a, relay, links); !ok {
+			continue
+		}
+		if ok, _ := direct(relay, b, links); !ok {
+			continue
+		}
+		r.Via = relay.Name
+		return r
+	}
+	return r
+}
+
+// visible will tell whether a and b are part of the same mesh
+func visible(a, b Peer) bool {
+	return a.Name != b.Name && a.Network == b.Network && !a.Pending && !b.Pending
+}
+
+// direct will tell whether a and b can have a tunnel
+// of their own, and why not when they cannot
+func direct(a, b Peer, links Links) (bool, string) {
+	l := links.Get(a.Name, b.Name)
+	if l.Disabled {
+		return false, "disabled"
+	}
+	if l.NoDirect {
+		return false, "marked as having no direct path"
+	}
+	if a.Type == TypeRoaming && b.Type == TypeRoaming {
+		return false, "both are roaming"
+	}
+	if links.endpoint(a, b) == "" && links.endpoint(b, a) == "" {
+		if a.NAT == NATSymmetric && b.NAT == NATSymmetric {
+			return false, "both are behind symmetric NAT"
+		}
+		return false, "neither has an endpoint the other can reach"
+	}
+	return true, ""
+}
+
+// forwarding will return the PostUp and PostDown commands
+// letting a relay forward traffic between its Peers
+func forwarding(ipv6 bool) ([]string, []string) {
+	up := []string{
+		"sysctl -q -w net.ipv4.ip_forward=1",
+		"iptables -A FORWARD -i %i -o %i -j ACCEPT",
+	}
+	down := []string{"iptables -D FORWARD -i %i -o %i -j ACCEPT"}
+	if ipv6 {
+		up = append(up, "sysctl -q -w net.ipv6.conf.all.forwarding=1", "ip6tables -A FORWARD -i %i -o %i -j ACCEPT")
+		down = append(down, "ip6tables -D FORWARD -i %i -o %i -j ACCEPT")
+	}
+	return up, down
+}
+
+// hasIPv6 will tell whether any of the addresses is IPv6
+func hasIPv6(addresses []string) bool {
+	for _, a := range addresses {
+		if pfx, err := ParseAddress(a); err == nil && pfx.Addr().Is6() {
+			return true
+		}
+	}
+	return false
+}
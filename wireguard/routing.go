@@ -0,0 +1,369 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package wireguard
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Routing daemons GenerateRouted can write configs for
+const (
+	RoutingBird  = "bird"
+	RoutingBabel = "babel"
+)
+
+// DefaultCost is the cost of a link without weight or measurements
+const DefaultCost = 100
+
+// tunnelPrefix starts the names of the point-to-point interfaces
+const tunnelPrefix = "gm-"
+
+// Tunnel is a point-to-point interface of a Peer in the routed mode,
+// it carries everything and a routing daemon picks the paths
+type Tunnel struct {
+	Peer      string
+	Interface string
+	// Local and Remote are the link-local addresses of the two ends
+	Local  string
+	Remote string
+	Cost   int
+	Config Config
+}
+
+// Cost will return the configured weight of the Link or else ten
+// times its round trip in milliseconds, DefaultCost if not measured
+func (l Link) Cost() int {
+	if l.Weight > 0 {
+		return l.Weight
+	}
+	rtt, ok := l.Latency()
+	if !ok {
+		return DefaultCost
+	}
+	cost := int(rtt.Microseconds() / 100)
+	switch {
+	case cost < 1:
+		return 1
+	case cost > 65535:
+		return 65535
+	}
+	return cost
+}
+
+// LinkLocal will return the link-local addresses of the two ends of
+// the Link, A first, in a /64 of their own so that every link of the
+// mesh can be told apart
+func (l Link) LinkLocal() (string, string) {
+	a, b := linkKey(l.A, l.B)
+	sum := sha256.Sum256([]byte(a + "|" + b))
+	base := fmt.Sprintf("fe80::%x:%x:0", uint16(sum[0])<<8|uint16(sum[1]), uint16(sum[2])<<8|uint16(sum[3]))
+	return base + ":1/64", base + ":2/64"
+}
+
+var ifaceName = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// tunnelInterface will return the name of the interface towards a Peer
+func tunnelInterface(peer string) string {
+	return interfaceName(tunnelPrefix, peer)
+}
+
+// interfaceName will return prefix and the lowercased name, hashed
+// when the name does not fit the 15 characters Linux allows
+func interfaceName(prefix, name string) string {
+	name = strings.ToLower(name)
+	if len(prefix+name) <= 15 && ifaceName.MatchString(name) {
+		return prefix + name
+	}
+	sum := sha256.Sum256([]byte(name))
+	return prefix + hex.EncodeToString(sum[:])[:15-len(prefix)]
+}
+
+// Ports the tunnels of the routed mode listen on, away from the
+// default ListenPort and the probe port
+const (
+	tunnelPortBase = 52000
+	tunnelPorts    = 8000
+)
+
+// pairPort will return the port of the tunnel between a and b, the
+// same for both ends and whatever the order of the registry
+func pairPort(a, b string) int {
+	a, b = linkKey(a, b)
+	sum := sha256.Sum256([]byte(a + "|" + b))
+	return tunnelPortBase + int(binary.BigEndian.Uint32(sum[:4])%tunnelPorts)
+}
+
+// tunnelPort is where owner listens for remote, the port of their pair
+// or, when another pair of owner got it first in name order, the
+// next free one
+func (p Peers) tunnelPort(owner, remote Peer) int {
+	if owner.ListenPort == 0 {
+		return 0
+	}
+	var names []string
+	for _, pr := range p {
+		if !strings.EqualFold(pr.Name, owner.Name) {
+			names = append(names, strings.ToLower(pr.Name))
+		}
+	}
+	sort.Strings(names)
+	used := map[int]bool{owner.ListenPort: true}
+	for _, n := range names {
+		port := pairPort(owner.Name, n)
+		for used[port] {
+			port = tunnelPortBase + (port-tunnelPortBase+1)%tunnelPorts
+		}
+		if strings.EqualFold(n, remote.Name) {
+			return port
+		}
+		used[port] = true
+	}
+	return 0
+}
+
+// Tunnels will return a tunnel for every Peer pr has a direct path to
+func (p Peers) Tunnels(pr Peer, links Links) ([]Tunnel, error) {
+	pol, err := LoadPolicy()
+	if err != nil {
+		return nil, err
+	}
+	var tunnels []Tunnel
+	for j := range p {
+		if !visible(pr, p[j]) || !p.route(pr, p[j], links).Direct {
+			continue
+		}
+		pub, err := p[j].Public()
+		if err != nil {
+			return nil, err
+		}
+		l := links.Get(pr.Name, p[j].Name)
+		local, remote := l.LinkLocal()
+		if !strings.EqualFold(l.A, pr.Name) {
+			local, remote = remote, local
+		}
+		// the endpoint of the node gets the port of the tunnel,
+		// one set on the link is used as it is
+		ep := links.endpoint(pr, p[j])
+		if l.Endpoints[strings.ToLower(pr.Name)] == "" {
+			if host, _, err := net.SplitHostPort(ep); err == nil {
+				ep = net.JoinHostPort(host, strconv.Itoa(p.tunnelPort(p[j], pr)))
+			}
+		}
+		addresses := append([]string{local}, pr.hostPrefixes()...)
+		up, down := tunnelRules(pol, p, pr, tunnelInterface(p[j].Name))
+		mtu := pr.MTU
+		if l.MTU != 0 {
+			mtu = l.MTU
+		}
+		tunnels = append(tunnels, Tunnel{
+			Peer:      p[j].Name,
+			Interface: tunnelInterface(p[j].Name),
+			Local:     local,
+			Remote:    remote,
+			Cost:      l.Cost(),
+			Config: Config{
+				Name: pr.Name,
+				Interface: Interface{
+					PrivateKey: pr.PrivateKey,
+					Address:    addresses,
+					ListenPort: p.tunnelPort(pr, p[j]),
+					MTU:        mtu,
+					Table:      "off",
+					PostUp:     up,
+					PostDown:   down,
+				},
+				Peers: []PeerConfig{{
+					Name:       p[j].Name,
+					PublicKey:  pub,
+					Endpoint:   ep,
+					AllowedIPs: []string{"0.0.0.0/0", "::/0"},
+
+					PersistentKeepalive: links.keepalive(pr, p[j]),
+				}},
+			},
+		})
+	}
+	return tunnels, nil
+}
+
+// tunnelRules will return the PostUp and PostDown commands of a
+// tunnel of pr: forwarding, the rules of the subnets pr is a gateway
+// of and the policy, in an nftables table of the tunnel's own so
+// that one going down does not take the others' rules with it
+func tunnelRules(pol *Policy, p Peers, pr Peer, iface string) ([]string, []string) {
+	fwd, _ := forwarding(hasIPv6(pr.Address))
+	up := sysctls(fwd)
+	gwUp, down := gatewayRules(pr.Subnets)
+	for _, u := range gwUp {
+		if !contains(up, u) {
+			up = append(up, u)
+		}
+	}
+	fwUp, fwDown := pol.firewall(p, pr, "gomesh-"+iface)
+	return append(up, fwUp...), append(down, fwDown...)
+}
+
+// sysctls will keep the sysctl commands of up, the routing daemon
+// needs forwarding but no firewall rules between the tunnels
+func sysctls(up []string) []string {
+	var out []string
+	for _, u := range up {
+		if strings.HasPrefix(u, "sysctl") {
+			out = append(out, u)
+		}
+	}
+	return out
+}
+
+// BirdConfig will return a BIRD 2 config running OSPFv3 over the
+// tunnels, announcing the mesh addresses and the subnets of pr
+func (p Peers) BirdConfig(pr Peer, tunnels []Tunnel) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Generated by gomesh for %s\n", strings.ToLower(pr.Name))
+	fmt.Fprintf(&b, "router id %s;\n", routerID(pr))
+	b.WriteString("\nprotocol device {\n}\n")
+	fmt.Fprintf(&b, "\nprotocol direct {\n\tipv4;\n\tipv6;\n\tinterface \"%s*\";\n}\n", tunnelPrefix)
+	subnets := p.served(pr)
+	families := []string{"ipv4"}
+	if hasIPv6(pr.Address) || hasIPv6(subnets) {
+		families = append(families, "ipv6")
+	}
+	for _, af := range families {
+		fmt.Fprintf(&b, "\nprotocol kernel {\n\t%s {\n\t\texport where source = RTS_OSPF;\n\t};\n}\n", af)
+	}
+	var static []string
+	for _, s := range subnets {
+		static = append(static, fmt.Sprintf("\troute %s unreachable;\n", s))
+	}
+	// only there to be announced, the kernel
+	// has the real routes of the subnets
+	if v4 := filterFamily(static, false); len(v4) > 0 {
+		fmt.Fprintf(&b, "\nprotocol static {\n\tipv4;\n%s}\n", strings.Join(v4, ""))
+	}
+	if v6 := filterFamily(static, true); len(v6) > 0 {
+		fmt.Fprintf(&b, "\nprotocol static {\n\tipv6;\n%s}\n", strings.Join(v6, ""))
+	}
+	for _, af := range families {
+		export := "source ~ [ RTS_DEVICE, RTS_STATIC ]"
+		if af == "ipv6" {
+			export += " && net !~ [ fe80::/10+ ]"
+		}
+		fmt.Fprintf(&b, "\nprotocol ospf v3 mesh_%s {\n\t%s {\n\t\timport all;\n\t\texport where %s;\n\t};\n\tarea 0 {\n", strings.TrimPrefix(af, "ip"), af, export)
+		for _, t := range tunnels {
+			fmt.Fprintf(&b, "\t\tinterface \"%s\" {\n\t\t\ttype ptp;\n\t\t\tcost %d;\n\t\t};\n", t.Interface, t.Cost)
+		}
+		b.WriteString("\t};\n}\n")
+	}
+	return b.String()
+}
+
+// routerID will return the first IPv4 address of pr or else a
+// 32-bit id hashed from its name, OSPF needs one on IPv6-only nodes
+func routerID(pr Peer) string {
+	for _, a := range pr.Addrs() {
+		if a.Is4() {
+			return a.String()
+		}
+	}
+	sum := sha256.Sum256([]byte(strings.ToLower(pr.Name)))
+	return net.IP(sum[:4]).String()
+}
+
+// BabelConfig will return a babeld config running over the
+// tunnels, announcing the mesh addresses and the subnets of pr
+func (p Peers) BabelConfig(pr Peer, tunnels []Tunnel) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Generated by gomesh for %s\n", strings.ToLower(pr.Name))
+	for _, t := range tunnels {
+		fmt.Fprintf(&b, "interface %s type tunnel rxcost %d\n", t.Interface, t.Cost)
+	}
+	for _, a := range pr.hostPrefixes() {
+		fmt.Fprintf(&b, "redistribute local ip %s allow\n", a)
+	}
+	for _, s := range p.served(pr) {
+		fmt.Fprintf(&b, "redistribute ip %s eq %s allow\n", s, s[strings.Index(s, "/")+1:])
+	}
+	b.WriteString("redistribute local deny\nredistribute deny\n")
+	return b.String()
+}
+
+// filterFamily will keep the lines holding IPv6 or IPv4 prefixes
+func filterFamily(lines []string, ipv6 bool) []string {
+	var out []string
+	for _, l := range lines {
+		if strings.Contains(l, ":") == ipv6 {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// GenerateRouted will write, for each Peer, a wg-quick config for
+// each of its tunnels and the config of the routing daemon into a
+// folder named after the Peer
+func (p Peers) GenerateRouted(folder string, peername string, daemon string) error {
+	if daemon != RoutingBird && daemon != RoutingBabel {
+		return fmt.Errorf("unknown routing daemon %q, use %s or %s", daemon, RoutingBird, RoutingBabel)
+	}
+	links, err := LoadLinks()
+	if err != nil {
+		return err
+	}
+	for _, pr := range p {
+		if (peername != "" && pr.Name != peername) || pr.Pending {
+			continue
+		}
+		tunnels, err := p.Tunnels(pr, links)
+		if err != nil {
+			return err
+		}
+		dir := filepath.Join(folder, strings.ToLower(pr.Name))
+		if !useStdOut {
+			if err = os.MkdirAll(dir, 0775); err != nil {
+				return err
+			}
+		}
+		for _, t := range tunnels {
+			if _, err = writeOutput(filepath.Join(dir, t.Interface+".conf"), []byte(t.Config.String())); err != nil {
+				return err
+			}
+		}
+		name, conf := "bird.conf", p.BirdConfig(pr, tunnels)
+		if daemon == RoutingBabel {
+			name, conf = "babeld.conf", p.BabelConfig(pr, tunnels)
+		}
+		if _, err = writeOutput(filepath.Join(dir, name), []byte(conf)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
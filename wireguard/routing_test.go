@@ -0,0 +1,215 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package wireguard
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func routedPeers(t *testing.T, names ...string) Peers {
+	t.Helper()
+	var p Peers
+	for i, n := range names {
+		p = append(p, Peer{
+			Name:       n,
+			Address:    []string{fmt.Sprintf("10.0.0.%d/32", i+1)},
+			Endpoint:   n + ".example.com",
+			ListenPort: 51820,
+			PrivateKey: mustKey(t),
+		})
+	}
+	return p
+}
+
+func TestTunnelPort(t *testing.T) {
+	p := routedPeers(t, "web1", "db1", "relay1")
+	for _, a := range p {
+		seen := map[int]bool{}
+		for _, b := range p {
+			if a.Name == b.Name {
+				continue
+			}
+			port := p.tunnelPort(a, b)
+			if port < tunnelPortBase || port >= tunnelPortBase+tunnelPorts {
+				t.Errorf("%s-%s: port %d out of range", a.Name, b.Name, port)
+			}
+			if seen[port] {
+				t.Errorf("%s: port %d used twice", a.Name, port)
+			}
+			seen[port] = true
+		}
+	}
+
+	// the order of the registry and new peers do not move the port
+	want := p.tunnelPort(p[0], p[1])
+	q := append(Peers{p[2], p[1]}, p[0])
+	q = append(q, routedPeers(t, "zz1")...)
+	if got := q.tunnelPort(p[0], p[1]); got != want {
+		t.Errorf("got %d, expected %d", got, want)
+	}
+	if got := p.tunnelPort(Peer{Name: "web1"}, p[1]); got != 0 {
+		t.Errorf("no ListenPort: got %d", got)
+	}
+}
+
+func TestTunnels(t *testing.T) {
+	tempRegistry(t)
+	p := routedPeers(t, "web1", "db1")
+	web, err := p.Tunnels(p[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := p.Tunnels(p[1], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(web) != 1 || len(db) != 1 {
+		t.Fatalf("got %d and %d tunnels", len(web), len(db))
+	}
+	port := web[0].Config.Interface.ListenPort
+	if port == 51820 || port == 51821 || port != db[0].Config.Interface.ListenPort {
+		t.Errorf("ports %d and %d", port, db[0].Config.Interface.ListenPort)
+	}
+	if ep := web[0].Config.Peers[0].Endpoint; ep != "db1.example.com:"+strconv.Itoa(port) {
+		t.Errorf("endpoint %s", ep)
+	}
+	if web[0].Local != db[0].Remote || web[0].Remote != db[0].Local {
+		t.Errorf("link-local %s-%s and %s-%s", web[0].Local, web[0].Remote, db[0].Local, db[0].Remote)
+	}
+}
+
+func TestTunnelEndpointOverride(t *testing.T) {
+	tempRegistry(t)
+	p := routedPeers(t, "web1", "db1")
+	links := Links{{A: "db1", B: "web1", Endpoints: map[string]string{"web1": "203.0.113.5:4500"}}}
+	web, err := p.Tunnels(p[0], links)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := p.Tunnels(p[1], links)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ep := web[0].Config.Peers[0].Endpoint; ep != "203.0.113.5:4500" {
+		t.Errorf("override: %s", ep)
+	}
+	if ep := db[0].Config.Peers[0].Endpoint; ep != "web1.example.com:"+strconv.Itoa(db[0].Config.Interface.ListenPort) {
+		t.Errorf("other end: %s", ep)
+	}
+}
+
+func TestTunnelRules(t *testing.T) {
+	tempRegistry(t)
+	p := routedPeers(t, "web1", "db1", "gw1")
+	p[0].Tags = []string{"web"}
+	p[1].Tags = []string{"db"}
+	p[2].Subnets = []Subnet{{Prefix: "192.168.10.0/24", Masquerade: true}}
+	if err := os.WriteFile(SidecarPath("policy"), []byte("allow tag:web -> tag:db port 5432/tcp"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := p.Tunnels(p[1], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(db) != 2 {
+		t.Fatalf("got %d tunnels", len(db))
+	}
+	for _, tn := range db {
+		up, down := tn.Config.Interface.PostUp, tn.Config.Interface.PostDown
+		table := "inet gomesh-" + tn.Interface
+		if !contains(up, "nft add rule "+table+" input iifname %i ip saddr { 10.0.0.1 } tcp dport { 5432 } accept") ||
+			!contains(up, "nft add rule "+table+" input iifname %i drop") {
+			t.Errorf("%s: PostUp\n%s", tn.Interface, strings.Join(up, "\n"))
+		}
+		if !contains(down, "nft delete table "+table) {
+			t.Errorf("%s: PostDown %v", tn.Interface, down)
+		}
+	}
+
+	gw, err := p.Tunnels(p[2], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tn := range gw {
+		up, down := tn.Config.Interface.PostUp, tn.Config.Interface.PostDown
+		want := []string{
+			"sysctl -q -w net.ipv4.ip_forward=1",
+			"iptables -A FORWARD -i %i -d 192.168.10.0/24 -j ACCEPT",
+			"iptables -A FORWARD -o %i -s 192.168.10.0/24 -j ACCEPT",
+			"iptables -A POSTROUTING -t nat ! -o %i -d 192.168.10.0/24 -j MASQUERADE",
+		}
+		// the policy filters what reaches gw1 itself too
+		if len(up) < len(want) || strings.Join(up[:len(want)], "\n") != strings.Join(want, "\n") ||
+			!contains(down, "iptables -D POSTROUTING -t nat ! -o %i -d 192.168.10.0/24 -j MASQUERADE") {
+			t.Errorf("%s: PostUp\n%s\nPostDown\n%s", tn.Interface, strings.Join(up, "\n"), strings.Join(down, "\n"))
+		}
+	}
+}
+
+func TestBirdConfig(t *testing.T) {
+	tempRegistry(t)
+	p := routedPeers(t, "web1", "db1")
+	p[1].Address = []string{"fd00::2/128"}
+	p[1].Subnets = []Subnet{{Prefix: "fd00:10::/64"}}
+	p[0].Subnets = []Subnet{{Prefix: "192.168.10.0/24"}}
+
+	tests := []struct {
+		peer     Peer
+		routerID string
+		static   []string
+	}{
+		{peer: p[0], routerID: "10.0.0.1", static: []string{"\nprotocol static {\n\tipv4;\n\troute 192.168.10.0/24 unreachable;\n}\n"}},
+		{peer: p[1], static: []string{"\nprotocol static {\n\tipv6;\n\troute fd00:10::/64 unreachable;\n}\n"}},
+	}
+	for _, tt := range tests {
+		tunnels, err := p.Tunnels(tt.peer, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conf := p.BirdConfig(tt.peer, tunnels)
+		var id string
+		if _, err = fmt.Sscanf(conf[strings.Index(conf, "router id "):], "router id %s", &id); err != nil {
+			t.Fatalf("%s: no router id:\n%s", tt.peer.Name, conf)
+		}
+		id = strings.TrimSuffix(id, ";")
+		if ip := net.ParseIP(id); ip.To4() == nil || (tt.routerID != "" && id != tt.routerID) {
+			t.Errorf("%s: router id %s", tt.peer.Name, id)
+		}
+		if strings.Count(conf, "protocol static") != len(tt.static) {
+			t.Errorf("%s:\n%s", tt.peer.Name, conf)
+		}
+		for _, s := range tt.static {
+			if !strings.Contains(conf, s) {
+				t.Errorf("%s: no\n%s\nin\n%s", tt.peer.Name, s, conf)
+			}
+		}
+	}
+	if routerID(p[1]) != routerID(Peer{Name: "DB1"}) {
+		t.Error("router id is not stable")
+	}
+}
@@ -0,0 +1,107 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package wireguard
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SignatureScheme is the Authorization scheme of signed node requests
+const SignatureScheme = "WireGuard"
+
+// MaxClockSkew is how far the time of a signed request
+// may be from the time it is verified
+const MaxClockSkew = 5 * time.Minute
+
+// requestMAC will authenticate method, uri, ts and the body with a key
+// derived from the X25519 shared secret of the node and the server, only
+// the two of them can compute it. The uri holds the query string, so
+// neither it nor the body can be changed in a captured request
+func requestMAC(shared []byte, method, uri, ts string, body []byte) []byte {
+	key := sha256.Sum256(append([]byte("gomesh node request\x00"), shared...))
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte(method + "\n" + uri + "\n" + ts + "\n" + hex.EncodeToString(sum[:])))
+	return mac.Sum(nil)
+}
+
+// SignRequest will return the Authorization header authenticating
+// a request of the named node with its WireGuard private key, uri is
+// the path and query of the request
+func SignRequest(name, privateKey, serverPublicKey, method, uri string, body []byte, now time.Time) (string, error) {
+	shared, err := SharedKey(privateKey, serverPublicKey)
+	if err != nil {
+		return "", err
+	}
+	ts := strconv.FormatInt(now.Unix(), 10)
+	v := url.Values{}
+	v.Set("name", name)
+	v.Set("ts", ts)
+	v.Set("sig", base64.RawURLEncoding.EncodeToString(requestMAC(shared, method, uri, ts, body)))
+	return SignatureScheme + " " + v.Encode(), nil
+}
+
+// VerifyRequest will check an Authorization header made by SignRequest
+// and return the name of the node that signed it, lookup must return
+// the public key of the named node
+func VerifyRequest(header, serverPrivateKey string, lookup func(name string) (string, error), method, uri string, body []byte, now time.Time) (string, error) {
+	if !strings.HasPrefix(header, SignatureScheme+" ") {
+		return "", errors.New("not a signed request")
+	}
+	v, err := url.ParseQuery(strings.TrimPrefix(header, SignatureScheme+" "))
+	if err != nil {
+		return "", err
+	}
+	name, ts := v.Get("name"), v.Get("ts")
+	sig, err := base64.RawURLEncoding.DecodeString(v.Get("sig"))
+	if err != nil {
+		return "", err
+	}
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return "", err
+	}
+	if d := now.Sub(time.Unix(sec, 0)); d > MaxClockSkew || d < -MaxClockSkew {
+		return "", fmt.Errorf("request time is off by %s", d)
+	}
+	pub, err := lookup(name)
+	if err != nil {
+		return "", err
+	}
+	shared, err := SharedKey(serverPrivateKey, pub)
+	if err != nil {
+		return "", err
+	}
+	if !hmac.Equal(sig, requestMAC(shared, method, uri, ts, body)) {
+		return "", errors.New("bad signature")
+	}
+	return name, nil
+}
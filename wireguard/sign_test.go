@@ -0,0 +1,68 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package wireguard
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSignRequest(t *testing.T) {
+	nodeKey, _ := GenerateKey()
+	nodePub, _ := PublicKey(nodeKey)
+	serverKey, _ := GenerateKey()
+	serverPub, _ := PublicKey(serverKey)
+	lookup := func(name string) (string, error) { return nodePub, nil }
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"Endpoint":"192.0.2.1:51820"}`)
+
+	h, err := SignRequest("a", nodeKey, serverPub, "POST", "/v1/nodes/a/report", body, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		method string
+		uri    string
+		body   []byte
+		at     time.Time
+		ok     bool
+	}{
+		{"as signed", "POST", "/v1/nodes/a/report", body, now, true},
+		{"other body", "POST", "/v1/nodes/a/report", []byte(`{"Endpoint":"198.51.100.1:51820"}`), now, false},
+		{"other query", "POST", "/v1/nodes/a/report?x=1", body, now, false},
+		{"other method", "PUT", "/v1/nodes/a/report", body, now, false},
+		{"other path", "POST", "/v1/nodes/a/probes", body, now, false},
+		{"too late", "POST", "/v1/nodes/a/report", body, now.Add(MaxClockSkew + time.Second), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, err := VerifyRequest(h, serverKey, lookup, tt.method, tt.uri, tt.body, tt.at)
+			if tt.ok && (err != nil || name != "a") {
+				t.Errorf("got %q, %v", name, err)
+			}
+			if !tt.ok && err == nil {
+				t.Error("verified")
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package wireguard
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Subnet is a LAN prefix a Peer routes into the mesh
+type Subnet struct {
+	Prefix string
+	// Standby subnets are only routed to the Peer when
+	// no other Peer announces the prefix as active
+	Standby bool `json:",omitempty"`
+	// Masquerade will NAT the mesh traffic going into the subnet
+	Masquerade bool `json:",omitempty"`
+}
+
+// Announcement is a Subnet together with the Peer announcing it
+type Announcement struct {
+	Peer    string
+	Network string
+	Subnet
+	// Active is true for the Peer the prefix is routed to
+	Active bool
+}
+
+// AddSubnet will make the named Peer announce a subnet,
+// it fails if the subnet overlaps another announcement
+func (p *Peers) AddSubnet(name string, s Subnet) error {
+	i := p.index(name)
+	if i < 0 {
+		return fmt.Errorf("%s: %w", name, ErrPeerNotFound)
+	}
+	_, ipnet, err := net.ParseCIDR(s.Prefix)
+	if err != nil {
+		return err
+	}
+	s.Prefix = ipnet.String()
+	for _, o := range (*p)[i].Subnets {
+		if o.Prefix == s.Prefix {
+			return fmt.Errorf("%s already announces %s", (*p)[i].Name, s.Prefix)
+		}
+	}
+
+	before := map[string]bool{}
+	for _, c := range p.SubnetConflicts() {
+		before[c] = true
+	}
+	(*p)[i].Subnets = append((*p)[i].Subnets, s)
+	for _, c := range p.SubnetConflicts() {
+		if !before[c] {
+			(*p)[i].Subnets = (*p)[i].Subnets[:len((*p)[i].Subnets)-1]
+			return errors.New(c)
+		}
+	}
+	return p.DumpPeers(true)
+}
+
+// DeleteSubnet will stop the named Peer announcing prefix
+func (p *Peers) DeleteSubnet(name string, prefix string) error {
+	i := p.index(name)
+	if i < 0 {
+		return fmt.Errorf("%s: %w", name, ErrPeerNotFound)
+	}
+	if _, ipnet, err := net.ParseCIDR(prefix); err == nil {
+		prefix = ipnet.String()
+	}
+	subnets := (*p)[i].Subnets
+	for j := range subnets {
+		if subnets[j].Prefix == prefix {
+			(*p)[i].Subnets = append(subnets[:j], subnets[j+1:]...)
+			return p.DumpPeers(true)
+		}
+	}
+	return fmt.Errorf("%s does not announce %s", (*p)[i].Name, prefix)
+}
+
+// PromoteSubnet will make the named Peer the active gateway of
+// prefix, the other Peers announcing it become standby
+func (p *Peers) PromoteSubnet(name string, prefix string) error {
+	i := p.index(name)
+	if i < 0 {
+		return fmt.Errorf("%s: %w", name, ErrPeerNotFound)
+	}
+	if _, ipnet, err := net.ParseCIDR(prefix); err == nil {
+		prefix = ipnet.String()
+	}
+	found := false
+	for j := range *p {
+		if (*p)[j].Network != (*p)[i].Network {
+			continue
+		}
+		for k := range (*p)[j].Subnets {
+			if (*p)[j].Subnets[k].Prefix == prefix {
+				(*p)[j].Subnets[k].Standby = j != i
+				found = found || j == i
+			}
+		}
+	}
+	if !found {
+		return fmt.Errorf("%s does not announce %s", (*p)[i].Name, prefix)
+	}
+	return p.DumpPeers(true)
+}
+
+// Announcements will return every subnet announced, telling
+// which Peer is the active gateway of each prefix
+func (p Peers) Announcements() []Announcement {
+	var out []Announcement
+	for _, pr := range p {
+		for _, s := range pr.Subnets {
+			out = append(out, Announcement{
+				Peer:    pr.Name,
+				Network: pr.Network,
+				Subnet:  s,
+				Active:  p.gateway(pr.Network, s.Prefix) == pr.Name,
+			})
+		}
+	}
+	return out
+}
+
+// SubnetConflicts will describe the announcements that overlap:
+// prefixes of different active gateways, prefixes announced as
+// active more than once and prefixes holding mesh addresses
+func (p Peers) SubnetConflicts() []string {
+	var conflicts []string
+	all := p.Announcements()
+	for i, a := range all {
+		_, an, err := net.ParseCIDR(a.Prefix)
+		if err != nil {
+			conflicts = append(conflicts, fmt.Sprintf("%s announces invalid prefix %s", a.Peer, a.Prefix))
+			continue
+		}
+		for _, b := range all[i+1:] {
+			if b.Network != a.Network || b.Peer == a.Peer {
+				continue
+			}
+			_, bn, err := net.ParseCIDR(b.Prefix)
+			if err != nil || !overlaps(an, bn) {
+				continue
+			}
+			switch {
+			case a.Prefix == b.Prefix && !a.Standby && !b.Standby:
+				conflicts = append(conflicts, fmt.Sprintf("%s and %s both announce %s as active", a.Peer, b.Peer, a.Prefix))
+			case a.Prefix != b.Prefix && a.Active && b.Active:
+				conflicts = append(conflicts, fmt.Sprintf("%s of %s overlaps %s of %s", a.Prefix, a.Peer, b.Prefix, b.Peer))
+			}
+		}
+		for _, pr := range p {
+			if pr.Network != a.Network {
+				continue
+			}
+			for _, addr := range pr.Addrs() {
+				if an.Contains(addr.AsSlice()) {
+					conflicts = append(conflicts, fmt.Sprintf("%s of %s holds the mesh address of %s", a.Prefix, a.Peer, pr.Name))
+				}
+			}
+		}
+	}
+	return conflicts
+}
+
+// gateway will return the name of the Peer prefix is routed to: the
+// first one announcing it as active, else the first standby one
+func (p Peers) gateway(network string, prefix string) string {
+	standby := ""
+	for _, pr := range p {
+		if pr.Network != network || pr.Pending {
+			continue
+		}
+		for _, s := range pr.Subnets {
+			if s.Prefix != prefix {
+				continue
+			}
+			if !s.Standby {
+				return pr.Name
+			}
+			if standby == "" {
+				standby = pr.Name
+			}
+		}
+	}
+	return standby
+}
+
+// served will return the prefixes routed to the Peer
+func (p Peers) served(pr Peer) []string {
+	var out []string
+	for _, s := range pr.Subnets {
+		if p.gateway(pr.Network, s.Prefix) == pr.Name {
+			out = append(out, s.Prefix)
+		}
+	}
+	return out
+}
+
+// gatewayRules will return the PostUp and PostDown commands letting
+// the Peer forward traffic between the mesh and its subnets
+func gatewayRules(subnets []Subnet) ([]string, []string) {
+	var up, down []string
+	for _, s := range subnets {
+		ipt, sysctl := "iptables", "sysctl -q -w net.ipv4.ip_forward=1"
+		if strings.Contains(s.Prefix, ":") {
+			ipt, sysctl = "ip6tables", "sysctl -q -w net.ipv6.conf.all.forwarding=1"
+		}
+		if !contains(up, sysctl) {
+			up = append(up, sysctl)
+		}
+		rules := []string{
+			fmt.Sprintf("FORWARD -i %%i -d %s -j ACCEPT", s.Prefix),
+			fmt.Sprintf("FORWARD -o %%i -s %s -j ACCEPT", s.Prefix),
+		}
+		if s.Masquerade {
+			rules = append(rules, fmt.Sprintf("POSTROUTING -t nat ! -o %%i -d %s -j MASQUERADE", s.Prefix))
+		}
+		for _, r := range rules {
+			up = append(up, ipt+" -A "+r)
+			down = append(down, ipt+" -D "+r)
+		}
+	}
+	return up, down
+}
+
+func overlaps(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
@@ -0,0 +1,61 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package wireguard
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGatewayConfig(t *testing.T) {
+	tempRegistry(t)
+	p := routedPeers(t, "gw1", "web1")
+	// a relay enables forwarding itself and the registry may
+	// already hold one of the rules, none is run twice
+	p[0].Relay = true
+	p[0].Subnets = []Subnet{{Prefix: "192.168.10.0/24", Masquerade: true}, {Prefix: "fd00:10::/64"}}
+	p[0].PostUp = "iptables -A FORWARD -i %i -d 192.168.10.0/24 -j ACCEPT"
+	p[0].PostDown = "iptables -D FORWARD -i %i -d 192.168.10.0/24 -j ACCEPT"
+
+	c, err := p.Config(p[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cmds := range [][]string{c.Interface.PostUp, c.Interface.PostDown} {
+		seen := map[string]bool{}
+		for _, cmd := range cmds {
+			if seen[cmd] {
+				t.Errorf("%q twice in\n%s", cmd, strings.Join(cmds, "\n"))
+			}
+			seen[cmd] = true
+		}
+	}
+	// every rule added is removed
+	for _, up := range c.Interface.PostUp {
+		if strings.Contains(up, " -A ") && !contains(c.Interface.PostDown, strings.Replace(up, " -A ", " -D ", 1)) {
+			t.Errorf("%q is not removed", up)
+		}
+	}
+	if !contains(c.Interface.PostUp, "ip6tables -A FORWARD -o %i -s fd00:10::/64 -j ACCEPT") {
+		t.Errorf("PostUp:\n%s", strings.Join(c.Interface.PostUp, "\n"))
+	}
+}
@@ -0,0 +1,160 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package wireguard
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const tokenPrefix = "gomesh1"
+
+// Token is an enrollment token allowing nodes to join a network
+type Token struct {
+	ID      string
+	Network string
+	Tags    []string `json:",omitempty"`
+	Created time.Time
+	Expires time.Time
+	Uses    int
+	Used    int
+	Revoked bool `json:",omitempty"`
+}
+
+// TokenStore holds the issued tokens and the secret they are signed with
+type TokenStore struct {
+	Secret []byte
+	Tokens []Token
+}
+
+type tokenPayload struct {
+	ID      string
+	Network string
+	Expires int64
+}
+
+// ErrInvalidToken is returned when redeeming a token that is
+// forged, unknown, revoked, expired or used up
+var ErrInvalidToken = errors.New("invalid token")
+
+// LoadTokens will load the token store kept next to the
+// registry, creating its signing secret if needed
+func LoadTokens() (*TokenStore, error) {
+	s := &TokenStore{}
+	if err := loadSidecar("tokens.json", s); err != nil {
+		return nil, err
+	}
+	if len(s.Secret) == 0 {
+		s.Secret = make([]byte, 32)
+		if _, err := rand.Read(s.Secret); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// DumpTokens will write the token store next to the registry
+func (s *TokenStore) DumpTokens() error {
+	return dumpSidecar("tokens.json", s)
+}
+
+// Outstanding reports whether the token can still be redeemed
+func (t Token) Outstanding(now time.Time) bool {
+	return !t.Revoked && now.Before(t.Expires) && t.Used < t.Uses
+}
+
+// Create will issue a signed token for network
+func (s *TokenStore) Create(network string, ttl time.Duration, uses int, tags []string) (string, Token, error) {
+	if uses < 1 {
+		return "", Token{}, errors.New("a token needs at least one use")
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", Token{}, err
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	t := Token{ID: hex.EncodeToString(id), Network: network, Tags: tags, Created: now, Expires: now.Add(ttl), Uses: uses}
+
+	payload, err := json.Marshal(tokenPayload{ID: t.ID, Network: t.Network, Expires: t.Expires.Unix()})
+	if err != nil {
+		return "", Token{}, err
+	}
+	signed := tokenPrefix + "." + base64.RawURLEncoding.EncodeToString(payload)
+	s.Tokens = append(s.Tokens, t)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(s.sign(signed)), t, s.DumpTokens()
+}
+
+// Revoke will revoke the token with the given ID
+func (s *TokenStore) Revoke(id string) error {
+	for i := range s.Tokens {
+		if s.Tokens[i].ID == id {
+			s.Tokens[i].Revoked = true
+			return s.DumpTokens()
+		}
+	}
+	return fmt.Errorf("token %s not found", id)
+}
+
+// Redeem will check the token and count one use of it, the
+// caller must DumpTokens once the join succeeded
+func (s *TokenStore) Redeem(token string, now time.Time) (Token, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != tokenPrefix {
+		return Token{}, ErrInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, s.sign(parts[0]+"."+parts[1])) {
+		return Token{}, ErrInvalidToken
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return Token{}, ErrInvalidToken
+	}
+	var p tokenPayload
+	if err = json.Unmarshal(b, &p); err != nil {
+		return Token{}, ErrInvalidToken
+	}
+	for i := range s.Tokens {
+		if s.Tokens[i].ID == p.ID {
+			if !s.Tokens[i].Outstanding(now) {
+				return Token{}, fmt.Errorf("%w: revoked, expired or used up", ErrInvalidToken)
+			}
+			s.Tokens[i].Used++
+			return s.Tokens[i], nil
+		}
+	}
+	return Token{}, ErrInvalidToken
+}
+
+func (s *TokenStore) sign(msg string) []byte {
+	mac := hmac.New(sha256.New, s.Secret)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,76 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package wireguard
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const vaultHeader = "$ANSIBLE_VAULT;1.1;AES256"
+
+// VaultEncrypt will encrypt plaintext with password using the
+// ansible-vault 1.1 AES256 format so that it can be used
+// inline with the !vault tag or decrypted by ansible-vault
+func VaultEncrypt(plaintext, password []byte) (string, error) {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	// ansible derives the AES key, the HMAC key and the CTR
+	// counter from a single PBKDF2 run
+	derived := pbkdf2.Key(password, salt, 10000, 2*32+aes.BlockSize, sha256.New)
+	key1, key2, iv := derived[:32], derived[32:64], derived[64:]
+
+	block, err := aes.NewCipher(key1)
+	if err != nil {
+		return "", err
+	}
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	padded := append(append([]byte{}, plaintext...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	ciphertext := make([]byte, len(padded))
+	cipher.NewCTR(block, iv).XORKeyStream(ciphertext, padded)
+
+	mac := hmac.New(sha256.New, key2)
+	mac.Write(ciphertext)
+
+	inner := hex.EncodeToString(salt) + "\n" + hex.EncodeToString(mac.Sum(nil)) + "\n" + hex.EncodeToString(ciphertext)
+	outer := hex.EncodeToString([]byte(inner))
+
+	var b strings.Builder
+	b.WriteString(vaultHeader)
+	for len(outer) > 80 {
+		b.WriteString("\n" + outer[:80])
+		outer = outer[80:]
+	}
+	b.WriteString("\n" + outer + "\n")
+	return b.String(), nil
+}
@@ -0,0 +1,127 @@
+/*
+Copyright © 2021 JPI Technologies Ltd <oss@jpi.io>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package wireguard
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// vaultDecrypt will decrypt an ansible-vault 1.1 AES256 payload the way
+// ansible-vault does: unwrap and unhexlify it, split it into the salt,
+// the HMAC and the ciphertext, check the HMAC and strip the padding
+func vaultDecrypt(t *testing.T, vault string, password []byte) ([]byte, error) {
+	t.Helper()
+	lines := strings.Split(strings.TrimSuffix(vault, "\n"), "\n")
+	if lines[0] != "$ANSIBLE_VAULT;1.1;AES256" {
+		return nil, errors.New("bad header " + lines[0])
+	}
+	for _, l := range lines[1:] {
+		if len(l) > 80 {
+			return nil, errors.New("line longer than 80 characters")
+		}
+	}
+	inner, err := hex.DecodeString(strings.Join(lines[1:], ""))
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(string(inner), "\n")
+	if len(parts) != 3 {
+		return nil, errors.New("expected salt, hmac and ciphertext")
+	}
+	var fields [3][]byte
+	for i, p := range parts {
+		if fields[i], err = hex.DecodeString(p); err != nil {
+			return nil, err
+		}
+	}
+	salt, sum, ciphertext := fields[0], fields[1], fields[2]
+	if len(salt) != 32 {
+		return nil, errors.New("salt is not 32 bytes")
+	}
+
+	derived := pbkdf2.Key(password, salt, 10000, 80, sha256.New)
+	mac := hmac.New(sha256.New, derived[32:64])
+	mac.Write(ciphertext)
+	if !hmac.Equal(mac.Sum(nil), sum) {
+		return nil, errors.New("HMAC mismatch")
+	}
+	block, err := aes.NewCipher(derived[:32])
+	if err != nil {
+		return nil, err
+	}
+	padded := make([]byte, len(ciphertext))
+	cipher.NewCTR(block, derived[64:80]).XORKeyStream(padded, ciphertext)
+	if len(padded) == 0 || len(padded)%aes.BlockSize != 0 {
+		return nil, errors.New("ciphertext is not padded to the block size")
+	}
+	n := int(padded[len(padded)-1])
+	if n == 0 || n > aes.BlockSize || !bytes.Equal(padded[len(padded)-n:], bytes.Repeat([]byte{byte(n)}, n)) {
+		return nil, errors.New("bad PKCS7 padding")
+	}
+	return padded[:len(padded)-n], nil
+}
+
+func TestVaultEncrypt(t *testing.T) {
+	password := []byte("correct horse")
+	for _, plaintext := range []string{
+		"",
+		"a",
+		"exactly 16 bytes",
+		"uMdl0tTcVSxEO4pHJFnlKlqJBuUxBHGqYm4yORxBy3o=",
+		strings.Repeat("long secret ", 40),
+	} {
+		v, err := VaultEncrypt([]byte(plaintext), password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(v, "$ANSIBLE_VAULT;1.1;AES256\n") || !strings.HasSuffix(v, "\n") {
+			t.Errorf("%q: not an ansible vault:\n%s", plaintext, v)
+		}
+		got, err := vaultDecrypt(t, v, password)
+		if err != nil {
+			t.Fatalf("%q: %v", plaintext, err)
+		}
+		if string(got) != plaintext {
+			t.Errorf("got %q, expected %q", got, plaintext)
+		}
+		if _, err = vaultDecrypt(t, v, []byte("wrong")); err == nil {
+			t.Errorf("%q: decrypted with the wrong password", plaintext)
+		}
+	}
+
+	// every payload has a salt of its own
+	a, _ := VaultEncrypt([]byte("secret"), password)
+	b, _ := VaultEncrypt([]byte("secret"), password)
+	if a == b {
+		t.Error("the same payload twice")
+	}
+}